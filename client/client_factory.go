@@ -22,10 +22,11 @@ import (
 	go_logger "github.com/phachon/go-logger"
 	"regexp"
 	"strings"
+	"text/template"
 	"time"
 )
 
-func createDiscoveryClient(discoveryMap map[string]model.Discovery,
+func createDiscoveryClient(discoveryMap map[string]model.Discovery, plugins map[string]model.Plugin,
 	logger *go_logger.Logger) (iClients map[string]discovery.DiscoveryClient, err error) {
 	var client discovery.DiscoveryClient
 	iClients = make(map[string]discovery.DiscoveryClient)
@@ -36,17 +37,50 @@ func createDiscoveryClient(discoveryMap map[string]model.Discovery,
 			client = &discovery.EurekaClient{Config: server, Logger: logger}
 			break
 		case model.NACOS_DISCOVERY:
-			client = &discovery.NacosClient{Config: server, Logger: logger}
+			v, ok := server.Config["version"]
+			ApiVersion := model.NACOS_V1
+			if ok && strings.ToLower(v) == string(model.NACOS_V2) {
+				ApiVersion = model.NACOS_V2
+			}
+			client = &discovery.NacosClient{Config: server, Logger: logger, ApiVersion: ApiVersion}
+			break
+		case model.CONSUL_DISCOVERY:
+			client = &discovery.ConsulClient{Config: server, Logger: logger}
+			break
+		case model.ETCD_DISCOVERY:
+			client = &discovery.EtcdClient{Config: server, Logger: logger}
+			break
+		case model.ZK_DISCOVERY:
+			client = &discovery.ZookeeperClient{Config: server, Logger: logger}
+			break
+		case model.K8S_DISCOVERY:
+			client = &discovery.KubernetesClient{Config: server, Logger: logger}
+			break
+		case model.DNS_DISCOVERY:
+			client = &discovery.DnsClient{Config: server, Logger: logger}
+			break
+		case model.FILE_DISCOVERY:
+			client = &discovery.FileClient{Config: server, Logger: logger}
+			break
+		case model.HTTP_JSON_DISCOVERY:
+			client = &discovery.HttpJsonClient{Config: server, Logger: logger}
+			break
+		case model.DOCKER_DISCOVERY:
+			client = &discovery.DockerClient{Config: server, Logger: logger}
 			break
 		default:
-			return nil, errors.New(fmt.Sprintf("Does not support%s", server.Type))
+			plugin, ok := plugins[string(server.Type)]
+			if !ok || plugin.Kind != model.DISCOVERY_PLUGIN {
+				return nil, errors.New(fmt.Sprintf("Does not support%s", server.Type))
+			}
+			client = &discovery.PluginClient{Config: server, Plugin: plugin, Logger: logger}
 		}
 		iClients[name] = client
 	}
 	return
 }
 
-func createGatewayClient(gatewayMap map[string]model.Gateway,
+func createGatewayClient(gatewayMap map[string]model.Gateway, plugins map[string]model.Plugin,
 	logger *go_logger.Logger) (iClients map[string]gateway.GatewayClient, err error) {
 	var client gateway.GatewayClient
 	iClients = make(map[string]gateway.GatewayClient)
@@ -65,8 +99,32 @@ func createGatewayClient(gatewayMap map[string]model.Gateway,
 		case model.KONG_GATEWAY:
 			client = &gateway.KongClient{Config: server, Logger: logger}
 			break
+		case model.NGINX_GATEWAY:
+			client = &gateway.NginxClient{Config: server, Logger: logger}
+			break
+		case model.ENVOY_GATEWAY:
+			envoyClient := &gateway.EnvoyClient{Config: server, Logger: logger}
+			// envoy may connect before the first sync
+			if err = envoyClient.Start(); err != nil {
+				return nil, err
+			}
+			client = envoyClient
+			break
+		case model.TRAEFIK_GATEWAY:
+			client = &gateway.TraefikClient{Config: server, Name: name, Logger: logger}
+			break
+		case model.HAPROXY_GATEWAY:
+			client = &gateway.HaproxyClient{Config: server, Logger: logger}
+			break
+		case model.CADDY_GATEWAY:
+			client = &gateway.CaddyClient{Config: server, Logger: logger}
+			break
 		default:
-			return nil, errors.New(fmt.Sprintf("Does not support%s", server.Type))
+			plugin, ok := plugins[string(server.Type)]
+			if !ok || plugin.Kind != model.GATEWAY_PLUGIN {
+				return nil, errors.New(fmt.Sprintf("Does not support%s", server.Type))
+			}
+			client = &gateway.PluginClient{Config: server, Plugin: plugin, Logger: logger}
 		}
 		iClients[name] = client
 	}
@@ -94,8 +152,22 @@ func GetHealthMap() map[string]int64 {
 }
 
 func CreateSyncer(config *model.Config, logger *go_logger.Logger) (syncers []Syncer, err error) {
-	discoveryClientMap, err = createDiscoveryClient(config.DiscoveryServers, logger)
-	gatewayClientMap, err = createGatewayClient(config.GatewayServers, logger)
+	// clients of last configuration are kept if any client fails to create
+	discoveryClients, err := createDiscoveryClient(config.DiscoveryServers, config.Plugins, logger)
+	if err != nil {
+		logger.Errorf("create discovery client failed, err:%s", err)
+		return nil, err
+	}
+	gatewayClients, err := createGatewayClient(config.GatewayServers, config.Plugins, logger)
+	if err != nil {
+		logger.Errorf("create gateway client failed, err:%s", err)
+		return nil, err
+	}
+	discoveryClientMap, gatewayClientMap = discoveryClients, gatewayClients
+	// zookeeper connections of removed or changed discoveries
+	discovery.ReleaseZookeeperConns(config.DiscoveryServers)
+	// xDS servers of removed envoy gateways or changed listen
+	gateway.ReleaseEnvoyServers(config.GatewayServers)
 
 	var unid string
 	var syncer Syncer
@@ -132,6 +204,20 @@ func CreateSyncer(config *model.Config, logger *go_logger.Logger) (syncers []Syn
 				syncer.UpstreamPrefix = target.Discovery
 			}
 		}
+		upstreamName := target.UpstreamName
+		// same service name in different namespaces or groups, upstream-prefix-serviceName is not unique
+		if len(upstreamName) == 0 && config.DiscoveryServers[target.Discovery].Type == model.NACOS_DISCOVERY &&
+			isMultiNacosScope(target.Config) {
+			upstreamName = defaultNacosUpstreamName
+		}
+		if len(upstreamName) > 0 {
+			tpl, tplErr := template.New(unid).Parse(upstreamName)
+			if tplErr != nil {
+				logger.Errorf("%s,invalid upstream-name:%s,err:%s", unid, upstreamName, tplErr)
+				continue
+			}
+			syncer.UpstreamNameTpl = tpl
+		}
 		syncers = append(syncers, syncer)
 
 		healthMap[syncer.Key] = time.Now().Unix()
@@ -140,6 +226,15 @@ func CreateSyncer(config *model.Config, logger *go_logger.Logger) (syncers []Syn
 	return
 }
 
+const defaultNacosUpstreamName = `{{.Prefix}}-{{or .Ext.namespaceId "public"}}-{{.Ext.groupName}}-{{.Name}}`
+
+// isMultiNacosScope sync services of more than one namespace or group
+func isMultiNacosScope(config map[string]string) bool {
+	namespaceId := strings.TrimSpace(config["namespaceId"])
+	return namespaceId == "*" || strings.Contains(namespaceId, ",") ||
+		strings.ContainsAny(config["groupName"], "*?[,")
+}
+
 type Syncer struct {
 	DiscoveryClient    discovery.DiscoveryClient
 	GatewayClient      gateway.GatewayClient
@@ -149,6 +244,7 @@ type Syncer struct {
 	Key                string
 	Logger             *go_logger.Logger
 	UpstreamPrefix     string
+	UpstreamNameTpl    *template.Template
 	MaximumIntervalSec int64
 }
 
@@ -160,6 +256,7 @@ func (syncer *Syncer) Run() {
 		panic(err)
 	}
 	var isExclude bool
+	upstreamNames := map[string]bool{}
 	for _, service := range services {
 		isExclude = false
 		for _, name := range syncer.ExcludeService {
@@ -171,6 +268,14 @@ func (syncer *Syncer) Run() {
 		if isExclude {
 			continue
 		}
+		// same service name in different namespaces or groups
+		upstreamName := syncer.getUpstreamName(service)
+		if upstreamNames[upstreamName] {
+			syncer.Logger.Errorf("duplicate upstream name:%s, service:%s, ext:%#v, please check upstream-name of %s",
+				upstreamName, service.Name, service.Ext, syncer.Key)
+			continue
+		}
+		upstreamNames[upstreamName] = true
 		syncer.syncServiceInstances(service)
 	}
 
@@ -186,19 +291,26 @@ func (syncer *Syncer) syncServiceInstances(service model.Service) {
 	if len(service.Instances) > 0 {
 		discoveryInstances = service.Instances
 	} else {
-		vo := model.GetInstanceVo{ServiceName: service.Name, ExtData: syncer.Config}
+		extData := map[string]string{}
+		for k, v := range syncer.Config {
+			extData[k] = v
+		}
+		for k, v := range service.Ext {
+			extData[k] = v
+		}
+		vo := model.GetInstanceVo{ServiceName: service.Name, ExtData: extData}
 		discoveryInstances, err = syncer.DiscoveryClient.GetServiceAllInstances(vo)
 
 		syncer.Logger.Debugf("Sync serviceName:%s", service.Name)
 		if err != nil {
-			syncer.Logger.Errorf("fetch discovery %s failed,syncer:%#v,err:", service.Name, syncer, err)
+			syncer.Logger.Errorf("fetch discovery %s failed,syncer:%#v,err:%s", service.Name, syncer, err)
 			panic(err)
 		}
 	}
 
-	gatewayInstances, err := syncer.GatewayClient.GetServiceAllInstances(syncer.getUpstreamName(service.Name))
+	gatewayInstances, err := syncer.GatewayClient.GetServiceAllInstances(syncer.getUpstreamName(service))
 	if err != nil {
-		syncer.Logger.Errorf("fetch gateway %s failed,syncer:%#v,err:%s", syncer.getUpstreamName(service.Name), syncer, err)
+		syncer.Logger.Errorf("fetch gateway %s failed,syncer:%#v,err:%s", syncer.getUpstreamName(service), syncer, err)
 		panic(err)
 	}
 
@@ -251,16 +363,29 @@ func (syncer *Syncer) syncServiceInstances(service model.Service) {
 	if len(diffIns) > 0 {
 		tpl, _ := syncer.Config["template"]
 
-		err = syncer.GatewayClient.SyncInstances(syncer.getUpstreamName(service.Name), tpl, discoveryInstances, diffIns)
+		err = syncer.GatewayClient.SyncInstances(syncer.getUpstreamName(service), tpl, discoveryInstances, diffIns)
 		if err != nil {
-			syncer.Logger.Errorf("update gateway %s failed,discoveryInstances:%s,diffIns:%s,syncer:%#v,err:%s",
-				syncer.getUpstreamName(service.Name), discoveryInstances, diffIns, syncer, err)
+			syncer.Logger.Errorf("update gateway %s failed,discoveryInstances:%#v,diffIns:%#v,syncer:%#v,err:%s",
+				syncer.getUpstreamName(service), discoveryInstances, diffIns, syncer, err)
 			panic(err)
 		}
 	}
 
-	syncer.Logger.Infof("Sync serviceName:%s,diffIns:%#v", syncer.getUpstreamName(service.Name), diffIns)
+	syncer.Logger.Infof("Sync serviceName:%s,diffIns:%#v", syncer.getUpstreamName(service), diffIns)
 }
-func (syncer *Syncer) getUpstreamName(serviceName string) string {
-	return syncer.UpstreamPrefix + "-" + serviceName
+func (syncer *Syncer) getUpstreamName(service model.Service) string {
+	if syncer.UpstreamNameTpl == nil {
+		return syncer.UpstreamPrefix + "-" + service.Name
+	}
+	var buf strings.Builder
+	err := syncer.UpstreamNameTpl.Execute(&buf, map[string]interface{}{
+		"Prefix": syncer.UpstreamPrefix,
+		"Name":   service.Name,
+		"Ext":    service.Ext,
+	})
+	if err != nil {
+		syncer.Logger.Errorf("render upstream-name failed, service:%s, ext:%#v, err:%s", service.Name, service.Ext, err)
+		return syncer.UpstreamPrefix + "-" + service.Name
+	}
+	return buf.String()
 }
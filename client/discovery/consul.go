@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+type ConsulClient struct {
+	Client http.Client
+	Config model.Discovery
+	Logger *go_logger.Logger
+}
+
+func (consulClient *ConsulClient) GetAllService(data map[string]string) ([]model.Service, error) {
+	// /v1/catalog/services?dc=
+	r := url.Values{}
+	consulClient.setDatacenter(r, data)
+
+	uri := consulClient.Config.Host + consulClient.Config.Prefix + "catalog/services?" + r.Encode()
+	resp, err := consulClient.httpDo(uri, "GET")
+	if err != nil {
+		consulClient.Logger.Errorf("fetch consul service error, uri:%s, err:%s", uri, err)
+		return nil, errors.New("fetch consul service error")
+	}
+	if 200 != resp.StatusCode {
+		_ = resp.Body.Close()
+		consulClient.Logger.Errorf("fetch consul service error, uri:%s, status:%s", uri, resp.Status)
+		return nil, errors.New("fetch consul service error")
+	}
+
+	servicesResp := model.ConsulServicesResp{}
+	err = json.NewDecoder(resp.Body).Decode(&servicesResp)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		consulClient.Logger.Errorf("fetch consul service error, uri:%s, err:%s", uri, err)
+		return nil, errors.New("fetch consul service error")
+	}
+	consulClient.Logger.Debugf("fetch consul service, uri:%s, servicesResp:%#v", uri, servicesResp)
+
+	tag, hasTag := data["tag"]
+	services := []model.Service{}
+	for name, tags := range servicesResp {
+		if hasTag && len(tag) > 0 && !slices.Contains(tags, tag) {
+			continue
+		}
+		services = append(services, model.Service{Name: name})
+	}
+	return services, nil
+}
+
+func (consulClient *ConsulClient) GetServiceAllInstances(vo model.GetInstanceVo) ([]model.Instance, error) {
+	// /v1/health/service/:service?passing=true&dc=&tag=
+	r := url.Values{}
+	consulClient.setDatacenter(r, vo.ExtData)
+	if tag, ok := vo.ExtData["tag"]; ok && len(tag) > 0 {
+		r.Set("tag", tag)
+	}
+	passingOnly, ok := vo.ExtData["passingOnly"]
+	if !ok || strings.ToLower(passingOnly) != "false" {
+		r.Set("passing", "true")
+	}
+
+	uri := consulClient.Config.Host + consulClient.Config.Prefix + "health/service/" +
+		url.PathEscape(vo.ServiceName) + "?" + r.Encode()
+	resp, err := consulClient.httpDo(uri, "GET")
+	if err != nil {
+		consulClient.Logger.Errorf("fetch consul service instance error, uri:%s, err:%s", uri, err)
+		return nil, errors.New("fetch consul service instance error")
+	}
+	if 404 == resp.StatusCode {
+		_ = resp.Body.Close()
+		return []model.Instance{}, nil
+	} else if 200 != resp.StatusCode {
+		_ = resp.Body.Close()
+		consulClient.Logger.Errorf("fetch consul service instance error, uri:%s, status:%s", uri, resp.Status)
+		return nil, errors.New("fetch consul service instance error")
+	}
+
+	entries := []model.ConsulServiceEntry{}
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		consulClient.Logger.Errorf("fetch consul service instance error, uri:%s, err:%s", uri, err)
+		return nil, errors.New("fetch consul service instance error")
+	}
+	consulClient.Logger.Debugf("fetch consul service:%s,entries:%#v", uri, entries)
+
+	instances := []model.Instance{}
+	for _, entry := range entries {
+		instances = append(instances, convertConsulInstance(entry, consulClient.Config.Weight))
+	}
+	return instances, nil
+}
+
+func convertConsulInstance(entry model.ConsulServiceEntry, defaultWeight float32) model.Instance {
+	ip := entry.Service.Address
+	if len(ip) == 0 {
+		ip = entry.Node.Address
+	}
+
+	// meta first, then tags, plain tags are also kept as "tags"
+	metadata := map[string]string{}
+	for _, tag := range entry.Service.Tags {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 2 {
+			metadata[kv[0]] = kv[1]
+		}
+	}
+	for k, v := range entry.Service.Meta {
+		metadata[k] = v
+	}
+	if len(entry.Service.Tags) > 0 {
+		metadata["tags"] = strings.Join(entry.Service.Tags, ",")
+	}
+
+	status := "passing"
+	for _, check := range entry.Checks {
+		if check.Status == "critical" || check.Status == "maintenance" {
+			status = check.Status
+			break
+		}
+		if check.Status == "warning" {
+			status = check.Status
+		}
+	}
+
+	weight := defaultWeight
+	if status == "warning" && entry.Service.Weights.Warning > 0 {
+		weight = float32(entry.Service.Weights.Warning)
+	} else if entry.Service.Weights.Passing > 0 {
+		weight = float32(entry.Service.Weights.Passing)
+	}
+
+	return model.Instance{
+		Ip:       ip,
+		Port:     entry.Service.Port,
+		Weight:   weight,
+		Metadata: metadata,
+		Ext: map[string]string{
+			"serviceId":  entry.Service.ID,
+			"node":       entry.Node.Node,
+			"datacenter": entry.Node.Datacenter,
+			"status":     status,
+		}}
+}
+
+func (consulClient *ConsulClient) ModifyRegistration(registration model.Registration, instances []model.Instance) error {
+	for _, instance := range instances {
+		if !instance.Change {
+			continue
+		}
+		// only works on the agent which the service registered
+		// PUT /v1/agent/service/maintenance/:service_id?enable=true&reason=
+		r := url.Values{}
+		r.Set("enable", "true")
+		if instance.Enabled {
+			r.Set("enable", "false")
+		}
+		r.Set("reason", "discovery-syncer")
+		uri := consulClient.Config.Host + consulClient.Config.Prefix + "agent/service/maintenance/" +
+			url.PathEscape(instance.Ext["serviceId"]) + "?" + r.Encode()
+		resp, err := consulClient.httpDo(uri, "PUT")
+		if err != nil {
+			consulClient.Logger.Errorf("change consul %s instance %#v failed, err:%s", registration.ServiceName,
+				instance, err)
+			return err
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		// 403 without acl permission, 404 if the service is not registered on this agent
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			consulClient.Logger.Errorf("change consul %s instance %#v failed, uri:%s, status:%s, body:%s",
+				registration.ServiceName, instance, uri, resp.Status, body)
+			return errors.New(fmt.Sprintf("change consul instance failed, uri:%s, status:%s, body:%s", uri,
+				resp.Status, body))
+		}
+		consulClient.Logger.Debugf("change consul %s instance %#v,body:%s,status:%s", registration.ServiceName,
+			instance, string(body), resp.Status)
+	}
+	return nil
+}
+
+func (consulClient *ConsulClient) setDatacenter(r url.Values, data map[string]string) {
+	dc, ok := data["datacenter"]
+	if !ok || len(dc) == 0 {
+		dc = consulClient.Config.Config["datacenter"]
+	}
+	if len(dc) > 0 {
+		r.Set("dc", dc)
+	}
+}
+
+func (consulClient *ConsulClient) httpDo(uri string, method string) (*http.Response, error) {
+	hc := &http.Client{Timeout: 30 * time.Second}
+
+	req, _ := http.NewRequest(method, uri, nil)
+	req.Header.Add("Accept", "application/json")
+	if token, ok := consulClient.Config.Config["token"]; ok && len(token) > 0 {
+		req.Header.Add("X-Consul-Token", token)
+	}
+	return hc.Do(req)
+}
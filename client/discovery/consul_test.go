@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package discovery
+
+import (
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestConsulCatalog(t *testing.T) {
+	server := newFakeServer(t, false, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Consul-Token") != "secret" {
+			writeJson(w, http.StatusForbidden, "ACL not found")
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/catalog/services":
+			writeJson(w, http.StatusOK, model.ConsulServicesResp{"consul": {}, "orders": {"http", "v1"},
+				"users": {"grpc"}})
+		case "/v1/health/service/orders":
+			writeJson(w, http.StatusOK, []model.ConsulServiceEntry{
+				{Node: model.ConsulNode{Node: "n1", Address: "10.0.0.1", Datacenter: "dc1"},
+					Service: model.ConsulAgentService{ID: "orders-1", Port: 8080, Tags: []string{"http", "zone=a"},
+						Weights: model.ConsulWeights{Passing: 5, Warning: 1}}},
+				{Node: model.ConsulNode{Node: "n2", Address: "10.0.0.2", Datacenter: "dc1"},
+					Service: model.ConsulAgentService{ID: "orders-2", Address: "172.17.0.2", Port: 8080,
+						Meta: map[string]string{"zone": "b"}, Weights: model.ConsulWeights{Passing: 5, Warning: 1}},
+					Checks: []model.ConsulHealthCheck{{Status: "passing"}, {Status: "warning"}}},
+			})
+		default:
+			writeJson(w, http.StatusNotFound, "")
+		}
+	})
+	client := &ConsulClient{Config: model.Discovery{Type: model.CONSUL_DISCOVERY, Host: server.URL, Prefix: "/v1/",
+		Weight: 10, Config: map[string]string{"token": "secret", "datacenter": "dc1"}}, Logger: go_logger.NewLogger()}
+
+	tests := []struct {
+		name string
+		data map[string]string
+		want []string
+		uri  string
+	}{
+		{name: "all services", data: map[string]string{}, want: []string{"consul", "orders", "users"},
+			uri: "GET /v1/catalog/services?dc=dc1"},
+		{name: "services with tag", data: map[string]string{"tag": "http", "datacenter": "dc2"},
+			want: []string{"orders"}, uri: "GET /v1/catalog/services?dc=dc2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			services, err := client.GetAllService(tt.data)
+			if err != nil {
+				t.Fatalf("GetAllService err:%s", err)
+			}
+			names := []string{}
+			for _, service := range services {
+				names = append(names, service.Name)
+			}
+			sort.Strings(names)
+			if fmt.Sprint(names) != fmt.Sprint(tt.want) {
+				t.Errorf("services got %v, want %v", names, tt.want)
+			}
+			if requests := server.takeRequests(); fmt.Sprint(requests) != fmt.Sprint([]string{tt.uri}) {
+				t.Errorf("requests got %v, want %s", requests, tt.uri)
+			}
+		})
+	}
+
+	instances, err := client.GetServiceAllInstances(model.GetInstanceVo{ServiceName: "orders",
+		ExtData: map[string]string{"tag": "http"}})
+	if err != nil {
+		t.Fatalf("GetServiceAllInstances err:%s", err)
+	}
+	// service address first, weight of warning when any check is warning
+	if got := sortedInstances(instances); fmt.Sprint(got) != "[10.0.0.1:8080/5 172.17.0.2:8080/1]" {
+		t.Errorf("instances got %v", got)
+	}
+	for _, instance := range instances {
+		if instance.Ext["serviceId"] == "orders-1" && (instance.Metadata["zone"] != "a" ||
+			instance.Metadata["tags"] != "http,zone=a" || instance.Ext["status"] != "passing") {
+			t.Errorf("instance orders-1 got %#v", instance)
+		}
+		if instance.Ext["serviceId"] == "orders-2" && (instance.Metadata["zone"] != "b" ||
+			instance.Ext["status"] != "warning") {
+			t.Errorf("instance orders-2 got %#v", instance)
+		}
+	}
+	if requests := server.takeRequests(); len(requests) != 1 ||
+		requests[0] != "GET /v1/health/service/orders?dc=dc1&passing=true&tag=http" {
+		t.Errorf("requests got %v", requests)
+	}
+
+	instances, err = client.GetServiceAllInstances(model.GetInstanceVo{ServiceName: "missing",
+		ExtData: map[string]string{"passingOnly": "false"}})
+	if err != nil || len(instances) != 0 {
+		t.Errorf("instances of missing service got %v, err:%v", instances, err)
+	}
+}
+
+func TestConsulMaintenance(t *testing.T) {
+	server := newFakeServer(t, false, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method != "PUT":
+			writeJson(w, http.StatusMethodNotAllowed, "")
+		case r.URL.Path == "/v1/agent/service/maintenance/orders-1":
+			w.WriteHeader(http.StatusOK)
+		case r.URL.Path == "/v1/agent/service/maintenance/orders-2":
+			writeJson(w, http.StatusForbidden, "Permission denied")
+		default:
+			writeJson(w, http.StatusNotFound, "Unknown service ID")
+		}
+	})
+	client := &ConsulClient{Config: model.Discovery{Type: model.CONSUL_DISCOVERY, Host: server.URL, Prefix: "/v1/"},
+		Logger: go_logger.NewLogger()}
+
+	err := client.ModifyRegistration(model.Registration{ServiceName: "orders"}, []model.Instance{
+		{Ip: "10.0.0.1", Port: 8080, Change: true, Enabled: false, Ext: map[string]string{"serviceId": "orders-1"}},
+		{Ip: "10.0.0.3", Port: 8080, Change: false, Ext: map[string]string{"serviceId": "orders-3"}},
+	})
+	if err != nil {
+		t.Fatalf("ModifyRegistration err:%s", err)
+	}
+	requests := server.takeRequests()
+	want := "PUT /v1/agent/service/maintenance/orders-1?enable=true&reason=discovery-syncer"
+	if len(requests) != 1 || requests[0] != want {
+		t.Errorf("requests got %v, want %s", requests, want)
+	}
+
+	for _, serviceId := range []string{"orders-2", "orders-9"} {
+		err = client.ModifyRegistration(model.Registration{ServiceName: "orders"}, []model.Instance{
+			{Ip: "10.0.0.2", Port: 8080, Change: true, Enabled: true, Ext: map[string]string{"serviceId": serviceId}},
+		})
+		if err == nil || !strings.Contains(err.Error(), "status:40") {
+			t.Errorf("ModifyRegistration of %s should fail, err:%v", serviceId, err)
+		}
+	}
+	if requests = server.takeRequests(); len(requests) != 2 || !strings.Contains(requests[0], "enable=false") {
+		t.Errorf("requests got %v", requests)
+	}
+}
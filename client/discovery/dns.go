@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"errors"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DnsClient resolve the services configured in target by SRV or A/AAAA records
+type DnsClient struct {
+	Config model.Discovery
+	Logger *go_logger.Logger
+}
+
+type dnsRecord struct {
+	Name   string
+	Record string
+	Port   int
+}
+
+func (dnsClient *DnsClient) GetAllService(data map[string]string) ([]model.Service, error) {
+	records, err := parseDnsRecords(data)
+	if err != nil {
+		dnsClient.Logger.Errorf("parse dns services error, services:%s, err:%s", data["services"], err)
+		return nil, err
+	}
+	services := []model.Service{}
+	failed := 0
+	for _, record := range records {
+		instances, err := dnsClient.resolve(record, data)
+		// skip the record which resolve failed, keep the upstream as it is
+		if err != nil {
+			failed++
+			dnsClient.Logger.Errorf("resolve dns record error, record:%s, err:%s", record.Record, err)
+			continue
+		}
+		if len(instances) == 0 {
+			continue
+		}
+		services = append(services, model.Service{Name: record.Name, Instances: instances})
+	}
+	if failed > 0 && failed == len(records) {
+		return nil, errors.New("fetch dns service instance error")
+	}
+	return services, nil
+}
+
+func (dnsClient *DnsClient) GetServiceAllInstances(vo model.GetInstanceVo) ([]model.Instance, error) {
+	records, err := parseDnsRecords(vo.ExtData)
+	if err != nil {
+		dnsClient.Logger.Errorf("parse dns services error, services:%s, err:%s", vo.ExtData["services"], err)
+		return nil, err
+	}
+	for _, record := range records {
+		if record.Name != vo.ServiceName {
+			continue
+		}
+		instances, err := dnsClient.resolve(record, vo.ExtData)
+		if err != nil {
+			dnsClient.Logger.Errorf("resolve dns record error, record:%s, err:%s", record.Record, err)
+			return nil, errors.New("fetch dns service instance error")
+		}
+		return instances, nil
+	}
+	return []model.Instance{}, nil
+}
+
+func (dnsClient *DnsClient) ModifyRegistration(model.Registration, []model.Instance) error {
+	return errors.New("dns discovery does not support modify registration")
+}
+
+// parseDnsRecords services like "orders=_http._tcp.orders.internal,vendor.internal:8443",
+// record starts with "_" is SRV, others are A/AAAA with port (default is config port or 80)
+func parseDnsRecords(data map[string]string) ([]dnsRecord, error) {
+	defaultPort := 80
+	if p, ok := data["port"]; ok && len(p) > 0 {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, err
+		}
+		defaultPort = port
+	}
+	records := []dnsRecord{}
+	for _, item := range strings.Split(data["services"], ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		record := dnsRecord{Record: item, Port: defaultPort}
+		if kv := strings.SplitN(item, "=", 2); len(kv) == 2 {
+			record.Name, record.Record = kv[0], kv[1]
+		}
+		if host, p, err := net.SplitHostPort(record.Record); err == nil {
+			port, err := strconv.Atoi(p)
+			if err != nil {
+				return nil, err
+			}
+			record.Record, record.Port = host, port
+		}
+		if len(record.Name) == 0 {
+			record.Name = record.Record
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (dnsClient *DnsClient) resolve(record dnsRecord, data map[string]string) ([]model.Instance, error) {
+	resolver := dnsClient.getResolver()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	network, ok := data["network"]
+	if !ok || len(network) == 0 {
+		network = "ip"
+	}
+
+	instances := []model.Instance{}
+	if !strings.HasPrefix(record.Record, "_") {
+		ips, err := resolver.LookupIP(ctx, network, record.Record)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			recordType := "A"
+			if ip.To4() == nil {
+				recordType = "AAAA"
+			}
+			instances = append(instances, model.Instance{Ip: ip.String(), Port: record.Port,
+				Weight: dnsClient.Config.Weight, Metadata: map[string]string{},
+				Ext: map[string]string{"record": record.Record, "type": recordType}})
+		}
+		return instances, nil
+	}
+
+	_, srvs, err := resolver.LookupSRV(ctx, "", "", record.Record)
+	if err != nil {
+		return nil, err
+	}
+	for _, srv := range srvs {
+		ips, err := resolver.LookupIP(ctx, network, srv.Target)
+		if err != nil {
+			dnsClient.Logger.Warningf("resolve srv target error, record:%s, target:%s, err:%s", record.Record,
+				srv.Target, err)
+			continue
+		}
+		weight := dnsClient.Config.Weight
+		if srv.Weight > 0 {
+			weight = float32(srv.Weight)
+		}
+		for _, ip := range ips {
+			instances = append(instances, model.Instance{Ip: ip.String(), Port: int(srv.Port), Weight: weight,
+				Metadata: map[string]string{"target": strings.TrimSuffix(srv.Target, "."),
+					"priority": strconv.Itoa(int(srv.Priority))},
+				Ext: map[string]string{"record": record.Record, "type": "SRV"}})
+		}
+	}
+	return instances, nil
+}
+
+// getResolver host like udp://10.0.0.2:53 or tcp://10.0.0.2:53, system resolver if host is empty
+func (dnsClient *DnsClient) getResolver() *net.Resolver {
+	if len(dnsClient.Config.Host) == 0 {
+		return net.DefaultResolver
+	}
+	u, err := url.Parse(dnsClient.Config.Host)
+	if err != nil {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: 5 * time.Second}
+			return d.DialContext(ctx, u.Scheme, u.Host)
+		},
+	}
+}
@@ -0,0 +1,324 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DockerClient list running containers with service label from docker engine api
+type DockerClient struct {
+	Config model.Discovery
+	Logger *go_logger.Logger
+	conn   *dockerConn
+	mutex  sync.Mutex
+}
+
+type dockerConn struct {
+	server string
+	hc     *http.Client
+	// host of tcp docker engine, used as ip of published ports
+	host string
+}
+
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+func (dockerClient *DockerClient) GetAllService(data map[string]string) ([]model.Service, error) {
+	serviceLabel := dockerClient.getConfig(data, "service-label")
+	containers, err := dockerClient.listContainers(serviceLabel)
+	if err != nil {
+		return nil, err
+	}
+	serviceMap := map[string][]model.DockerContainer{}
+	for _, container := range containers {
+		name := container.Labels[serviceLabel]
+		serviceMap[name] = append(serviceMap[name], container)
+	}
+	names := []string{}
+	for name := range serviceMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	services := []model.Service{}
+	for _, name := range names {
+		services = append(services, model.Service{Name: name,
+			Instances: dockerClient.convertInstances(serviceMap[name], data)})
+	}
+	return services, nil
+}
+
+func (dockerClient *DockerClient) GetServiceAllInstances(vo model.GetInstanceVo) ([]model.Instance, error) {
+	serviceLabel := dockerClient.getConfig(vo.ExtData, "service-label")
+	containers, err := dockerClient.listContainers(serviceLabel + "=" + vo.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	instances := dockerClient.convertInstances(containers, vo.ExtData)
+	dockerClient.Logger.Debugf("fetch docker service:%s,instances:%#v", vo.ServiceName, instances)
+	return instances, nil
+}
+
+func (dockerClient *DockerClient) ModifyRegistration(model.Registration, []model.Instance) error {
+	return errors.New("docker discovery does not support modify registration")
+}
+
+// listContainers GET /containers/json?filters={"label":["syncer.service"],"status":["running"]}
+func (dockerClient *DockerClient) listContainers(label string) ([]model.DockerContainer, error) {
+	conn, err := dockerClient.getConn()
+	if err != nil {
+		dockerClient.Logger.Errorf("connect docker error, host:%s, err:%s", dockerClient.Config.Host, err)
+		return nil, errors.New("connect docker error")
+	}
+	// prefix is the api version, like /v1.41/, unversioned api is used if empty
+	prefix := dockerClient.Config.Prefix
+	if len(prefix) == 0 {
+		prefix = "/"
+	}
+	filters, _ := json.Marshal(map[string][]string{"label": {label}, "status": {"running"}})
+	uri := conn.server + prefix + "containers/json?filters=" + url.QueryEscape(string(filters))
+
+	req, _ := http.NewRequest("GET", uri, nil)
+	req.Header.Add("Accept", "application/json")
+	resp, err := conn.hc.Do(req)
+	if err != nil {
+		dockerClient.Logger.Errorf("fetch docker containers error, uri:%s, err:%s", uri, err)
+		return nil, errors.New("fetch docker containers error")
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		dockerClient.Logger.Errorf("fetch docker containers error, uri:%s, status:%s, body:%s, err:%v",
+			uri, resp.Status, body, err)
+		return nil, errors.New("fetch docker containers error")
+	}
+	containers := []model.DockerContainer{}
+	if err = json.Unmarshal(body, &containers); err != nil {
+		dockerClient.Logger.Errorf("fetch docker containers error, uri:%s, err:%s", uri, err)
+		return nil, errors.New("fetch docker containers error")
+	}
+	dockerClient.Logger.Debugf("fetch docker containers, uri:%s, containers:%d", uri, len(containers))
+	return containers, nil
+}
+
+func (dockerClient *DockerClient) convertInstances(containers []model.DockerContainer,
+	data map[string]string) []model.Instance {
+	portLabel := dockerClient.getConfig(data, "port-label")
+	weightLabel := dockerClient.getConfig(data, "weight-label")
+	addressType := dockerClient.getConfig(data, "address-type")
+	network := dockerClient.getConfig(data, "network")
+	hostIp := dockerClient.getConfig(data, "host-ip")
+	if len(hostIp) == 0 && dockerClient.conn != nil {
+		hostIp = dockerClient.conn.host
+	}
+
+	instances := []model.Instance{}
+	for _, container := range containers {
+		name := strings.TrimPrefix(strings.Join(container.Names, ","), "/")
+		port, err := getContainerPort(container, container.Labels[portLabel])
+		if err != nil {
+			dockerClient.Logger.Warningf("skip docker container:%s, err:%s", name, err)
+			continue
+		}
+		var ip string
+		if addressType == "host" {
+			ip, port, err = getPublishedAddress(container, port, hostIp)
+		} else if container.HostConfig.NetworkMode == "host" {
+			ip = hostIp
+		} else {
+			ip, err = getContainerIp(container, network)
+		}
+		if err == nil && len(ip) == 0 {
+			err = errors.New("host-ip is required")
+		}
+		if err != nil {
+			dockerClient.Logger.Warningf("skip docker container:%s, err:%s", name, err)
+			continue
+		}
+
+		weight := dockerClient.Config.Weight
+		if w, ok := container.Labels[weightLabel]; ok {
+			if v, err := strconv.ParseFloat(w, 32); err == nil {
+				weight = float32(v)
+			}
+		}
+		instances = append(instances, model.Instance{Ip: ip, Port: port, Weight: weight,
+			Metadata: container.Labels,
+			Ext:      map[string]string{"containerId": container.Id, "containerName": name}})
+	}
+	return instances
+}
+
+// getContainerPort port label first, or the only exposed tcp port
+func getContainerPort(container model.DockerContainer, portLabel string) (int, error) {
+	if len(portLabel) > 0 {
+		return strconv.Atoi(portLabel)
+	}
+	ports := map[int]bool{}
+	for _, port := range container.Ports {
+		if port.Type == "tcp" {
+			ports[port.PrivatePort] = true
+		}
+	}
+	if len(ports) != 1 {
+		return 0, errors.New(fmt.Sprintf("port label is required, exposed ports:%d", len(ports)))
+	}
+	for port := range ports {
+		return port, nil
+	}
+	return 0, nil
+}
+
+// getPublishedAddress host ip and published port of container port
+func getPublishedAddress(container model.DockerContainer, privatePort int, hostIp string) (string, int, error) {
+	for _, port := range container.Ports {
+		if port.PrivatePort != privatePort || port.PublicPort == 0 || port.Type != "tcp" {
+			continue
+		}
+		ip := port.IP
+		if len(ip) == 0 || ip == "0.0.0.0" || ip == "::" {
+			ip = hostIp
+		}
+		return ip, port.PublicPort, nil
+	}
+	return "", 0, errors.New(fmt.Sprintf("port %d is not published", privatePort))
+}
+
+// getContainerIp ip of the network, or the first network sorted by name
+func getContainerIp(container model.DockerContainer, network string) (string, error) {
+	if len(network) > 0 {
+		settings, ok := container.NetworkSettings.Networks[network]
+		if !ok || len(settings.IPAddress) == 0 {
+			return "", errors.New(fmt.Sprintf("network %s not found", network))
+		}
+		return settings.IPAddress, nil
+	}
+	names := []string{}
+	for name := range container.NetworkSettings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if ip := container.NetworkSettings.Networks[name].IPAddress; len(ip) > 0 {
+			return ip, nil
+		}
+	}
+	return "", errors.New("no container ip found")
+}
+
+// getConfig target config first, then discovery config, then default
+func (dockerClient *DockerClient) getConfig(data map[string]string, key string) string {
+	if v, ok := data[key]; ok && len(v) > 0 {
+		return v
+	}
+	if v, ok := dockerClient.Config.Config[key]; ok && len(v) > 0 {
+		return v
+	}
+	switch key {
+	case "service-label":
+		return "syncer.service"
+	case "port-label":
+		return "syncer.port"
+	case "weight-label":
+		return "syncer.weight"
+	case "address-type":
+		return "container"
+	}
+	return ""
+}
+
+// getConn unix:///var/run/docker.sock, tcp://host:2375, or https://host:2376 with tls
+func (dockerClient *DockerClient) getConn() (*dockerConn, error) {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	if dockerClient.conn != nil {
+		return dockerClient.conn, nil
+	}
+
+	host := dockerClient.Config.Host
+	if len(host) == 0 {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if len(host) == 0 {
+		host = defaultDockerHost
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	config := dockerClient.Config.Config
+	transport := &http.Transport{}
+	conn := &dockerConn{hc: &http.Client{Timeout: 30 * time.Second, Transport: transport}}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		}
+		conn.server = "http://docker"
+	case "tcp", "http", "https":
+		scheme := "http"
+		if u.Scheme == "https" || len(config["ca-file"]) > 0 || len(config["cert-file"]) > 0 {
+			scheme = "https"
+			tlsConfig, err := newDockerTlsConfig(config)
+			if err != nil {
+				return nil, err
+			}
+			transport.TLSClientConfig = tlsConfig
+		}
+		conn.server = scheme + "://" + u.Host
+		conn.host = u.Hostname()
+	default:
+		return nil, errors.New(fmt.Sprintf("invalid docker host:%s", host))
+	}
+	dockerClient.conn = conn
+	return conn, nil
+}
+
+func newDockerTlsConfig(config map[string]string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: strings.ToLower(config["insecure-skip-tls-verify"]) == "true"}
+	if caFile := config["ca-file"]; len(caFile) > 0 {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM(ca)
+	}
+	if certFile, keyFile := config["cert-file"], config["key-file"]; len(certFile) > 0 && len(keyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,275 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeDockerContainers containers of fake docker engine, the filters of list api are applied by the fake
+var fakeDockerContainers = []model.DockerContainer{
+	{
+		Id: "c1", Names: []string{"/web-1"}, State: "running",
+		Labels: map[string]string{"syncer.service": "web", "syncer.weight": "5"},
+		Ports:  []model.DockerPort{{PrivatePort: 8080, PublicPort: 32768, Type: "tcp", IP: "0.0.0.0"}},
+		NetworkSettings: model.DockerNetworkSettings{Networks: map[string]model.DockerNetwork{
+			"bridge": {IPAddress: "172.17.0.2"},
+			"svc":    {IPAddress: "172.20.0.2"},
+		}},
+	},
+	{
+		Id: "c2", Names: []string{"/web-2"}, State: "running",
+		Labels: map[string]string{"syncer.service": "web", "syncer.port": "9090"},
+		Ports: []model.DockerPort{
+			{PrivatePort: 8080, Type: "tcp"},
+			{PrivatePort: 9090, PublicPort: 9091, Type: "tcp", IP: "192.168.1.10"},
+		},
+		NetworkSettings: model.DockerNetworkSettings{Networks: map[string]model.DockerNetwork{
+			"zeta":   {IPAddress: "172.30.0.3"},
+			"alpha":  {},
+			"bridge": {IPAddress: "172.17.0.3"},
+		}},
+	},
+	{
+		Id: "c3", Names: []string{"/web-3"}, State: "exited",
+		Labels: map[string]string{"syncer.service": "web"},
+		Ports:  []model.DockerPort{{PrivatePort: 8080, Type: "tcp"}},
+		NetworkSettings: model.DockerNetworkSettings{Networks: map[string]model.DockerNetwork{
+			"bridge": {IPAddress: "172.17.0.4"},
+		}},
+	},
+	{
+		Id: "c4", Names: []string{"/api-1"}, State: "running",
+		Labels:     map[string]string{"syncer.service": "api", "syncer.port": "7070"},
+		HostConfig: model.DockerContainerHostConf{NetworkMode: "host"},
+	},
+	{
+		Id: "c5", Names: []string{"/redis"}, State: "running",
+		Labels: map[string]string{"com.docker.compose.service": "redis"},
+		Ports:  []model.DockerPort{{PrivatePort: 6379, Type: "tcp"}},
+		NetworkSettings: model.DockerNetworkSettings{Networks: map[string]model.DockerNetwork{
+			"bridge": {IPAddress: "172.17.0.5"},
+		}},
+	},
+}
+
+// serveFakeDocker GET /v1.41/containers/json, filters label key or key=value and status
+func serveFakeDocker(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1.41/containers/json" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	filter := map[string][]string{}
+	if err := json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filter); err != nil {
+		writeJson(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	containers := []model.DockerContainer{}
+	for _, container := range fakeDockerContainers {
+		if matchDockerFilter(filter, container) {
+			containers = append(containers, container)
+		}
+	}
+	writeJson(w, http.StatusOK, containers)
+}
+
+func matchDockerFilter(filter map[string][]string, container model.DockerContainer) bool {
+	for _, status := range filter["status"] {
+		if container.State != status {
+			return false
+		}
+	}
+	for _, label := range filter["label"] {
+		key, value, hasValue := strings.Cut(label, "=")
+		v, ok := container.Labels[key]
+		if !ok || hasValue && v != value {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDockerLabelFilter(t *testing.T) {
+	server := newFakeServer(t, false, serveFakeDocker)
+	client := &DockerClient{Config: model.Discovery{Type: model.DOCKER_DISCOVERY,
+		Host: "tcp://" + server.Listener.Addr().String(), Prefix: "/v1.41/", Weight: 10}, Logger: go_logger.NewLogger()}
+
+	services, err := client.GetAllService(nil)
+	if err != nil {
+		t.Fatalf("GetAllService err:%s", err)
+	}
+	got := []string{}
+	for _, service := range services {
+		got = append(got, fmt.Sprintf("%s:%v", service.Name, sortedInstances(service.Instances)))
+	}
+	want := []string{"api:[127.0.0.1:7070/10]", "web:[172.17.0.2:8080/5 172.17.0.3:9090/10]"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("services got %v, want %v", got, want)
+	}
+
+	instances, err := client.GetServiceAllInstances(model.GetInstanceVo{ServiceName: "web",
+		ExtData: map[string]string{}})
+	if err != nil {
+		t.Fatalf("GetServiceAllInstances err:%s", err)
+	}
+	if got := sortedInstances(instances); fmt.Sprint(got) != "[172.17.0.2:8080/5 172.17.0.3:9090/10]" {
+		t.Errorf("instances of web got %v", got)
+	}
+	for _, instance := range instances {
+		if len(instance.Ext["containerId"]) == 0 || strings.HasPrefix(instance.Ext["containerName"], "/") {
+			t.Errorf("instance ext got %v", instance.Ext)
+		}
+	}
+
+	// custom service label from target config
+	services, err = client.GetAllService(map[string]string{"service-label": "com.docker.compose.service"})
+	if err != nil {
+		t.Fatalf("GetAllService err:%s", err)
+	}
+	if len(services) != 1 || services[0].Name != "redis" ||
+		fmt.Sprint(sortedInstances(services[0].Instances)) != "[172.17.0.5:6379/10]" {
+		t.Errorf("services with custom label got %#v", services)
+	}
+
+	wantFilters := []string{
+		`map[label:[syncer.service] status:[running]]`,
+		`map[label:[syncer.service=web] status:[running]]`,
+		`map[label:[com.docker.compose.service] status:[running]]`,
+	}
+	requests := server.takeRequests()
+	if len(requests) != len(wantFilters) {
+		t.Fatalf("requests got %v, want filters %v", requests, wantFilters)
+	}
+	for i, request := range requests {
+		u, _ := url.Parse(strings.TrimPrefix(request, "GET "))
+		filter := map[string][]string{}
+		_ = json.Unmarshal([]byte(u.Query().Get("filters")), &filter)
+		if fmt.Sprint(filter) != wantFilters[i] {
+			t.Errorf("filters[%d] got %v, want %s", i, filter, wantFilters[i])
+		}
+	}
+}
+
+func TestDockerAddress(t *testing.T) {
+	server := newFakeServer(t, false, serveFakeDocker)
+
+	tests := []struct {
+		name    string
+		service string
+		config  map[string]string
+		want    string
+	}{
+		{
+			// c2 has no ip in network alpha, the next network sorted by name is used
+			name:    "container ip of first network",
+			service: "web",
+			config:  map[string]string{},
+			want:    "[172.17.0.2:8080/5 172.17.0.3:9090/10]",
+		},
+		{
+			name:    "container ip of network",
+			service: "web",
+			config:  map[string]string{"network": "svc"},
+			want:    "[172.20.0.2:8080/5]",
+		},
+		{
+			name:    "network not found",
+			service: "web",
+			config:  map[string]string{"network": "missing"},
+			want:    "[]",
+		},
+		{
+			// published on 0.0.0.0 uses host of docker engine, published on ip uses the ip
+			name:    "published host port",
+			service: "web",
+			config:  map[string]string{"address-type": "host"},
+			want:    "[127.0.0.1:32768/5 192.168.1.10:9091/10]",
+		},
+		{
+			name:    "published host port with host-ip",
+			service: "web",
+			config:  map[string]string{"address-type": "host", "host-ip": "10.0.0.1"},
+			want:    "[10.0.0.1:32768/5 192.168.1.10:9091/10]",
+		},
+		{
+			name:    "host network",
+			service: "api",
+			config:  map[string]string{"host-ip": "10.0.0.1"},
+			want:    "[10.0.0.1:7070/10]",
+		},
+		{
+			name:    "port label",
+			service: "web",
+			config:  map[string]string{"port-label": "syncer.weight"},
+			want:    "[172.17.0.2:5/5]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &DockerClient{Config: model.Discovery{Type: model.DOCKER_DISCOVERY,
+				Host: "tcp://" + server.Listener.Addr().String(), Prefix: "/v1.41/", Weight: 10},
+				Logger: go_logger.NewLogger()}
+			instances, err := client.GetServiceAllInstances(model.GetInstanceVo{ServiceName: tt.service,
+				ExtData: tt.config})
+			if err != nil {
+				t.Fatalf("GetServiceAllInstances err:%s", err)
+			}
+			if got := sortedInstances(instances); fmt.Sprint(got) != tt.want {
+				t.Errorf("instances got %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDockerUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix socket not supported, err:%s", err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(serveFakeDocker))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	// host-ip is required by published ports and host network when docker engine is unix socket
+	client := &DockerClient{Config: model.Discovery{Type: model.DOCKER_DISCOVERY, Host: "unix://" + socket,
+		Prefix: "/v1.41/", Weight: 10}, Logger: go_logger.NewLogger()}
+	instances, err := client.GetServiceAllInstances(model.GetInstanceVo{ServiceName: "api",
+		ExtData: map[string]string{}})
+	if err != nil {
+		t.Fatalf("GetServiceAllInstances err:%s", err)
+	}
+	if len(instances) != 0 {
+		t.Errorf("instances without host-ip got %v", sortedInstances(instances))
+	}
+	instances, err = client.GetServiceAllInstances(model.GetInstanceVo{ServiceName: "web",
+		ExtData: map[string]string{}})
+	if err != nil {
+		t.Fatalf("GetServiceAllInstances err:%s", err)
+	}
+	if got := sortedInstances(instances); fmt.Sprint(got) != "[172.17.0.2:8080/5 172.17.0.3:9090/10]" {
+		t.Errorf("instances got %v", got)
+	}
+}
@@ -0,0 +1,316 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package discovery
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EtcdClient read instances from etcd v3 by json grpc-gateway (/v3/kv/range)
+type EtcdClient struct {
+	Client http.Client
+	Config model.Discovery
+	Logger *go_logger.Logger
+	token  string
+	mutex  sync.Mutex
+}
+
+var defaultEtcdKeyPrefix = map[model.EtcdKeyLayout]string{
+	model.ETCD_GRPC_LAYOUT:  "/services/",
+	model.ETCD_MICRO_LAYOUT: "/micro/registry/",
+	model.ETCD_PLAIN_LAYOUT: "/services/",
+}
+
+func (etcdClient *EtcdClient) GetAllService(data map[string]string) ([]model.Service, error) {
+	layout, keyPrefix := etcdClient.getLayout(data)
+	kvs, err := etcdClient.rangePrefix(keyPrefix)
+	if err != nil {
+		etcdClient.Logger.Errorf("fetch etcd service error, prefix:%s, err:%s", keyPrefix, err)
+		return nil, errors.New("fetch etcd service error")
+	}
+
+	serviceMap := etcdClient.convertEtcdInstances(layout, keyPrefix, kvs)
+	names := make([]string, 0, len(serviceMap))
+	for name := range serviceMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	services := []model.Service{}
+	for _, name := range names {
+		services = append(services, model.Service{Name: name, Instances: serviceMap[name]})
+	}
+	return services, nil
+}
+
+func (etcdClient *EtcdClient) GetServiceAllInstances(vo model.GetInstanceVo) ([]model.Instance, error) {
+	layout, keyPrefix := etcdClient.getLayout(vo.ExtData)
+	kvs, err := etcdClient.rangePrefix(keyPrefix + vo.ServiceName + "/")
+	if err != nil {
+		etcdClient.Logger.Errorf("fetch etcd service instance error, prefix:%s, err:%s",
+			keyPrefix+vo.ServiceName+"/", err)
+		return nil, errors.New("fetch etcd service instance error")
+	}
+	instances, ok := etcdClient.convertEtcdInstances(layout, keyPrefix, kvs)[vo.ServiceName]
+	if !ok {
+		return []model.Instance{}, nil
+	}
+	return instances, nil
+}
+
+func (etcdClient *EtcdClient) ModifyRegistration(model.Registration, []model.Instance) error {
+	return errors.New("etcd discovery does not support modify registration")
+}
+
+func (etcdClient *EtcdClient) getLayout(data map[string]string) (model.EtcdKeyLayout, string) {
+	layout := model.EtcdKeyLayout(etcdClient.getConfig(data, "layout"))
+	if _, ok := defaultEtcdKeyPrefix[layout]; !ok {
+		layout = model.ETCD_PLAIN_LAYOUT
+	}
+	keyPrefix := etcdClient.getConfig(data, "key-prefix")
+	if len(keyPrefix) == 0 {
+		keyPrefix = defaultEtcdKeyPrefix[layout]
+	}
+	if !strings.HasSuffix(keyPrefix, "/") {
+		keyPrefix = keyPrefix + "/"
+	}
+	return layout, keyPrefix
+}
+
+// getConfig target config first, then discovery config
+func (etcdClient *EtcdClient) getConfig(data map[string]string, key string) string {
+	if v, ok := data[key]; ok && len(v) > 0 {
+		return v
+	}
+	return etcdClient.Config.Config[key]
+}
+
+// convertEtcdInstances group kvs by service name
+func (etcdClient *EtcdClient) convertEtcdInstances(layout model.EtcdKeyLayout, keyPrefix string,
+	kvs map[string]string) map[string][]model.Instance {
+	serviceMap := map[string][]model.Instance{}
+	for key, value := range kvs {
+		path := strings.TrimPrefix(key, keyPrefix)
+		var serviceName string
+		switch layout {
+		case model.ETCD_GRPC_LAYOUT:
+			// <target>/<addr>, target may contain "/"
+			idx := strings.LastIndex(path, "/")
+			if idx <= 0 {
+				continue
+			}
+			serviceName = path[:idx]
+		default:
+			// <service>/<id>
+			serviceName = strings.SplitN(path, "/", 2)[0]
+		}
+		if len(serviceName) == 0 {
+			continue
+		}
+		instances, err := etcdClient.convertEtcdValue(layout, key, value)
+		if err != nil {
+			etcdClient.Logger.Warningf("skip etcd key:%s, value:%s, err:%s", key, value, err)
+			continue
+		}
+		serviceMap[serviceName] = append(serviceMap[serviceName], instances...)
+	}
+	return serviceMap
+}
+
+func (etcdClient *EtcdClient) convertEtcdValue(layout model.EtcdKeyLayout, key string,
+	value string) ([]model.Instance, error) {
+	instances := []model.Instance{}
+	switch layout {
+	case model.ETCD_GRPC_LAYOUT:
+		endpoint := model.EtcdGrpcEndpoint{}
+		if err := json.Unmarshal([]byte(value), &endpoint); err != nil {
+			return nil, err
+		}
+		metadata := map[string]string{}
+		if m, ok := endpoint.Metadata.(map[string]interface{}); ok {
+			for k, v := range m {
+				metadata[k] = fmt.Sprintf("%v", v)
+			}
+		}
+		instance, err := etcdClient.newInstance(endpoint.Addr, metadata, key)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	case model.ETCD_MICRO_LAYOUT:
+		service := model.EtcdMicroService{}
+		if err := json.Unmarshal([]byte(value), &service); err != nil {
+			return nil, err
+		}
+		for _, node := range service.Nodes {
+			metadata := map[string]string{"version": service.Version}
+			for k, v := range service.Metadata {
+				metadata[k] = v
+			}
+			for k, v := range node.Metadata {
+				metadata[k] = v
+			}
+			instance, err := etcdClient.newInstance(node.Address, metadata, key)
+			if err != nil {
+				return nil, err
+			}
+			instance.Ext["nodeId"] = node.Id
+			instances = append(instances, instance)
+		}
+	default:
+		instance, err := etcdClient.newInstance(strings.TrimSpace(value), map[string]string{}, key)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+func (etcdClient *EtcdClient) newInstance(addr string, metadata map[string]string,
+	key string) (model.Instance, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return model.Instance{}, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return model.Instance{}, err
+	}
+	weight := etcdClient.Config.Weight
+	if w, ok := metadata["weight"]; ok {
+		if f, err := strconv.ParseFloat(w, 32); err == nil {
+			weight = float32(f)
+		}
+	}
+	return model.Instance{Ip: host, Port: port, Weight: weight, Metadata: metadata,
+		Ext: map[string]string{"key": key}}, nil
+}
+
+// rangePrefix fetch all kvs with the prefix, key -> value
+func (etcdClient *EtcdClient) rangePrefix(prefix string) (map[string]string, error) {
+	body, _ := json.Marshal(model.EtcdRangeReq{
+		Key:      base64.StdEncoding.EncodeToString([]byte(prefix)),
+		RangeEnd: base64.StdEncoding.EncodeToString(getPrefixRangeEnd(prefix)),
+	})
+	respBytes, err := etcdClient.httpDo("kv/range", body, true)
+	if err != nil {
+		return nil, err
+	}
+	rangeResp := model.EtcdRangeResp{}
+	if err = json.Unmarshal(respBytes, &rangeResp); err != nil {
+		return nil, err
+	}
+	etcdClient.Logger.Debugf("fetch etcd prefix:%s, count:%s", prefix, rangeResp.Count)
+
+	kvs := map[string]string{}
+	for _, kv := range rangeResp.Kvs {
+		key, err := base64.StdEncoding.DecodeString(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		kvs[string(key)] = string(value)
+	}
+	return kvs, nil
+}
+
+// getPrefixRangeEnd same as clientv3.GetPrefixRangeEnd
+func getPrefixRangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i] = end[i] + 1
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
+
+func (etcdClient *EtcdClient) authenticate() (string, error) {
+	etcdClient.mutex.Lock()
+	defer etcdClient.mutex.Unlock()
+	username := etcdClient.Config.Config["username"]
+	if len(username) == 0 {
+		return "", nil
+	}
+	if len(etcdClient.token) > 0 {
+		return etcdClient.token, nil
+	}
+	body, _ := json.Marshal(model.EtcdAuthReq{Name: username, Password: etcdClient.Config.Config["password"]})
+	respBytes, err := etcdClient.httpDo("auth/authenticate", body, false)
+	if err != nil {
+		return "", err
+	}
+	authResp := model.EtcdAuthResp{}
+	if err = json.Unmarshal(respBytes, &authResp); err != nil {
+		return "", err
+	}
+	etcdClient.token = authResp.Token
+	return etcdClient.token, nil
+}
+
+func (etcdClient *EtcdClient) httpDo(uri string, body []byte, withAuth bool) ([]byte, error) {
+	url := etcdClient.Config.Host + etcdClient.Config.Prefix + uri
+	hc := &http.Client{Timeout: 30 * time.Second}
+
+	for retry := 0; ; retry++ {
+		req, _ := http.NewRequest("POST", url, bytes.NewReader(body))
+		req.Header.Add("Accept", "application/json")
+		req.Header.Add("Content-Type", "application/json")
+		if withAuth {
+			token, err := etcdClient.authenticate()
+			if err != nil {
+				return nil, err
+			}
+			if len(token) > 0 {
+				req.Header.Add("Authorization", token)
+			}
+		}
+		resp, err := hc.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		respBytes, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		// token expired, re-authenticate once
+		if withAuth && resp.StatusCode == http.StatusUnauthorized && retry == 0 {
+			etcdClient.mutex.Lock()
+			etcdClient.token = ""
+			etcdClient.mutex.Unlock()
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New(fmt.Sprintf("access etcd error, url:%s, status:%s, body:%s", url,
+				resp.Status, respBytes))
+		}
+		return respBytes, nil
+	}
+}
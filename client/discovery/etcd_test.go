@@ -0,0 +1,248 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package discovery
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+	"net/http"
+	"testing"
+)
+
+// fakeEtcd grpc-gateway of etcd v3, kv/range and auth/authenticate, served by fakeServer
+type fakeEtcd struct {
+	kvs        map[string]string
+	username   string
+	validToken string
+	issued     int
+	ranges     []model.EtcdRangeReq
+}
+
+func (fake *fakeEtcd) serve(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v3/auth/authenticate":
+		req := model.EtcdAuthReq{}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if req.Name != fake.username {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fake.issued++
+		fake.validToken = fmt.Sprintf("token-%d", fake.issued)
+		_ = json.NewEncoder(w).Encode(model.EtcdAuthResp{Token: fake.validToken})
+	case "/v3/kv/range":
+		if len(fake.username) > 0 && r.Header.Get("Authorization") != fake.validToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		req := model.EtcdRangeReq{}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		fake.ranges = append(fake.ranges, req)
+		start, _ := base64.StdEncoding.DecodeString(req.Key)
+		end, _ := base64.StdEncoding.DecodeString(req.RangeEnd)
+		resp := model.EtcdRangeResp{Kvs: []model.EtcdKeyValue{}}
+		for key, value := range fake.kvs {
+			if key >= string(start) && key < string(end) {
+				resp.Kvs = append(resp.Kvs, model.EtcdKeyValue{
+					Key:   base64.StdEncoding.EncodeToString([]byte(key)),
+					Value: base64.StdEncoding.EncodeToString([]byte(value)),
+				})
+			}
+		}
+		resp.Count = fmt.Sprintf("%d", len(resp.Kvs))
+		_ = json.NewEncoder(w).Encode(resp)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestEtcdLayouts(t *testing.T) {
+	tests := []struct {
+		name     string
+		layout   string
+		kvs      map[string]string
+		services map[string][]string
+		metadata map[string]string
+	}{
+		{
+			name:   "grpc",
+			layout: "grpc",
+			kvs: map[string]string{
+				"/services/foo/bar/10.0.0.1:8080": `{"Addr":"10.0.0.1:8080","Metadata":{"weight":"5","zone":"a"}}`,
+				"/services/foo/bar/10.0.0.2:8080": `{"Addr":"10.0.0.2:8080"}`,
+				"/services/baz/10.0.0.3:9090":     `{"Addr":"10.0.0.3:9090","Metadata":{"zone":"b"}}`,
+				"/servicesx/other/10.0.0.4:1":     `{"Addr":"10.0.0.4:1"}`,
+			},
+			services: map[string][]string{
+				"foo/bar": {"10.0.0.1:8080/5", "10.0.0.2:8080/10"},
+				"baz":     {"10.0.0.3:9090/10"},
+			},
+			metadata: map[string]string{"zone": "a", "weight": "5"},
+		},
+		{
+			name:   "micro",
+			layout: "micro",
+			kvs: map[string]string{
+				"/micro/registry/orders/orders-1": `{"name":"orders","version":"1.0.0","metadata":{"zone":"a"},` +
+					`"nodes":[{"id":"orders-1","address":"10.0.0.1:8080","metadata":{"weight":"3"}}]}`,
+				"/micro/registry/orders/orders-2": `{"name":"orders","version":"1.0.0",` +
+					`"nodes":[{"id":"orders-2","address":"10.0.0.2:8080"}]}`,
+				"/micro/registry/users/users-1": `not json`,
+			},
+			services: map[string][]string{
+				"orders": {"10.0.0.1:8080/3", "10.0.0.2:8080/10"},
+			},
+			metadata: map[string]string{"zone": "a", "weight": "3", "version": "1.0.0"},
+		},
+		{
+			name:   "plain",
+			layout: "",
+			kvs: map[string]string{
+				"/services/orders/1": "10.0.0.1:8080",
+				"/services/orders/2": " 10.0.0.2:8080\n",
+				"/services/users/1":  "[::1]:9090",
+				"/services/bad/1":    "10.0.0.3",
+			},
+			services: map[string][]string{
+				"orders": {"10.0.0.1:8080/10", "10.0.0.2:8080/10"},
+				"users":  {"::1:9090/10"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t, false, (&fakeEtcd{kvs: tt.kvs}).serve)
+			client := &EtcdClient{Config: model.Discovery{Type: model.ETCD_DISCOVERY, Host: server.URL, Prefix: "/v3/",
+				Weight: 10, Config: map[string]string{"layout": tt.layout}}, Logger: go_logger.NewLogger()}
+			services, err := client.GetAllService(nil)
+			if err != nil {
+				t.Fatalf("GetAllService err:%s", err)
+			}
+			if len(services) != len(tt.services) {
+				t.Fatalf("services got %d, want %d: %#v", len(services), len(tt.services), services)
+			}
+			for _, service := range services {
+				want, ok := tt.services[service.Name]
+				if !ok {
+					t.Fatalf("unexpected service %s", service.Name)
+				}
+				if got := sortedInstances(service.Instances); fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("service %s instances got %v, want %v", service.Name, got, want)
+				}
+			}
+			for name, want := range tt.services {
+				instances, err := client.GetServiceAllInstances(model.GetInstanceVo{ServiceName: name})
+				if err != nil {
+					t.Fatalf("GetServiceAllInstances err:%s", err)
+				}
+				if got := sortedInstances(instances); fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("instances of %s got %v, want %v", name, got, want)
+				}
+				for _, instance := range instances {
+					if len(instance.Ext["key"]) == 0 {
+						t.Errorf("instance %s:%d without key", instance.Ip, instance.Port)
+					}
+				}
+			}
+			if tt.metadata == nil {
+				return
+			}
+			for _, service := range services {
+				for _, instance := range service.Instances {
+					if instance.Metadata["zone"] != tt.metadata["zone"] ||
+						instance.Metadata["weight"] != tt.metadata["weight"] {
+						continue
+					}
+					for k, v := range tt.metadata {
+						if instance.Metadata[k] != v {
+							t.Errorf("metadata %s got %s, want %s", k, instance.Metadata[k], v)
+						}
+					}
+					return
+				}
+			}
+			t.Errorf("no instance with metadata %v", tt.metadata)
+		})
+	}
+}
+
+func TestEtcdRangeKeys(t *testing.T) {
+	fake := &fakeEtcd{kvs: map[string]string{}}
+	server := newFakeServer(t, false, fake.serve)
+	client := &EtcdClient{Config: model.Discovery{Type: model.ETCD_DISCOVERY, Host: server.URL, Prefix: "/v3/",
+		Weight: 10, Config: map[string]string{"key-prefix": "/custom"}}, Logger: go_logger.NewLogger()}
+	if _, err := client.GetServiceAllInstances(model.GetInstanceVo{ServiceName: "orders"}); err != nil {
+		t.Fatalf("GetServiceAllInstances err:%s", err)
+	}
+	if len(fake.ranges) != 1 {
+		t.Fatalf("ranges got %d, want 1", len(fake.ranges))
+	}
+	key, _ := base64.StdEncoding.DecodeString(fake.ranges[0].Key)
+	end, _ := base64.StdEncoding.DecodeString(fake.ranges[0].RangeEnd)
+	if string(key) != "/custom/orders/" || string(end) != "/custom/orders0" {
+		t.Errorf("range got [%s, %s), want [/custom/orders/, /custom/orders0)", key, end)
+	}
+
+	tests := []struct {
+		prefix string
+		want   []byte
+	}{
+		{"/a/", []byte("/a0")},
+		{"a\xff", []byte("b")},
+		{"\xff\xff", []byte{0}},
+	}
+	for _, tt := range tests {
+		if got := getPrefixRangeEnd(tt.prefix); string(got) != string(tt.want) {
+			t.Errorf("getPrefixRangeEnd(%q) got %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestEtcdTokenRetry(t *testing.T) {
+	fake := &fakeEtcd{username: "root", kvs: map[string]string{"/services/orders/1": "10.0.0.1:8080"}}
+	server := newFakeServer(t, false, fake.serve)
+	client := &EtcdClient{Config: model.Discovery{Type: model.ETCD_DISCOVERY, Host: server.URL, Prefix: "/v3/",
+		Weight: 10, Config: map[string]string{"username": "root", "password": "secret"}}, Logger: go_logger.NewLogger()}
+	if _, err := client.GetAllService(nil); err != nil {
+		t.Fatalf("GetAllService err:%s", err)
+	}
+	if fake.issued != 1 {
+		t.Fatalf("tokens issued got %d, want 1", fake.issued)
+	}
+
+	// token expired on server, client gets 401 and authenticates again
+	server.mutex.Lock()
+	fake.validToken = "revoked"
+	server.mutex.Unlock()
+	services, err := client.GetAllService(nil)
+	if err != nil {
+		t.Fatalf("GetAllService after token expired err:%s", err)
+	}
+	if len(services) != 1 || len(services[0].Instances) != 1 {
+		t.Errorf("services got %#v", services)
+	}
+	if fake.issued != 2 {
+		t.Errorf("tokens issued got %d, want 2", fake.issued)
+	}
+
+	// wrong credentials are not retried forever
+	client.Config.Config["username"] = "nobody"
+	client.token = ""
+	if _, err = client.GetAllService(nil); err == nil {
+		t.Errorf("GetAllService with wrong username should fail")
+	}
+}
@@ -16,13 +16,18 @@ package discovery
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/anjia0532/apisix-discovery-syncer/model"
 	go_logger "github.com/phachon/go-logger"
 	"io"
 	"io/ioutil"
+	"maps"
 	"net/http"
-	"regexp"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -30,99 +35,307 @@ type EurekaClient struct {
 	Client http.Client
 	Config model.Discovery
 	Logger *go_logger.Logger
+	// local registry, appName -> instanceId -> instance
+	registry map[string]map[string]model.EurekaInstance
+	// mutex guards reading and swapping registry, fetchMutex serializes fetch and apply,
+	// so a slow full fetch never overwrites a newer delta
+	mutex      sync.Mutex
+	fetchMutex sync.Mutex
+	picker     *hostPicker
+	pickerOnce sync.Once
 }
 
-var HostPageRE = regexp.MustCompile(`^https?://(?P<Ip>[\w.]+):(?P<Port>\d+)/?$`)
+func (eurekaClient *EurekaClient) GetAllService(data map[string]string) ([]model.Service, error) {
+	if err := eurekaClient.refreshRegistry(); err != nil {
+		return nil, err
+	}
 
-func (eurekaClient *EurekaClient) GetAllService(map[string]string) ([]model.Service, error) {
-	uri := eurekaClient.Config.Host + eurekaClient.Config.Prefix + "apps/"
-	hc := &http.Client{Timeout: 30 * time.Second}
+	eurekaClient.mutex.Lock()
+	defer eurekaClient.mutex.Unlock()
+	names := []string{}
+	for name := range eurekaClient.registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	services := []model.Service{}
+	for _, name := range names {
+		eurekaInstances := []model.EurekaInstance{}
+		for _, instance := range eurekaClient.registry[name] {
+			eurekaInstances = append(eurekaInstances, instance)
+		}
+		services = append(services, model.Service{Name: name,
+			Instances: eurekaClient.convertEurekaInstance(eurekaInstances, data)})
+	}
+	return services, nil
+}
+
+// refreshRegistry fetch delta or full registry, one fetch at a time
+func (eurekaClient *EurekaClient) refreshRegistry() error {
+	eurekaClient.fetchMutex.Lock()
+	defer eurekaClient.fetchMutex.Unlock()
+
+	eurekaClient.mutex.Lock()
+	fetched := eurekaClient.registry != nil
+	eurekaClient.mutex.Unlock()
 
-	req, _ := http.NewRequest("GET", uri, nil)
-	req.Header.Add("Accept", "application/json")
-	resp, err := hc.Do(req)
+	if !fetched || eurekaClient.Config.Config["disable-delta"] == "true" {
+		return eurekaClient.fetchFullRegistry()
+	}
+	err := eurekaClient.fetchDeltaRegistry()
+	if err != nil {
+		eurekaClient.Logger.Warningf("fetch eureka delta failed, fallback to full fetch, err:%s", err)
+		err = eurekaClient.fetchFullRegistry()
+	}
+	return err
+}
 
+// fetchFullRegistry GET /eureka/apps/ and replace the local registry
+func (eurekaClient *EurekaClient) fetchFullRegistry() error {
+	apps, err := eurekaClient.fetchApps("apps/")
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if 404 == resp.StatusCode {
-		return []model.Service{}, nil
-	} else if 200 != resp.StatusCode {
-		eurekaClient.Logger.Errorf("fetch eureka service error, uri:%s, err:%s", uri, err)
+	registry := map[string]map[string]model.EurekaInstance{}
+	for _, app := range apps.Application {
+		instances := map[string]model.EurekaInstance{}
+		for _, instance := range app.Instance {
+			instances[instance.InstanceId] = instance
+		}
+		registry[app.Name] = instances
+	}
+	eurekaClient.mutex.Lock()
+	eurekaClient.registry = registry
+	eurekaClient.mutex.Unlock()
+	return nil
+}
+
+// fetchDeltaRegistry GET /eureka/apps/delta, apply changes to the local registry,
+// same as eureka client, verify apps__hashcode after apply
+func (eurekaClient *EurekaClient) fetchDeltaRegistry() error {
+	delta, err := eurekaClient.fetchApps("apps/delta")
+	if err != nil {
+		return err
+	}
+	eurekaClient.mutex.Lock()
+	defer eurekaClient.mutex.Unlock()
+	// apply to a copy, the local registry is kept if hashcode mismatch, changed apps are copied on write
+	registry := maps.Clone(eurekaClient.registry)
+	copied := map[string]bool{}
+	for _, app := range delta.Application {
+		for _, instance := range app.Instance {
+			instances, ok := registry[app.Name]
+			if ok && !copied[app.Name] {
+				instances = maps.Clone(instances)
+				registry[app.Name] = instances
+				copied[app.Name] = true
+			}
+			switch instance.ActionType {
+			case "ADDED", "MODIFIED":
+				if !ok {
+					instances = map[string]model.EurekaInstance{}
+					registry[app.Name] = instances
+					copied[app.Name] = true
+				}
+				instances[instance.InstanceId] = instance
+			case "DELETED":
+				if !ok {
+					continue
+				}
+				delete(instances, instance.InstanceId)
+				if len(instances) == 0 {
+					delete(registry, app.Name)
+					delete(copied, app.Name)
+				}
+			}
+		}
+	}
+	hashcode := getReconcileHashCode(registry)
+	if hashcode != delta.AppsHashcode {
+		return errors.New(fmt.Sprintf("reconcile hashcode mismatch, local:%s, remote:%s", hashcode, delta.AppsHashcode))
+	}
+	eurekaClient.registry = registry
+	eurekaClient.Logger.Debugf("apply eureka delta, versions:%s, hashcode:%s", delta.VersionsDelta, hashcode)
+	return nil
+}
+
+// getReconcileHashCode count instances by status, e.g. DOWN_1_UP_3_
+func getReconcileHashCode(registry map[string]map[string]model.EurekaInstance) string {
+	counts := map[string]int{}
+	for _, instances := range registry {
+		for _, instance := range instances {
+			counts[instance.Status]++
+		}
+	}
+	statuses := []string{}
+	for status := range counts {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	var hashcode strings.Builder
+	for _, status := range statuses {
+		hashcode.WriteString(fmt.Sprintf("%s_%d_", status, counts[status]))
+	}
+	return hashcode.String()
+}
+
+func (eurekaClient *EurekaClient) fetchApps(path string) (*model.EurekaApps, error) {
+	status, body, err := eurekaClient.httpDo("GET", path)
+	if err != nil {
+		eurekaClient.Logger.Errorf("fetch eureka service error, path:%s, err:%s", path, err)
+		return nil, errors.New("fetch eureka service error")
+	}
+	if 404 == status {
+		return &model.EurekaApps{}, nil
+	} else if 200 != status {
+		eurekaClient.Logger.Errorf("fetch eureka service error, path:%s, status:%d", path, status)
 		return nil, errors.New("fetch eureka service error")
 	}
 
 	eurekaResp := model.EurekaAppsResp{}
-	err = json.NewDecoder(resp.Body).Decode(&eurekaResp)
-	_, _ = io.Copy(ioutil.Discard, resp.Body)
-	_ = resp.Body.Close()
+	err = json.Unmarshal(body, &eurekaResp)
 	if err != nil {
 		return nil, err
 	}
-	services := []model.Service{}
-	for _, app := range eurekaResp.Applications.Application {
-
-		services = append(services, model.Service{Name: app.Name,
-			Instances: convertEurekaInstance(app.Instance, eurekaClient.Config.Weight)})
-	}
-	return services, nil
+	return &eurekaResp.Applications, nil
 }
 
 func (eurekaClient *EurekaClient) GetServiceAllInstances(vo model.GetInstanceVo) ([]model.Instance, error) {
-	uri := eurekaClient.Config.Host + eurekaClient.Config.Prefix + "apps/" + vo.ServiceName
-	hc := &http.Client{Timeout: 30 * time.Second}
-
-	req, _ := http.NewRequest("GET", uri, nil)
-	req.Header.Add("Accept", "application/json")
-	resp, err := hc.Do(req)
+	path := "apps/" + vo.ServiceName
+	status, body, err := eurekaClient.httpDo("GET", path)
 
 	if err != nil {
-		return nil, err
+		eurekaClient.Logger.Errorf("fetch eureka service instance error, path:%s, err:%s", path, err)
+		return nil, errors.New("fetch eureka service instance error")
 	}
-	if 404 == resp.StatusCode {
+	if 404 == status {
 		return []model.Instance{}, nil
-	} else if 200 != resp.StatusCode {
-		eurekaClient.Logger.Errorf("fetch eureka service instance error, uri:%s, err:%s", uri, err)
+	} else if 200 != status {
+		eurekaClient.Logger.Errorf("fetch eureka service instance error, path:%s, status:%d", path, status)
 		return nil, errors.New("fetch eureka service instance error")
 	}
 	eurekaResp := model.EurekaAppResp{}
-	err = json.NewDecoder(resp.Body).Decode(&eurekaResp)
+	err = json.Unmarshal(body, &eurekaResp)
 
-	eurekaClient.Logger.Debugf("fetch eureka service,uri:%s,%#v", uri, eurekaResp)
-
-	_, _ = io.Copy(ioutil.Discard, resp.Body)
-	_ = resp.Body.Close()
+	eurekaClient.Logger.Debugf("fetch eureka service,path:%s,%#v", path, eurekaResp)
 
 	if err != nil {
 		return nil, err
 	}
 
-	instances := convertEurekaInstance(eurekaResp.Application.Instance, eurekaClient.Config.Weight)
-	eurekaClient.Logger.Debugf("fetch eureka service:%s,instances:%#v", uri, instances)
+	instances := eurekaClient.convertEurekaInstance(eurekaResp.Application.Instance, vo.ExtData)
+	eurekaClient.Logger.Debugf("fetch eureka service:%s,instances:%#v", path, instances)
 	return instances, nil
 }
 
-func convertEurekaInstance(eurekaApps []model.EurekaInstance, defaultWeight float32) []model.Instance {
+// httpDo request eureka peers, network error or 5xx will failover to next peer
+func (eurekaClient *EurekaClient) httpDo(method string, path string) (int, []byte, error) {
+	eurekaClient.pickerOnce.Do(func() {
+		eurekaClient.picker = newHostPicker(eurekaClient.Config, eurekaClient.Logger)
+	})
+	hc := &http.Client{Timeout: 30 * time.Second}
+
+	var (
+		status int
+		body   []byte
+	)
+	err := eurekaClient.picker.do(func(host string) (bool, error) {
+		uri := host + eurekaClient.Config.Prefix + path
+		req, _ := http.NewRequest(method, uri, nil)
+		req.Header.Add("Accept", "application/json")
+		resp, err := hc.Do(req)
+		if err != nil {
+			return true, err
+		}
+		body, err = io.ReadAll(resp.Body)
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return true, err
+		}
+		status = resp.StatusCode
+		if status >= 500 {
+			return true, errors.New(fmt.Sprintf("uri:%s, status:%s", uri, resp.Status))
+		}
+		return false, nil
+	})
+	return status, body, err
+}
+
+func (eurekaClient *EurekaClient) convertEurekaInstance(eurekaApps []model.EurekaInstance,
+	data map[string]string) []model.Instance {
 
 	instances := []model.Instance{}
 	if len(eurekaApps) == 0 {
 		return instances
 	}
+	addressType := strings.ToLower(data["address-type"])
+	portType := strings.ToLower(data["port-type"])
 	for _, eurekaIns := range eurekaApps {
 		if "UP" != eurekaIns.Status {
 			continue
 		}
-		matches := HostPageRE.FindStringSubmatch(eurekaIns.HomePageUrl)
-
-		port, _ := strconv.Atoi(matches[HostPageRE.SubexpIndex("Port")])
-		instance := model.Instance{Ip: matches[HostPageRE.SubexpIndex("Ip")], Port: port,
-			Metadata: eurekaIns.Metadata, Weight: defaultWeight,
-			Ext: map[string]string{"instanceId": eurekaIns.InstanceId}}
+		host, port, scheme, err := getEurekaAddress(eurekaIns, addressType, portType)
+		if err != nil {
+			eurekaClient.Logger.Warningf("skip eureka instance:%s, homePageUrl:%s, err:%s",
+				eurekaIns.InstanceId, eurekaIns.HomePageUrl, err)
+			continue
+		}
+		instance := model.Instance{Ip: host, Port: port,
+			Metadata: eurekaIns.Metadata, Weight: eurekaClient.Config.Weight,
+			Ext: map[string]string{"instanceId": eurekaIns.InstanceId, "scheme": scheme}}
 
 		instances = append(instances, instance)
 	}
 	return instances
 }
+
+// getEurekaAddress addressType is ip(default) or hostname, portType is auto(default), plain or secure,
+// fallback to homePageUrl if ipAddr/hostName or port is absent
+func getEurekaAddress(eurekaIns model.EurekaInstance, addressType string,
+	portType string) (string, int, string, error) {
+	host := eurekaIns.IpAddr
+	if addressType == "hostname" && len(eurekaIns.HostName) > 0 || len(host) == 0 {
+		host = eurekaIns.HostName
+	}
+	port, scheme := eurekaIns.Port.Port, "http"
+	switch portType {
+	case "secure":
+		port, scheme = eurekaIns.SecurePort.Port, "https"
+	case "plain":
+		break
+	default:
+		if !eurekaIns.Port.Enabled && eurekaIns.SecurePort.Enabled {
+			port, scheme = eurekaIns.SecurePort.Port, "https"
+		}
+	}
+	if len(host) > 0 && port > 0 {
+		return host, port, scheme, nil
+	}
+
+	homePage, err := url.Parse(eurekaIns.HomePageUrl)
+	if err != nil {
+		return "", 0, "", err
+	}
+	if len(homePage.Hostname()) == 0 {
+		return "", 0, "", errors.New("no address found")
+	}
+	if len(host) == 0 {
+		host = homePage.Hostname()
+	}
+	if port > 0 {
+		return host, port, scheme, nil
+	}
+	scheme = homePage.Scheme
+	port, err = strconv.Atoi(homePage.Port())
+	if err != nil {
+		port = 80
+		if scheme == "https" {
+			port = 443
+		}
+	}
+	return host, port, scheme, nil
+}
+
 func (eurekaClient *EurekaClient) ModifyRegistration(registration model.Registration, instances []model.Instance) error {
 	for _, instance := range instances {
 		if !instance.Change {
@@ -135,23 +348,15 @@ func (eurekaClient *EurekaClient) ModifyRegistration(registration model.Registra
 		// OUT_OF_SERVICE enabled is false
 		// UP enabled is true
 		// PUT /eureka/v2/apps/appID/instanceID/status?value=OUT_OF_SERVICE
-		uri := eurekaClient.Config.Host + eurekaClient.Config.Prefix + "apps/" + registration.ServiceName + "/" +
-			instance.Ext["instanceId"] + "/status/?value=" + status
-		hc := &http.Client{Timeout: 30 * time.Second}
-
-		req, _ := http.NewRequest("PUT", uri, nil)
-		req.Header.Add("Accept", "application/json")
-		resp, err := hc.Do(req)
+		path := "apps/" + registration.ServiceName + "/" + instance.Ext["instanceId"] + "/status/?value=" + status
+		respStatus, body, err := eurekaClient.httpDo("PUT", path)
 		if err != nil {
 			eurekaClient.Logger.Errorf("change eureka %s instance %#v failed, err:%s", registration.ServiceName,
 				instance, err)
 			return err
 		}
-		body, _ := ioutil.ReadAll(resp.Body)
-		eurekaClient.Logger.Debugf("change eureka %s instance %#v,body:%s,status:%s", registration.ServiceName,
-			instance, string(body), resp.Status)
-		_, _ = io.Copy(ioutil.Discard, resp.Body)
-		_ = resp.Body.Close()
+		eurekaClient.Logger.Debugf("change eureka %s instance %#v,body:%s,status:%d", registration.ServiceName,
+			instance, string(body), respStatus)
 	}
 	return nil
 }
@@ -0,0 +1,288 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package discovery
+
+import (
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// eurekaApp app of instances like id:STATUS
+func eurekaApp(name string, instances ...string) model.EurekaApp {
+	app := model.EurekaApp{Name: name}
+	for _, instance := range instances {
+		id, status, _ := strings.Cut(instance, ":")
+		app.Instance = append(app.Instance, model.EurekaInstance{InstanceId: id, Status: status,
+			HomePageUrl: "http://" + id + ":8080/"})
+	}
+	return app
+}
+
+// eurekaDelta app of instances like id:STATUS, changed by actionType
+func eurekaDelta(name string, actionType string, instances ...string) model.EurekaApp {
+	app := eurekaApp(name, instances...)
+	for i := range app.Instance {
+		app.Instance[i].ActionType = actionType
+	}
+	return app
+}
+
+// registryOf local registry as sorted app/id:STATUS
+func registryOf(eurekaClient *EurekaClient) []string {
+	eurekaClient.mutex.Lock()
+	defer eurekaClient.mutex.Unlock()
+	result := []string{}
+	for name, instances := range eurekaClient.registry {
+		for id, instance := range instances {
+			result = append(result, name+"/"+id+":"+instance.Status)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestEurekaDeltaRegistry(t *testing.T) {
+	full := model.EurekaApps{Application: []model.EurekaApp{
+		eurekaApp("ORDERS", "o1:UP", "o2:UP"),
+		eurekaApp("USERS", "u1:DOWN"),
+	}}
+	delta := model.EurekaApps{}
+	server := newFakeServer(t, false, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/eureka/apps/":
+			writeJson(w, http.StatusOK, model.EurekaAppsResp{Applications: full})
+		case "/eureka/apps/delta":
+			writeJson(w, http.StatusOK, model.EurekaAppsResp{Applications: delta})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	client := &EurekaClient{Config: model.Discovery{Type: model.EUREKA_DISCOVERY, Host: server.URL,
+		Prefix: "/eureka/", Weight: 10, Config: map[string]string{}}, Logger: go_logger.NewLogger()}
+
+	tests := []struct {
+		name     string
+		delta    model.EurekaApps
+		config   map[string]string
+		requests []string
+		registry []string
+	}{
+		{
+			name:     "full fetch at first",
+			requests: []string{"GET /eureka/apps/"},
+			registry: []string{"ORDERS/o1:UP", "ORDERS/o2:UP", "USERS/u1:DOWN"},
+		},
+		{
+			name: "apply delta",
+			delta: model.EurekaApps{AppsHashcode: "DOWN_1_UP_2_", Application: []model.EurekaApp{
+				eurekaDelta("ORDERS", "ADDED", "o3:UP"),
+				eurekaDelta("ORDERS", "MODIFIED", "o1:DOWN"),
+				eurekaDelta("USERS", "DELETED", "u1:DOWN"),
+				eurekaDelta("PAYMENTS", "DELETED", "p1:UP"),
+			}},
+			requests: []string{"GET /eureka/apps/delta"},
+			registry: []string{"ORDERS/o1:DOWN", "ORDERS/o2:UP", "ORDERS/o3:UP"},
+		},
+		{
+			name: "add app by delta",
+			delta: model.EurekaApps{AppsHashcode: "DOWN_1_UP_3_", Application: []model.EurekaApp{
+				eurekaDelta("PAYMENTS", "ADDED", "p1:UP"),
+			}},
+			requests: []string{"GET /eureka/apps/delta"},
+			registry: []string{"ORDERS/o1:DOWN", "ORDERS/o2:UP", "ORDERS/o3:UP", "PAYMENTS/p1:UP"},
+		},
+		{
+			// a missed delta makes the hashcode mismatch, local registry is rebuilt by full fetch
+			name: "hashcode mismatch fallback to full fetch",
+			delta: model.EurekaApps{AppsHashcode: "UP_5_", Application: []model.EurekaApp{
+				eurekaDelta("ORDERS", "DELETED", "o3:UP"),
+			}},
+			requests: []string{"GET /eureka/apps/delta", "GET /eureka/apps/"},
+			registry: []string{"ORDERS/o1:UP", "ORDERS/o2:UP", "USERS/u1:DOWN"},
+		},
+		{
+			name:     "delta disabled",
+			delta:    model.EurekaApps{AppsHashcode: "UP_2_"},
+			config:   map[string]string{"disable-delta": "true"},
+			requests: []string{"GET /eureka/apps/"},
+			registry: []string{"ORDERS/o1:UP", "ORDERS/o2:UP", "USERS/u1:DOWN"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delta = tt.delta
+			client.Config.Config = tt.config
+			if _, err := client.GetAllService(map[string]string{}); err != nil {
+				t.Fatalf("GetAllService err:%s", err)
+			}
+			if got := server.takeRequests(); fmt.Sprint(got) != fmt.Sprint(tt.requests) {
+				t.Errorf("requests got %v, want %v", got, tt.requests)
+			}
+			if got := registryOf(client); fmt.Sprint(got) != fmt.Sprint(tt.registry) {
+				t.Errorf("registry got %v, want %v", got, tt.registry)
+			}
+		})
+	}
+}
+
+func TestEurekaDeltaMismatchKeepsRegistry(t *testing.T) {
+	delta := model.EurekaApps{AppsHashcode: "UP_1_", Application: []model.EurekaApp{
+		eurekaDelta("ORDERS", "MODIFIED", "o1:DOWN"),
+		eurekaDelta("USERS", "DELETED", "u1:UP"),
+	}}
+	server := newFakeServer(t, false, func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, model.EurekaAppsResp{Applications: delta})
+	})
+	client := &EurekaClient{Config: model.Discovery{Type: model.EUREKA_DISCOVERY, Host: server.URL,
+		Prefix: "/eureka/"}, Logger: go_logger.NewLogger()}
+	client.registry = map[string]map[string]model.EurekaInstance{
+		"ORDERS": {"o1": {InstanceId: "o1", Status: "UP"}},
+		"USERS":  {"u1": {InstanceId: "u1", Status: "UP"}},
+	}
+
+	// delta is applied to a copy, apps of the local registry are not changed in place
+	if err := client.fetchDeltaRegistry(); err == nil {
+		t.Fatalf("fetchDeltaRegistry should fail with hashcode mismatch")
+	}
+	if got := fmt.Sprint(registryOf(client)); got != "[ORDERS/o1:UP USERS/u1:UP]" {
+		t.Errorf("registry got %s", got)
+	}
+}
+
+func TestGetReconcileHashCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		registry map[string]map[string]model.EurekaInstance
+		want     string
+	}{
+		{name: "empty", registry: map[string]map[string]model.EurekaInstance{}, want: ""},
+		{
+			name: "single status",
+			registry: map[string]map[string]model.EurekaInstance{
+				"ORDERS": {"o1": {Status: "UP"}, "o2": {Status: "UP"}},
+			},
+			want: "UP_2_",
+		},
+		{
+			// statuses are sorted, counted across apps
+			name: "statuses of apps",
+			registry: map[string]map[string]model.EurekaInstance{
+				"ORDERS": {"o1": {Status: "UP"}, "o2": {Status: "OUT_OF_SERVICE"}, "o3": {Status: "UP"}},
+				"USERS":  {"u1": {Status: "DOWN"}, "u2": {Status: "UP"}},
+			},
+			want: "DOWN_1_OUT_OF_SERVICE_1_UP_3_",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getReconcileHashCode(tt.registry); got != tt.want {
+				t.Errorf("getReconcileHashCode got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetEurekaAddress(t *testing.T) {
+	tests := []struct {
+		name        string
+		instance    model.EurekaInstance
+		addressType string
+		portType    string
+		want        string
+		wantErr     bool
+	}{
+		{
+			name: "ip and port",
+			instance: model.EurekaInstance{IpAddr: "10.0.0.1", HostName: "orders-1",
+				Port: model.EurekaPort{Port: 8080, Enabled: true}, SecurePort: model.EurekaPort{Port: 8443}},
+			want: "http://10.0.0.1:8080",
+		},
+		{
+			name: "hostname",
+			instance: model.EurekaInstance{IpAddr: "10.0.0.1", HostName: "orders-1",
+				Port: model.EurekaPort{Port: 8080, Enabled: true}},
+			addressType: "hostname",
+			want:        "http://orders-1:8080",
+		},
+		{
+			name:     "hostname without ipAddr",
+			instance: model.EurekaInstance{HostName: "orders-1", Port: model.EurekaPort{Port: 8080, Enabled: true}},
+			want:     "http://orders-1:8080",
+		},
+		{
+			// securePort is used when only securePort is enabled
+			name: "auto secure port",
+			instance: model.EurekaInstance{IpAddr: "10.0.0.1", Port: model.EurekaPort{Port: 8080},
+				SecurePort: model.EurekaPort{Port: 8443, Enabled: true}},
+			want: "https://10.0.0.1:8443",
+		},
+		{
+			name: "secure port",
+			instance: model.EurekaInstance{IpAddr: "10.0.0.1", Port: model.EurekaPort{Port: 8080, Enabled: true},
+				SecurePort: model.EurekaPort{Port: 8443}},
+			portType: "secure",
+			want:     "https://10.0.0.1:8443",
+		},
+		{
+			name: "plain port",
+			instance: model.EurekaInstance{IpAddr: "10.0.0.1", Port: model.EurekaPort{Port: 8080},
+				SecurePort: model.EurekaPort{Port: 8443, Enabled: true}},
+			portType: "plain",
+			want:     "http://10.0.0.1:8080",
+		},
+		{
+			name:     "homePageUrl without ipAddr and port",
+			instance: model.EurekaInstance{HomePageUrl: "https://orders.example.com:9443/"},
+			want:     "https://orders.example.com:9443",
+		},
+		{
+			name:     "default port of homePageUrl",
+			instance: model.EurekaInstance{HomePageUrl: "https://orders.example.com/"},
+			want:     "https://orders.example.com:443",
+		},
+		{
+			name: "port with host of homePageUrl",
+			instance: model.EurekaInstance{Port: model.EurekaPort{Port: 8080, Enabled: true},
+				HomePageUrl: "http://orders.example.com/"},
+			want: "http://orders.example.com:8080",
+		},
+		{
+			name:     "no address",
+			instance: model.EurekaInstance{Port: model.EurekaPort{Port: 8080, Enabled: true}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port, scheme, err := getEurekaAddress(tt.instance, tt.addressType, tt.portType)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("getEurekaAddress should fail, got %s://%s:%d", scheme, host, port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getEurekaAddress err:%s", err)
+			}
+			if got := fmt.Sprintf("%s://%s:%d", scheme, host, port); got != tt.want {
+				t.Errorf("getEurekaAddress got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
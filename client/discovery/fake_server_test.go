@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// fakeServer stand-in of a registry api, requests are served one at a time and recorded as "METHOD /path?query"
+type fakeServer struct {
+	*httptest.Server
+	requests []string
+	mutex    sync.Mutex
+}
+
+// newFakeServer start a http server, or a https server if secure, closed when the test finishes
+func newFakeServer(t *testing.T, secure bool, handler http.HandlerFunc) *fakeServer {
+	server := &fakeServer{}
+	server.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		server.requests = append(server.requests, r.Method+" "+r.URL.RequestURI())
+		handler(w, r)
+	}))
+	if secure {
+		server.StartTLS()
+	} else {
+		server.Start()
+	}
+	t.Cleanup(server.Close)
+	return server
+}
+
+// takeRequests requests recorded since last call
+func (server *fakeServer) takeRequests() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	requests := server.requests
+	server.requests = nil
+	return requests
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// sortedInstances instances as sorted ip:port/weight
+func sortedInstances(instances []model.Instance) []string {
+	result := []string{}
+	for _, instance := range instances {
+		result = append(result, fmt.Sprintf("%s:%d/%v", instance.Ip, instance.Port, instance.Weight))
+	}
+	sort.Strings(result)
+	return result
+}
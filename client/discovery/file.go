@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package discovery
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileClient read services from yaml/json file or all files in directory,
+// reload when the content of files changed
+type FileClient struct {
+	Config    model.Discovery
+	Logger    *go_logger.Logger
+	services  []model.Service
+	signature string
+	mutex     sync.Mutex
+}
+
+var fileDiscoveryExts = []string{".yaml", ".yml", ".json"}
+
+func (fileClient *FileClient) GetAllService(map[string]string) ([]model.Service, error) {
+	return fileClient.load()
+}
+
+func (fileClient *FileClient) GetServiceAllInstances(vo model.GetInstanceVo) ([]model.Instance, error) {
+	services, err := fileClient.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range services {
+		if service.Name == vo.ServiceName {
+			return service.Instances, nil
+		}
+	}
+	return []model.Instance{}, nil
+}
+
+func (fileClient *FileClient) ModifyRegistration(model.Registration, []model.Instance) error {
+	return errors.New("file discovery does not support modify registration")
+}
+
+func (fileClient *FileClient) load() ([]model.Service, error) {
+	fileClient.mutex.Lock()
+	defer fileClient.mutex.Unlock()
+
+	files, err := fileClient.listFiles()
+	if err != nil {
+		fileClient.Logger.Errorf("list discovery files error, path:%s, err:%s", fileClient.Config.Host, err)
+		return nil, err
+	}
+	// size and modification time may not change when rewritten within mtime granularity, compare content
+	hash := sha256.New()
+	contents := map[string][]byte{}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			fileClient.Logger.Errorf("read discovery file error, file:%s, err:%s", file, err)
+			return nil, err
+		}
+		contents[file] = content
+		_, _ = fmt.Fprintf(hash, "%s:%d:", file, len(content))
+		hash.Write(content)
+	}
+	signature := hex.EncodeToString(hash.Sum(nil))
+	if signature == fileClient.signature {
+		return fileClient.services, nil
+	}
+
+	serviceMap := map[string][]model.Instance{}
+	for _, file := range files {
+		content := contents[file]
+		fileServices := model.FileServices{}
+		if err = yaml.Unmarshal(content, &fileServices); err != nil {
+			fileClient.Logger.Errorf("parse discovery file error, file:%s, err:%s", file, err)
+			return nil, err
+		}
+		for _, service := range fileServices.Services {
+			if len(service.Name) == 0 {
+				return nil, errors.New(fmt.Sprintf("service name must not null, file:%s", file))
+			}
+			if _, ok := serviceMap[service.Name]; !ok {
+				serviceMap[service.Name] = []model.Instance{}
+			}
+			for _, ins := range service.Instances {
+				if len(ins.Ip) == 0 || ins.Port < 1 || ins.Port > 65535 {
+					return nil, errors.New(fmt.Sprintf("invalid instance %s:%d of service %s, ip must not null "+
+						"and port must between 1 ~ 65535, file:%s", ins.Ip, ins.Port, service.Name, file))
+				}
+				instance := model.Instance{Ip: ins.Ip, Port: ins.Port, Weight: fileClient.Config.Weight,
+					Metadata: ins.Metadata, Ext: map[string]string{"file": file}}
+				if ins.Weight != nil {
+					instance.Weight = *ins.Weight
+				}
+				serviceMap[service.Name] = append(serviceMap[service.Name], instance)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(serviceMap))
+	for name := range serviceMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	services := []model.Service{}
+	for _, name := range names {
+		services = append(services, model.Service{Name: name, Instances: serviceMap[name]})
+	}
+	fileClient.Logger.Infof("reload discovery files, path:%s, services:%d", fileClient.Config.Host, len(services))
+	fileClient.services, fileClient.signature = services, signature
+	return services, nil
+}
+
+// listFiles the file itself, or yaml/json files in the directory (not recursive), sorted by name
+func (fileClient *FileClient) listFiles() ([]string, error) {
+	path := strings.TrimPrefix(fileClient.Config.Host, "file://")
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		files = []string{}
+		for _, entry := range entries {
+			if entry.IsDir() || !slices.Contains(fileDiscoveryExts, strings.ToLower(filepath.Ext(entry.Name()))) {
+				continue
+			}
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	return files, nil
+}
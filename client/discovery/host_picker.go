@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package discovery
+
+import (
+	"errors"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+	"sync"
+	"time"
+)
+
+// hostPicker pick a peer of discovery cluster, peers failed recently are cooling down and tried last
+type hostPicker struct {
+	hosts      []string
+	roundRobin bool
+	coolDown   time.Duration
+	next       int
+	failedAt   map[string]time.Time
+	logger     *go_logger.Logger
+	mutex      sync.Mutex
+}
+
+func newHostPicker(discovery model.Discovery, logger *go_logger.Logger) *hostPicker {
+	picker := &hostPicker{
+		hosts:      discovery.GetHosts(),
+		roundRobin: discovery.Config["load-balance"] == "round-robin",
+		coolDown:   30 * time.Second,
+		failedAt:   map[string]time.Time{},
+		logger:     logger,
+	}
+	if coolDown, ok := discovery.Config["cool-down"]; ok && len(coolDown) > 0 {
+		duration, err := time.ParseDuration(coolDown)
+		if err != nil {
+			logger.Warningf("invalid cool-down:%s, use %s, err:%s", coolDown, picker.coolDown, err)
+		} else {
+			picker.coolDown = duration
+		}
+	}
+	return picker
+}
+
+// candidates healthy peers first, failover keeps the order of config, round-robin starts from next peer
+func (picker *hostPicker) candidates() []string {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+
+	start := 0
+	if picker.roundRobin && len(picker.hosts) > 0 {
+		start = picker.next % len(picker.hosts)
+		picker.next++
+	}
+	healthy, cooling := []string{}, []string{}
+	for i := range picker.hosts {
+		host := picker.hosts[(start+i)%len(picker.hosts)]
+		if failedAt, ok := picker.failedAt[host]; ok && time.Since(failedAt) < picker.coolDown {
+			cooling = append(cooling, host)
+		} else {
+			healthy = append(healthy, host)
+		}
+	}
+	return append(healthy, cooling...)
+}
+
+func (picker *hostPicker) markFailed(host string) {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+	picker.failedAt[host] = time.Now()
+}
+
+func (picker *hostPicker) markSucceeded(host string) {
+	picker.mutex.Lock()
+	defer picker.mutex.Unlock()
+	delete(picker.failedAt, host)
+}
+
+// do call fn with peers until it succeeds, fn returns true if the peer is unavailable and should failover
+func (picker *hostPicker) do(fn func(host string) (bool, error)) error {
+	err := errors.New("no available host")
+	for _, host := range picker.candidates() {
+		var failover bool
+		failover, err = fn(host)
+		if !failover {
+			picker.markSucceeded(host)
+			return err
+		}
+		picker.markFailed(host)
+		picker.logger.Warningf("discovery host:%s unavailable, cool down %s, err:%s", host, picker.coolDown, err)
+	}
+	return err
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHostPickerCandidates(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]string
+		failed []string
+		// candidates of 3 calls
+		want []string
+	}{
+		{
+			name: "failover",
+			want: []string{"[a b c]", "[a b c]", "[a b c]"},
+		},
+		{
+			name:   "failover with failed peer",
+			failed: []string{"a"},
+			want:   []string{"[b c a]", "[b c a]", "[b c a]"},
+		},
+		{
+			name:   "round robin",
+			config: map[string]string{"load-balance": "round-robin"},
+			want:   []string{"[a b c]", "[b c a]", "[c a b]"},
+		},
+		{
+			name:   "round robin with failed peers",
+			config: map[string]string{"load-balance": "round-robin"},
+			failed: []string{"a", "b"},
+			want:   []string{"[c a b]", "[c b a]", "[c a b]"},
+		},
+		{
+			name:   "cool down expired",
+			config: map[string]string{"cool-down": "0s"},
+			failed: []string{"a"},
+			want:   []string{"[a b c]", "[a b c]", "[a b c]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			picker := newHostPicker(model.Discovery{Host: "a, b,c", Config: tt.config}, go_logger.NewLogger())
+			for _, host := range tt.failed {
+				picker.markFailed(host)
+			}
+			for i, want := range tt.want {
+				if got := fmt.Sprint(picker.candidates()); got != want {
+					t.Errorf("candidates of call %d got %s, want %s", i, got, want)
+				}
+			}
+		})
+	}
+
+	picker := newHostPicker(model.Discovery{Host: "a", Config: map[string]string{"cool-down": "soon"}},
+		go_logger.NewLogger())
+	if picker.coolDown != 30*time.Second {
+		t.Errorf("cool down of invalid config got %s", picker.coolDown)
+	}
+}
+
+func TestHostPickerDo(t *testing.T) {
+	picker := newHostPicker(model.Discovery{Host: "a,b,c"}, go_logger.NewLogger())
+
+	// unavailable peers are cooling down, the next call starts from the succeeded peer
+	called := []string{}
+	err := picker.do(func(host string) (bool, error) {
+		called = append(called, host)
+		if host == "c" {
+			return false, nil
+		}
+		return true, errors.New("connection refused")
+	})
+	if err != nil || fmt.Sprint(called) != "[a b c]" {
+		t.Errorf("called got %v, err:%v", called, err)
+	}
+	if got := fmt.Sprint(picker.candidates()); got != "[c a b]" {
+		t.Errorf("candidates got %s", got)
+	}
+
+	// error of available peer is returned without failover
+	called = []string{}
+	err = picker.do(func(host string) (bool, error) {
+		called = append(called, host)
+		return false, errors.New("status:404")
+	})
+	if err == nil || fmt.Sprint(called) != "[c]" {
+		t.Errorf("called got %v, err:%v", called, err)
+	}
+
+	// error of the last peer when all peers are unavailable
+	called = []string{}
+	err = picker.do(func(host string) (bool, error) {
+		called = append(called, host)
+		return true, errors.New("unavailable " + host)
+	})
+	if err == nil || err.Error() != "unavailable b" || fmt.Sprint(called) != "[c a b]" {
+		t.Errorf("called got %v, err:%v", called, err)
+	}
+
+	picker = newHostPicker(model.Discovery{Host: ""}, go_logger.NewLogger())
+	if err = picker.do(func(host string) (bool, error) { return false, nil }); err == nil {
+		t.Errorf("do without host should fail")
+	}
+}
+
+func TestNacosFailover(t *testing.T) {
+	unavailable := newFakeServer(t, false, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	stopped := newFakeServer(t, false, func(w http.ResponseWriter, r *http.Request) {})
+	stopped.Close()
+	available := newFakeServer(t, false, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/nacos/v1/ns/service/list" {
+			writeJson(w, http.StatusNotFound, "not found")
+			return
+		}
+		writeNacos(w, model.NACOS_V1, map[string]interface{}{"count": 1, "doms": []string{"orders"}})
+	})
+	client := &NacosClient{Config: model.Discovery{Type: model.NACOS_DISCOVERY,
+		Host: unavailable.URL + "," + stopped.URL + "," + available.URL, Prefix: "/nacos/v1/"},
+		ApiVersion: model.NACOS_V1, Logger: go_logger.NewLogger()}
+
+	for i := 0; i < 2; i++ {
+		services, err := client.GetAllService(map[string]string{})
+		if err != nil || len(services) != 1 {
+			t.Fatalf("GetAllService got %v, err:%v", services, err)
+		}
+	}
+	// peers failed are cooling down, not requested by the second call
+	if requests := unavailable.takeRequests(); len(requests) != 1 {
+		t.Errorf("requests of unavailable peer got %v", requests)
+	}
+	if requests := available.takeRequests(); len(requests) != 2 {
+		t.Errorf("requests of available peer got %v", requests)
+	}
+
+	// 4xx is not failover
+	if _, err := client.GetServiceAllInstances(model.GetInstanceVo{ServiceName: "orders"}); err == nil {
+		t.Errorf("GetServiceAllInstances should fail with 404")
+	}
+	if requests := unavailable.takeRequests(); len(requests) != 0 {
+		t.Errorf("requests of unavailable peer got %v", requests)
+	}
+}
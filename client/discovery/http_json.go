@@ -0,0 +1,375 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package discovery
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// HttpJsonClient fetch services and instances from any http json api,
+// map the response to services and instances by jsonpath or golang template
+type HttpJsonClient struct {
+	Config model.Discovery
+	Logger *go_logger.Logger
+}
+
+func (httpJsonClient *HttpJsonClient) GetAllService(data map[string]string) ([]model.Service, error) {
+	servicesUrl := httpJsonClient.getConfig(data, "services-url")
+	if len(servicesUrl) == 0 {
+		return nil, errors.New("services-url must not null")
+	}
+	body, uri, err := httpJsonClient.httpGet(servicesUrl)
+	if err != nil {
+		httpJsonClient.Logger.Errorf("fetch http-json service error, uri:%s, err:%s", uri, err)
+		return nil, errors.New("fetch http-json service error")
+	}
+	items, err := jsonPathQuery(body, httpJsonClient.getConfig(data, "services-path"))
+	if err != nil {
+		httpJsonClient.Logger.Errorf("fetch http-json service error, uri:%s, err:%s", uri, err)
+		return nil, errors.New("fetch http-json service error")
+	}
+	httpJsonClient.Logger.Debugf("fetch http-json service, uri:%s, items:%#v", uri, items)
+
+	// instances are in the services response if instances-url is empty
+	embedded := len(httpJsonClient.getConfig(data, "instances-url")) == 0
+	services := []model.Service{}
+	for _, item := range items {
+		name, err := evalJsonField(item, httpJsonClient.getConfig(data, "service-name-path"))
+		if err != nil {
+			httpJsonClient.Logger.Errorf("eval http-json service name error, item:%#v, err:%s", item, err)
+			return nil, errors.New("fetch http-json service error")
+		}
+		if len(name) == 0 {
+			continue
+		}
+		service := model.Service{Name: name}
+		if embedded {
+			service.Instances, err = httpJsonClient.convertInstances(item, data)
+			if err != nil {
+				httpJsonClient.Logger.Errorf("convert http-json service instance error, service:%s, err:%s",
+					name, err)
+				return nil, errors.New("fetch http-json service instance error")
+			}
+			if len(service.Instances) == 0 {
+				continue
+			}
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+func (httpJsonClient *HttpJsonClient) GetServiceAllInstances(vo model.GetInstanceVo) ([]model.Instance, error) {
+	instancesUrl := httpJsonClient.getConfig(vo.ExtData, "instances-url")
+	if len(instancesUrl) == 0 {
+		services, err := httpJsonClient.GetAllService(vo.ExtData)
+		if err != nil {
+			return nil, err
+		}
+		for _, service := range services {
+			if service.Name == vo.ServiceName {
+				return service.Instances, nil
+			}
+		}
+		return []model.Instance{}, nil
+	}
+	tmpl, err := template.New("InstancesUrl").Funcs(template.FuncMap{
+		"pathEscape":  url.PathEscape,
+		"queryEscape": url.QueryEscape,
+	}).Parse(instancesUrl)
+	if err != nil {
+		httpJsonClient.Logger.Errorf("parse http-json instances-url error, tmpl:%s, err:%s", instancesUrl, err)
+		return nil, err
+	}
+	var buf bytes.Buffer
+	// ServiceName is escaped for both path and query, RawServiceName is as is
+	data := map[string]string{
+		"ServiceName":    strings.ReplaceAll(url.QueryEscape(vo.ServiceName), "+", "%20"),
+		"RawServiceName": vo.ServiceName,
+	}
+	if err = tmpl.Execute(&buf, data); err != nil {
+		httpJsonClient.Logger.Errorf("parse http-json instances-url error, tmpl:%s, err:%s", instancesUrl, err)
+		return nil, err
+	}
+
+	body, uri, err := httpJsonClient.httpGet(buf.String())
+	if err != nil {
+		httpJsonClient.Logger.Errorf("fetch http-json service instance error, uri:%s, err:%s", uri, err)
+		return nil, errors.New("fetch http-json service instance error")
+	}
+	var root interface{}
+	if err = decodeJsonNumber(body, &root); err != nil {
+		httpJsonClient.Logger.Errorf("fetch http-json service instance error, uri:%s, err:%s", uri, err)
+		return nil, errors.New("fetch http-json service instance error")
+	}
+	instances, err := httpJsonClient.convertInstances(root, vo.ExtData)
+	if err != nil {
+		httpJsonClient.Logger.Errorf("convert http-json service instance error, uri:%s, err:%s", uri, err)
+		return nil, errors.New("fetch http-json service instance error")
+	}
+	httpJsonClient.Logger.Debugf("fetch http-json service instance, uri:%s, instances:%#v", uri, instances)
+	return instances, nil
+}
+
+func (httpJsonClient *HttpJsonClient) ModifyRegistration(model.Registration, []model.Instance) error {
+	return errors.New("http-json discovery does not support modify registration")
+}
+
+func (httpJsonClient *HttpJsonClient) convertInstances(root interface{},
+	data map[string]string) ([]model.Instance, error) {
+	items, err := jsonPathEval(root, httpJsonClient.getConfig(data, "instances-path"))
+	if err != nil {
+		return nil, err
+	}
+	instances := []model.Instance{}
+	for _, item := range items {
+		ip, err := evalJsonField(item, httpJsonClient.getConfig(data, "ip-path"))
+		if err != nil {
+			return nil, err
+		}
+		portStr, err := evalJsonField(item, httpJsonClient.getConfig(data, "port-path"))
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			httpJsonClient.Logger.Warningf("skip http-json instance, invalid port:%s, item:%#v", portStr, item)
+			continue
+		}
+		instance := model.Instance{Ip: ip, Port: port, Weight: httpJsonClient.Config.Weight,
+			Metadata: map[string]string{}, Ext: map[string]string{}}
+		if expr := httpJsonClient.getConfig(data, "weight-path"); len(expr) > 0 {
+			weightStr, err := evalJsonField(item, expr)
+			if err != nil {
+				return nil, err
+			}
+			if weight, err := strconv.ParseFloat(weightStr, 32); err == nil {
+				instance.Weight = float32(weight)
+			}
+		}
+		if expr := httpJsonClient.getConfig(data, "metadata-path"); len(expr) > 0 {
+			values, err := jsonPathEval(item, expr)
+			if err != nil {
+				return nil, err
+			}
+			for _, value := range values {
+				if m, ok := value.(map[string]interface{}); ok {
+					for k, v := range m {
+						instance.Metadata[k] = fmt.Sprint(v)
+					}
+				}
+			}
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// getConfig target config first, then discovery config
+func (httpJsonClient *HttpJsonClient) getConfig(data map[string]string, key string) string {
+	if v, ok := data[key]; ok && len(v) > 0 {
+		return v
+	}
+	return httpJsonClient.Config.Config[key]
+}
+
+// httpGet path is relative to host+prefix, unless it starts with http
+func (httpJsonClient *HttpJsonClient) httpGet(path string) ([]byte, string, error) {
+	uri := path
+	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+		uri = httpJsonClient.Config.Host + httpJsonClient.Config.Prefix + strings.TrimPrefix(path, "/")
+	}
+	hc := &http.Client{Timeout: 30 * time.Second}
+	req, _ := http.NewRequest("GET", uri, nil)
+	req.Header.Add("Accept", "application/json")
+	// header.X-Token: xxx
+	for k, v := range httpJsonClient.Config.Config {
+		if strings.HasPrefix(k, "header.") {
+			req.Header.Set(strings.TrimPrefix(k, "header."), v)
+		}
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, uri, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, uri, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, uri, errors.New(fmt.Sprintf("status:%s, body:%s", resp.Status, body))
+	}
+	return body, uri, nil
+}
+
+func decodeJsonNumber(body []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+func jsonPathQuery(body []byte, expr string) ([]interface{}, error) {
+	var root interface{}
+	if err := decodeJsonNumber(body, &root); err != nil {
+		return nil, err
+	}
+	return jsonPathEval(root, expr)
+}
+
+// evalJsonField golang template if expr contains "{{", otherwise jsonpath(first match),
+// the item itself if expr is empty
+func evalJsonField(item interface{}, expr string) (string, error) {
+	if strings.Contains(expr, "{{") {
+		tmpl, err := template.New("JsonField").Option("missingkey=zero").Parse(expr)
+		if err != nil {
+			return "", err
+		}
+		var buf bytes.Buffer
+		if err = tmpl.Execute(&buf, item); err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(buf.String()), nil
+	}
+	values, err := jsonPathEval(item, expr)
+	if err != nil {
+		return "", err
+	}
+	if len(values) == 0 || values[0] == nil {
+		return "", nil
+	}
+	switch v := values[0].(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(v)
+		return string(b), err
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+var jsonPathTokenRE = regexp.MustCompile(`^(\.\.?[^.\[]*|\[\*]|\[-?\d+]|\['[^']*']|\["[^"]*"])`)
+
+// jsonPathEval a subset of jsonpath, supports $ .key ['key'] [n] [*] .* and ..key
+func jsonPathEval(root interface{}, expr string) ([]interface{}, error) {
+	expr = strings.TrimSpace(expr)
+	if len(expr) == 0 || expr == "$" {
+		return []interface{}{root}, nil
+	}
+	if !strings.HasPrefix(expr, "$") {
+		return nil, errors.New(fmt.Sprintf("invalid jsonpath:%s, must start with $", expr))
+	}
+	rest := expr[1:]
+	current := []interface{}{root}
+	for len(rest) > 0 {
+		token := jsonPathTokenRE.FindString(rest)
+		if len(token) == 0 {
+			return nil, errors.New(fmt.Sprintf("invalid jsonpath:%s, near %s", expr, rest))
+		}
+		rest = rest[len(token):]
+		next := []interface{}{}
+		for _, node := range current {
+			next = append(next, jsonPathStep(node, token)...)
+		}
+		current = next
+	}
+	return current, nil
+}
+
+func jsonPathStep(node interface{}, token string) []interface{} {
+	switch {
+	case strings.HasPrefix(token, ".."):
+		return jsonPathDescendants(node, token[2:])
+	case token == ".*" || token == "[*]":
+		return jsonPathChildren(node)
+	case strings.HasPrefix(token, "."):
+		return jsonPathKey(node, token[1:])
+	case strings.HasPrefix(token, "['") || strings.HasPrefix(token, "[\""):
+		return jsonPathKey(node, token[2:len(token)-2])
+	default:
+		idx, _ := strconv.Atoi(token[1 : len(token)-1])
+		arr, ok := node.([]interface{})
+		if !ok {
+			return nil
+		}
+		if idx < 0 {
+			idx = len(arr) + idx
+		}
+		if idx < 0 || idx >= len(arr) {
+			return nil
+		}
+		return []interface{}{arr[idx]}
+	}
+}
+
+func jsonPathKey(node interface{}, key string) []interface{} {
+	m, ok := node.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	v, ok := m[key]
+	if !ok {
+		return nil
+	}
+	return []interface{}{v}
+}
+
+func jsonPathChildren(node interface{}) []interface{} {
+	switch n := node.(type) {
+	case []interface{}:
+		return n
+	case map[string]interface{}:
+		keys := make([]string, 0, len(n))
+		for k := range n {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		children := []interface{}{}
+		for _, k := range keys {
+			children = append(children, n[k])
+		}
+		return children
+	}
+	return nil
+}
+
+func jsonPathDescendants(node interface{}, key string) []interface{} {
+	result := []interface{}{}
+	if key == "*" || len(key) == 0 {
+		result = append(result, jsonPathChildren(node)...)
+	} else {
+		result = append(result, jsonPathKey(node, key)...)
+	}
+	for _, child := range jsonPathChildren(node) {
+		result = append(result, jsonPathDescendants(child, key)...)
+	}
+	return result
+}
@@ -0,0 +1,388 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package discovery
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+	"gopkg.in/yaml.v2"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KubernetesClient list Services and EndpointSlices from kubernetes api server
+type KubernetesClient struct {
+	Config model.Discovery
+	Logger *go_logger.Logger
+	conn   *kubernetesConn
+	mutex  sync.Mutex
+}
+
+type kubernetesConn struct {
+	server    string
+	hc        *http.Client
+	token     string
+	tokenFile string
+	username  string
+	password  string
+	namespace string
+}
+
+const (
+	inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+func (kubernetesClient *KubernetesClient) GetAllService(data map[string]string) ([]model.Service, error) {
+	conn, err := kubernetesClient.getConn()
+	if err != nil {
+		kubernetesClient.Logger.Errorf("init kubernetes client error, err:%s", err)
+		return nil, errors.New("fetch kubernetes service error")
+	}
+	namespace := kubernetesClient.getNamespace(conn, data)
+	r := url.Values{}
+	if selector, ok := data["labelSelector"]; ok && len(selector) > 0 {
+		r.Set("labelSelector", selector)
+	}
+	serviceList := model.K8sServiceList{}
+	uri := "/api/v1/namespaces/" + namespace + "/services?" + r.Encode()
+	if err = kubernetesClient.httpGet(conn, uri, &serviceList); err != nil {
+		kubernetesClient.Logger.Errorf("fetch kubernetes service error, uri:%s, err:%s", uri, err)
+		return nil, errors.New("fetch kubernetes service error")
+	}
+	kubernetesClient.Logger.Debugf("fetch kubernetes service, uri:%s, serviceList:%#v", uri, serviceList)
+
+	services := []model.Service{}
+	for _, service := range serviceList.Items {
+		if service.Spec.Type == "ExternalName" {
+			continue
+		}
+		services = append(services, model.Service{Name: service.Metadata.Name})
+	}
+	return services, nil
+}
+
+func (kubernetesClient *KubernetesClient) GetServiceAllInstances(vo model.GetInstanceVo) ([]model.Instance, error) {
+	conn, err := kubernetesClient.getConn()
+	if err != nil {
+		kubernetesClient.Logger.Errorf("init kubernetes client error, err:%s", err)
+		return nil, errors.New("fetch kubernetes service instance error")
+	}
+	namespace := kubernetesClient.getNamespace(conn, vo.ExtData)
+
+	r := url.Values{}
+	r.Set("labelSelector", "kubernetes.io/service-name="+vo.ServiceName)
+	sliceList := model.K8sEndpointSliceList{}
+	uri := "/apis/discovery.k8s.io/v1/namespaces/" + namespace + "/endpointslices?" + r.Encode()
+	if err = kubernetesClient.httpGet(conn, uri, &sliceList); err != nil {
+		kubernetesClient.Logger.Errorf("fetch kubernetes endpointslices error, uri:%s, err:%s", uri, err)
+		return nil, errors.New("fetch kubernetes service instance error")
+	}
+	kubernetesClient.Logger.Debugf("fetch kubernetes endpointslices, uri:%s, sliceList:%#v", uri, sliceList)
+
+	podLabels := kubernetesClient.fetchPodLabels(conn, namespace, vo.ServiceName)
+	portName := vo.ExtData["port"]
+
+	instances := []model.Instance{}
+	exists := map[string]bool{}
+	for _, slice := range sliceList.Items {
+		if slice.AddressType == "FQDN" {
+			continue
+		}
+		port, ok := selectK8sPort(slice.Ports, portName)
+		if !ok {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			// nil ready means unknown, should be interpreted as ready
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			metadata := map[string]string{}
+			ext := map[string]string{"namespace": namespace, "nodeName": endpoint.NodeName, "zone": endpoint.Zone,
+				"portName": port.Name}
+			if endpoint.TargetRef != nil && endpoint.TargetRef.Kind == "Pod" {
+				ext["podName"] = endpoint.TargetRef.Name
+				for k, v := range podLabels[endpoint.TargetRef.Name] {
+					metadata[k] = v
+				}
+			}
+			for _, address := range endpoint.Addresses {
+				// the same endpoint may be in multiple slices during update
+				k := net.JoinHostPort(address, strconv.Itoa(port.Port))
+				if exists[k] {
+					continue
+				}
+				exists[k] = true
+				// every instance owns its maps, addresses of an endpoint must not share them
+				instance := model.Instance{Ip: address, Port: port.Port, Weight: kubernetesClient.Config.Weight,
+					Metadata: map[string]string{}, Ext: map[string]string{}}
+				for mk, mv := range metadata {
+					instance.Metadata[mk] = mv
+				}
+				for ek, ev := range ext {
+					instance.Ext[ek] = ev
+				}
+				instances = append(instances, instance)
+			}
+		}
+	}
+	return instances, nil
+}
+
+func (kubernetesClient *KubernetesClient) ModifyRegistration(model.Registration, []model.Instance) error {
+	return errors.New("kubernetes discovery does not support modify registration")
+}
+
+// selectK8sPort select port by name or number, first port if portName is empty
+func selectK8sPort(ports []model.K8sEndpointPort, portName string) (model.K8sEndpointPort, bool) {
+	if len(ports) == 0 {
+		return model.K8sEndpointPort{}, false
+	}
+	if len(portName) == 0 {
+		// ports of the slice are shared, sort a copy
+		sorted := append([]model.K8sEndpointPort{}, ports...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+		return sorted[0], true
+	}
+	for _, port := range ports {
+		if port.Name == portName || strconv.Itoa(port.Port) == portName {
+			return port, true
+		}
+	}
+	return model.K8sEndpointPort{}, false
+}
+
+// fetchPodLabels pod name -> labels, selected by service selector
+func (kubernetesClient *KubernetesClient) fetchPodLabels(conn *kubernetesConn, namespace string,
+	serviceName string) map[string]map[string]string {
+	podLabels := map[string]map[string]string{}
+
+	service := model.K8sService{}
+	uri := "/api/v1/namespaces/" + namespace + "/services/" + serviceName
+	if err := kubernetesClient.httpGet(conn, uri, &service); err != nil {
+		kubernetesClient.Logger.Warningf("fetch kubernetes service error, uri:%s, err:%s", uri, err)
+		return podLabels
+	}
+	if len(service.Spec.Selector) == 0 {
+		return podLabels
+	}
+	selectors := []string{}
+	for k, v := range service.Spec.Selector {
+		selectors = append(selectors, k+"="+v)
+	}
+	sort.Strings(selectors)
+	r := url.Values{}
+	r.Set("labelSelector", strings.Join(selectors, ","))
+
+	podList := model.K8sPodList{}
+	uri = "/api/v1/namespaces/" + namespace + "/pods?" + r.Encode()
+	if err := kubernetesClient.httpGet(conn, uri, &podList); err != nil {
+		kubernetesClient.Logger.Warningf("fetch kubernetes pods error, uri:%s, err:%s", uri, err)
+		return podLabels
+	}
+	for _, pod := range podList.Items {
+		podLabels[pod.Metadata.Name] = pod.Metadata.Labels
+	}
+	return podLabels
+}
+
+func (kubernetesClient *KubernetesClient) getNamespace(conn *kubernetesConn, data map[string]string) string {
+	if namespace, ok := data["namespace"]; ok && len(namespace) > 0 {
+		return namespace
+	}
+	if len(conn.namespace) > 0 {
+		return conn.namespace
+	}
+	return "default"
+}
+
+func (kubernetesClient *KubernetesClient) httpGet(conn *kubernetesConn, uri string, v interface{}) error {
+	u := conn.server + strings.TrimSuffix(kubernetesClient.Config.Prefix, "/") + uri
+	req, _ := http.NewRequest("GET", u, nil)
+	req.Header.Add("Accept", "application/json")
+
+	token := conn.token
+	if len(conn.tokenFile) > 0 {
+		// service account token is rotated by kubelet
+		content, err := os.ReadFile(conn.tokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if len(token) > 0 {
+		req.Header.Add("Authorization", "Bearer "+token)
+	} else if len(conn.username) > 0 {
+		req.SetBasicAuth(conn.username, conn.password)
+	}
+
+	resp, err := conn.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return errors.New(fmt.Sprintf("status:%s, body:%s", resp.Status, body))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (kubernetesClient *KubernetesClient) getConn() (*kubernetesConn, error) {
+	kubernetesClient.mutex.Lock()
+	defer kubernetesClient.mutex.Unlock()
+	if kubernetesClient.conn != nil {
+		return kubernetesClient.conn, nil
+	}
+	var (
+		conn *kubernetesConn
+		err  error
+	)
+	config := kubernetesClient.Config.Config
+	if kubeconfig, ok := config["kubeconfig"]; ok && len(kubeconfig) > 0 {
+		conn, err = newKubeConfigConn(kubeconfig, config["context"])
+	} else {
+		conn, err = newInClusterConn(kubernetesClient.Config.Host, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	kubernetesClient.conn = conn
+	return conn, nil
+}
+
+// newInClusterConn use host and config token/ca-file first, service account if not configured
+func newInClusterConn(host string, config map[string]string) (*kubernetesConn, error) {
+	conn := &kubernetesConn{server: host, token: config["token"]}
+	if len(conn.server) == 0 {
+		h, p := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if len(h) == 0 || len(p) == 0 {
+			return nil, errors.New("unable to load in-cluster configuration, KUBERNETES_SERVICE_HOST and " +
+				"KUBERNETES_SERVICE_PORT must be defined")
+		}
+		conn.server = "https://" + net.JoinHostPort(h, p)
+	}
+	if _, err := os.Stat(inClusterTokenFile); len(conn.token) == 0 && err == nil {
+		conn.tokenFile = inClusterTokenFile
+	}
+	caFile := config["ca-file"]
+	if _, err := os.Stat(inClusterCAFile); len(caFile) == 0 && err == nil {
+		caFile = inClusterCAFile
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: strings.ToLower(config["insecure-skip-tls-verify"]) == "true"}
+	if len(caFile) > 0 {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM(ca)
+	}
+	conn.hc = &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return conn, nil
+}
+
+func newKubeConfigConn(path string, contextName string) (*kubernetesConn, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kubeConfig := model.KubeConfig{}
+	if err = yaml.Unmarshal(content, &kubeConfig); err != nil {
+		return nil, err
+	}
+	if len(contextName) == 0 {
+		contextName = kubeConfig.CurrentContext
+	}
+	conn := &kubernetesConn{}
+	clusterName, userName := "", ""
+	for _, ctx := range kubeConfig.Contexts {
+		if ctx.Name == contextName {
+			clusterName, userName, conn.namespace = ctx.Context.Cluster, ctx.Context.User, ctx.Context.Namespace
+		}
+	}
+	if len(clusterName) == 0 {
+		return nil, errors.New(fmt.Sprintf("context %s not found in kubeconfig %s", contextName, path))
+	}
+
+	tlsConfig := &tls.Config{}
+	for _, cluster := range kubeConfig.Clusters {
+		if cluster.Name != clusterName {
+			continue
+		}
+		conn.server = cluster.Cluster.Server
+		tlsConfig.InsecureSkipVerify = cluster.Cluster.InsecureSkipTLSVerify
+		ca, err := readKubeConfigData(cluster.Cluster.CertificateAuthorityData, cluster.Cluster.CertificateAuthority)
+		if err != nil {
+			return nil, err
+		}
+		if len(ca) > 0 {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			tlsConfig.RootCAs.AppendCertsFromPEM(ca)
+		}
+	}
+	for _, user := range kubeConfig.Users {
+		if user.Name != userName {
+			continue
+		}
+		conn.token, conn.tokenFile = user.User.Token, user.User.TokenFile
+		conn.username, conn.password = user.User.Username, user.User.Password
+		cert, err := readKubeConfigData(user.User.ClientCertificateData, user.User.ClientCertificate)
+		if err != nil {
+			return nil, err
+		}
+		key, err := readKubeConfigData(user.User.ClientKeyData, user.User.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(cert) > 0 && len(key) > 0 {
+			keyPair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{keyPair}
+		}
+	}
+	if len(conn.server) == 0 {
+		return nil, errors.New(fmt.Sprintf("cluster %s not found in kubeconfig %s", clusterName, path))
+	}
+	conn.hc = &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return conn, nil
+}
+
+// readKubeConfigData base64 data first, then file
+func readKubeConfigData(data string, file string) ([]byte, error) {
+	if len(data) > 0 {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if len(file) > 0 {
+		return os.ReadFile(file)
+	}
+	return nil, nil
+}
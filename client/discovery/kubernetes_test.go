@@ -0,0 +1,369 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package discovery
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const fakeK8sToken = "test-token"
+
+var (
+	k8sReady    = true
+	k8sNotReady = false
+)
+
+// fakeK8sObjects objects of namespace shop served by fake api server
+var fakeK8sObjects = struct {
+	services []model.K8sService
+	slices   map[string][]model.K8sEndpointSlice
+	pods     []model.K8sPod
+}{
+	services: []model.K8sService{
+		{Metadata: model.K8sObjectMeta{Name: "orders", Labels: map[string]string{"tier": "backend"}},
+			Spec: model.K8sServiceSpec{Type: "ClusterIP", Selector: map[string]string{"app": "orders"}}},
+		{Metadata: model.K8sObjectMeta{Name: "payments", Labels: map[string]string{"tier": "backend"}},
+			Spec: model.K8sServiceSpec{Type: "ClusterIP"}},
+		{Metadata: model.K8sObjectMeta{Name: "legacy", Labels: map[string]string{"tier": "backend"}},
+			Spec: model.K8sServiceSpec{Type: "ExternalName"}},
+		{Metadata: model.K8sObjectMeta{Name: "web", Labels: map[string]string{"tier": "frontend"}},
+			Spec: model.K8sServiceSpec{Type: "NodePort"}},
+	},
+	slices: map[string][]model.K8sEndpointSlice{
+		"orders": {
+			{
+				AddressType: "IPv4",
+				Ports: []model.K8sEndpointPort{
+					{Name: "metrics", Port: 9090, Protocol: "TCP"},
+					{Name: "http", Port: 8080, Protocol: "TCP"},
+				},
+				Endpoints: []model.K8sEndpoint{
+					{Addresses: []string{"10.0.0.1"}, Conditions: model.K8sEndpointConditions{Ready: &k8sReady},
+						TargetRef: &model.K8sObjectReference{Kind: "Pod", Name: "orders-1"}, Zone: "a"},
+					{Addresses: []string{"10.0.0.2"}, Conditions: model.K8sEndpointConditions{Ready: &k8sNotReady},
+						TargetRef: &model.K8sObjectReference{Kind: "Pod", Name: "orders-2"}},
+					// ready unknown is ready
+					{Addresses: []string{"10.0.0.3", "10.0.0.4"},
+						TargetRef: &model.K8sObjectReference{Kind: "Pod", Name: "orders-3"}},
+				},
+			},
+			// endpoint in two slices during update
+			{
+				AddressType: "IPv4",
+				Ports: []model.K8sEndpointPort{
+					{Name: "metrics", Port: 9090, Protocol: "TCP"},
+					{Name: "http", Port: 8080, Protocol: "TCP"},
+				},
+				Endpoints: []model.K8sEndpoint{
+					{Addresses: []string{"10.0.0.1"}, Conditions: model.K8sEndpointConditions{Ready: &k8sReady},
+						TargetRef: &model.K8sObjectReference{Kind: "Pod", Name: "orders-1"}},
+				},
+			},
+			{
+				AddressType: "FQDN",
+				Ports:       []model.K8sEndpointPort{{Name: "http", Port: 8080}},
+				Endpoints:   []model.K8sEndpoint{{Addresses: []string{"orders.example.com"}}},
+			},
+		},
+	},
+	pods: []model.K8sPod{
+		{Metadata: model.K8sObjectMeta{Name: "orders-1", Labels: map[string]string{"app": "orders", "version": "v1"}}},
+		{Metadata: model.K8sObjectMeta{Name: "orders-3", Labels: map[string]string{"app": "orders", "version": "v2"}}},
+		{Metadata: model.K8sObjectMeta{Name: "other", Labels: map[string]string{"app": "other"}}},
+	},
+}
+
+// matchK8sLabels equality based label selector, like a=b,c=d
+func matchK8sLabels(selector string, labels map[string]string) bool {
+	if len(selector) == 0 {
+		return true
+	}
+	for _, requirement := range strings.Split(selector, ",") {
+		kv := strings.SplitN(requirement, "=", 2)
+		if len(kv) != 2 || labels[kv[0]] != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// serveFakeK8s api server of fakeK8sObjects, list apis filtered by labelSelector
+func serveFakeK8s(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+fakeK8sToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	selector := r.URL.Query().Get("labelSelector")
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	// only namespace shop has objects
+	namespace := ""
+	for i, part := range parts {
+		if part == "namespaces" && i+1 < len(parts) {
+			namespace = parts[i+1]
+		}
+	}
+	var result interface{}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api/v1/namespaces/") && strings.HasSuffix(r.URL.Path, "/services"):
+		list := model.K8sServiceList{Items: []model.K8sService{}}
+		for _, service := range fakeK8sObjects.services {
+			if namespace == "shop" && matchK8sLabels(selector, service.Metadata.Labels) {
+				list.Items = append(list.Items, service)
+			}
+		}
+		result = list
+	case strings.HasPrefix(r.URL.Path, "/api/v1/namespaces/") && parts[len(parts)-2] == "services":
+		for _, service := range fakeK8sObjects.services {
+			if namespace == "shop" && service.Metadata.Name == parts[len(parts)-1] {
+				result = service
+			}
+		}
+	case strings.HasSuffix(r.URL.Path, "/endpointslices"):
+		list := model.K8sEndpointSliceList{Items: []model.K8sEndpointSlice{}}
+		name := strings.TrimPrefix(selector, "kubernetes.io/service-name=")
+		if namespace == "shop" {
+			list.Items = append(list.Items, fakeK8sObjects.slices[name]...)
+		}
+		result = list
+	case strings.HasSuffix(r.URL.Path, "/pods"):
+		list := model.K8sPodList{Items: []model.K8sPod{}}
+		for _, pod := range fakeK8sObjects.pods {
+			if namespace == "shop" && matchK8sLabels(selector, pod.Metadata.Labels) {
+				list.Items = append(list.Items, pod)
+			}
+		}
+		result = list
+	}
+	if result == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJson(w, http.StatusOK, result)
+}
+
+// writeK8sCA write ca of tls server to pem file
+func writeK8sCA(t *testing.T, server *fakeServer) (string, []byte) {
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return caFile, ca
+}
+
+func TestKubernetesInClusterAndKubeConfig(t *testing.T) {
+	server := newFakeServer(t, true, serveFakeK8s)
+	caFile, ca := writeK8sCA(t, server)
+	u, _ := url.Parse(server.URL)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte(fakeK8sToken+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	content := fmt.Sprintf(`
+apiVersion: v1
+kind: Config
+current-context: dev
+clusters:
+- name: dev
+  cluster:
+    server: %s
+    certificate-authority-data: %s
+users:
+- name: dev
+  user:
+    tokenFile: %s
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: dev
+    namespace: shop
+- name: other
+  context:
+    cluster: dev
+    user: dev
+    namespace: other
+`, server.URL, base64.StdEncoding.EncodeToString(ca), tokenFile)
+	if err := os.WriteFile(kubeconfig, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		host    string
+		env     map[string]string
+		config  map[string]string
+		data    map[string]string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "in-cluster host and token",
+			host:   server.URL,
+			config: map[string]string{"token": fakeK8sToken, "ca-file": caFile},
+			data:   map[string]string{"namespace": "shop"},
+			want:   []string{"orders", "payments", "web"},
+		},
+		{
+			name:   "in-cluster service env",
+			env:    map[string]string{"KUBERNETES_SERVICE_HOST": u.Hostname(), "KUBERNETES_SERVICE_PORT": u.Port()},
+			config: map[string]string{"token": fakeK8sToken, "ca-file": caFile},
+			data:   map[string]string{"namespace": "shop", "labelSelector": "tier=backend"},
+			want:   []string{"orders", "payments"},
+		},
+		{
+			name:    "in-cluster without ca",
+			host:    server.URL,
+			config:  map[string]string{"token": fakeK8sToken},
+			data:    map[string]string{"namespace": "shop"},
+			wantErr: true,
+		},
+		{
+			name:    "in-cluster wrong token",
+			host:    server.URL,
+			config:  map[string]string{"token": "wrong", "ca-file": caFile},
+			data:    map[string]string{"namespace": "shop"},
+			wantErr: true,
+		},
+		{
+			name:   "kubeconfig namespace of current context",
+			config: map[string]string{"kubeconfig": kubeconfig},
+			data:   map[string]string{"labelSelector": "tier=frontend"},
+			want:   []string{"web"},
+		},
+		{
+			name:   "kubeconfig context",
+			config: map[string]string{"kubeconfig": kubeconfig, "context": "other"},
+			want:   []string{},
+		},
+		{
+			name:    "kubeconfig context not found",
+			config:  map[string]string{"kubeconfig": kubeconfig, "context": "missing"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			client := &KubernetesClient{Config: model.Discovery{Type: model.K8S_DISCOVERY, Host: tt.host,
+				Weight: 100, Config: tt.config}, Logger: go_logger.NewLogger()}
+			services, err := client.GetAllService(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("GetAllService should fail, got %#v", services)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetAllService err:%s", err)
+			}
+			names := []string{}
+			for _, service := range services {
+				names = append(names, service.Name)
+			}
+			sort.Strings(names)
+			if fmt.Sprint(names) != fmt.Sprint(tt.want) {
+				t.Errorf("services got %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestKubernetesInstances(t *testing.T) {
+	server := newFakeServer(t, true, serveFakeK8s)
+	caFile, _ := writeK8sCA(t, server)
+	client := &KubernetesClient{Config: model.Discovery{Type: model.K8S_DISCOVERY, Host: server.URL, Weight: 100,
+		Config: map[string]string{"token": fakeK8sToken, "ca-file": caFile}}, Logger: go_logger.NewLogger()}
+
+	tests := []struct {
+		name string
+		port string
+		want []string
+	}{
+		// first port by name when not selected
+		{name: "default port", port: "", want: []string{"10.0.0.1:8080", "10.0.0.3:8080", "10.0.0.4:8080"}},
+		{name: "named port", port: "metrics", want: []string{"10.0.0.1:9090", "10.0.0.3:9090", "10.0.0.4:9090"}},
+		{name: "port number", port: "9090", want: []string{"10.0.0.1:9090", "10.0.0.3:9090", "10.0.0.4:9090"}},
+		{name: "unknown port", port: "grpc", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instances, err := client.GetServiceAllInstances(model.GetInstanceVo{ServiceName: "orders",
+				ExtData: map[string]string{"namespace": "shop", "port": tt.port}})
+			if err != nil {
+				t.Fatalf("GetServiceAllInstances err:%s", err)
+			}
+			got := []string{}
+			for _, instance := range instances {
+				got = append(got, fmt.Sprintf("%s:%d", instance.Ip, instance.Port))
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("instances got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	instances, err := client.GetServiceAllInstances(model.GetInstanceVo{ServiceName: "orders",
+		ExtData: map[string]string{"namespace": "shop"}})
+	if err != nil {
+		t.Fatalf("GetServiceAllInstances err:%s", err)
+	}
+	byIp := map[string]model.Instance{}
+	for _, instance := range instances {
+		byIp[instance.Ip] = instance
+	}
+	if byIp["10.0.0.1"].Metadata["version"] != "v1" || byIp["10.0.0.3"].Metadata["version"] != "v2" {
+		t.Errorf("pod labels are not metadata: %#v", instances)
+	}
+	if byIp["10.0.0.1"].Ext["podName"] != "orders-1" || byIp["10.0.0.1"].Ext["zone"] != "a" ||
+		byIp["10.0.0.1"].Ext["portName"] != "http" {
+		t.Errorf("ext got %#v", byIp["10.0.0.1"].Ext)
+	}
+	// addresses of the same endpoint do not share maps
+	byIp["10.0.0.3"].Metadata["version"] = "changed"
+	byIp["10.0.0.3"].Ext["podName"] = "changed"
+	if byIp["10.0.0.4"].Metadata["version"] != "v2" || byIp["10.0.0.4"].Ext["podName"] != "orders-3" {
+		t.Errorf("instances share metadata or ext: %#v", byIp["10.0.0.4"])
+	}
+}
+
+func TestSelectK8sPort(t *testing.T) {
+	ports := []model.K8sEndpointPort{{Name: "metrics", Port: 9090}, {Name: "http", Port: 8080}}
+	port, ok := selectK8sPort(ports, "")
+	if !ok || port.Name != "http" {
+		t.Errorf("default port got %#v, want http", port)
+	}
+	if ports[0].Name != "metrics" {
+		t.Errorf("ports of caller are sorted in place: %#v", ports)
+	}
+	if _, ok = selectK8sPort(nil, ""); ok {
+		t.Errorf("port of empty ports should not be selected")
+	}
+}
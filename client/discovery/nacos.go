@@ -14,6 +14,9 @@
 package discovery
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -23,95 +26,365 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type NacosClient struct {
-	Client http.Client
-	Config model.Discovery
-	Logger *go_logger.Logger
+	Client         http.Client
+	Config         model.Discovery
+	ApiVersion     model.NacosApiVersion
+	Logger         *go_logger.Logger
+	accessToken    string
+	tokenRefreshAt time.Time
+	mutex          sync.Mutex
+	picker         *hostPicker
+	pickerOnce     sync.Once
 }
 
+// nacosIgnoreParams are syncer's own config, not passed to nacos
+var nacosIgnoreParams = []string{"template", "pageNo", "pageSize", "pageConcurrency",
+	"unhealthy-policy", "disabled-policy"}
+
 func (nacosClient *NacosClient) GetAllService(data map[string]string) ([]model.Service, error) {
-	// /nacos/v1/ns/service/list?pageNo=0&pageSize=100&groupName=&namespaceId=
+	// /nacos/v1/ns/service/list?pageNo=1&pageSize=100&groupName=&namespaceId=
+	// /nacos/v2/ns/service/list?pageNo=1&pageSize=100&groupName=&namespaceId=
 	data = getDefaultMap(data, map[string]string{
-		"pageNo":      "0",
-		"pageSize":    "1000000",
-		"groupName":   "DEFAULT_GROUP",
-		"namespaceId": "",
+		"pageSize":        "100",
+		"pageConcurrency": "4",
+		"groupName":       "DEFAULT_GROUP",
+		"namespaceId":     "",
 	})
+	pageSize, err := strconv.Atoi(data["pageSize"])
+	if err != nil || pageSize <= 0 {
+		return nil, errors.New(fmt.Sprintf("invalid nacos pageSize:%s", data["pageSize"]))
+	}
+	concurrency, err := strconv.Atoi(data["pageConcurrency"])
+	if err != nil || concurrency <= 0 {
+		concurrency = 1
+	}
+	namespaceIds, err := nacosClient.getNamespaceIds(data["namespaceId"])
+	if err != nil {
+		return nil, err
+	}
+	groupNames := splitAndTrim(data["groupName"])
+	if len(groupNames) == 0 {
+		groupNames = []string{"DEFAULT_GROUP"}
+	}
+	wildcard := false
+	for _, groupName := range groupNames {
+		if strings.ContainsAny(groupName, "*?[") {
+			wildcard = true
+			break
+		}
+	}
+
+	services := []model.Service{}
+	for _, namespaceId := range namespaceIds {
+		// there is no group list api, filter groups from catalog
+		if wildcard {
+			catalog, err := nacosClient.fetchAllPages(pageSize, concurrency, func(pageNo, pageSize int) ([]model.Service, int, error) {
+				return nacosClient.fetchCatalogPage(namespaceId, pageNo, pageSize)
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, service := range catalog {
+				if matchGroupName(groupNames, service.Ext["groupName"]) {
+					services = append(services, service)
+				}
+			}
+			continue
+		}
+		for _, groupName := range groupNames {
+			r := url.Values{}
+			for k, v := range data {
+				if slices.Contains(nacosIgnoreParams, k) {
+					continue
+				}
+				r.Set(k, v)
+			}
+			r.Set("namespaceId", namespaceId)
+			r.Set("groupName", groupName)
+			groupServices, err := nacosClient.fetchAllPages(pageSize, concurrency, func(pageNo, pageSize int) ([]model.Service, int, error) {
+				return nacosClient.fetchServicePage(r, pageNo, pageSize)
+			})
+			if err != nil {
+				return nil, err
+			}
+			services = append(services, groupServices...)
+		}
+	}
+	return services, nil
+}
+
+// fetchAllPages fetch first page to get the total count, then fetch the rest pages concurrently
+func (nacosClient *NacosClient) fetchAllPages(pageSize int, concurrency int,
+	fetch func(pageNo int, pageSize int) ([]model.Service, int, error)) ([]model.Service, error) {
+	services, count, err := fetch(1, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	// server may limit the max page size
+	if len(services) > 0 && len(services) < pageSize && len(services) < count {
+		nacosClient.Logger.Warningf("nacos limits pageSize to %d, expect %d", len(services), pageSize)
+		pageSize = len(services)
+	}
+	pages := (count + pageSize - 1) / pageSize
+	if pages < 1 {
+		pages = 1
+	}
+	pageServices := make([][]model.Service, pages+1)
+	pageServices[1] = services
+
+	var (
+		wg       sync.WaitGroup
+		errMutex sync.Mutex
+		pageErr  error
+	)
+	pageCh := make(chan int)
+	for i := 0; i < concurrency && i < pages-1; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pageNo := range pageCh {
+				services, _, err := fetch(pageNo, pageSize)
+				if err != nil {
+					errMutex.Lock()
+					pageErr = err
+					errMutex.Unlock()
+					continue
+				}
+				pageServices[pageNo] = services
+			}
+		}()
+	}
+	for pageNo := 2; pageNo <= pages; pageNo++ {
+		pageCh <- pageNo
+	}
+	close(pageCh)
+	wg.Wait()
+	if pageErr != nil {
+		return nil, pageErr
+	}
+
+	// services may move between pages during paging
+	result := []model.Service{}
+	exists := map[string]bool{}
+	for _, services := range pageServices {
+		for _, service := range services {
+			key := service.Ext["groupName"] + "@@" + service.Name
+			if exists[key] {
+				continue
+			}
+			exists[key] = true
+			result = append(result, service)
+		}
+	}
+	if len(result) < count {
+		nacosClient.Logger.Warningf("fetch nacos service, expect %d services, but got %d", count, len(result))
+	}
+	return result, nil
+}
+
+func (nacosClient *NacosClient) fetchServicePage(params url.Values, pageNo int, pageSize int) ([]model.Service, int, error) {
 	r := url.Values{}
-	for k, v := range data {
-		r.Set(k, v)
+	for k, v := range params {
+		r[k] = v
 	}
+	r.Set("pageNo", strconv.Itoa(pageNo))
+	r.Set("pageSize", strconv.Itoa(pageSize))
 
-	uri := nacosClient.Config.Host + nacosClient.Config.Prefix + "ns/service/list?" + r.Encode()
-	resp, err := http.DefaultClient.Get(uri)
+	uri := nacosClient.getPrefix(nacosClient.ApiVersion) + "ns/service/list?" + r.Encode()
+	body, err := nacosClient.httpDo("GET", uri, nil)
 	if err != nil {
 		nacosClient.Logger.Errorf("fetch nacos service error, uri:%s,err:%s", uri, err)
-		return nil, errors.New("fetch nacos service error")
+		return nil, 0, errors.New("fetch nacos service error")
 	}
 	serviceResp := &model.NacosServiceResp{}
-
-	err = json.NewDecoder(resp.Body).Decode(&serviceResp)
-	_, _ = io.Copy(ioutil.Discard, resp.Body)
-	_ = resp.Body.Close()
+	err = nacosClient.decodeResp(body, serviceResp)
 	if err != nil {
 		nacosClient.Logger.Errorf("fetch nacos service error, uri:%s,err:%s", uri, err)
-		return nil, errors.New("fetch nacos service error")
+		return nil, 0, errors.New("fetch nacos service error")
 	}
 	nacosClient.Logger.Debugf("fetch nacos service,uri, uri:%s, serviceResp:%#v", uri, serviceResp)
 	services := []model.Service{}
-	for _, name := range serviceResp.ServiceNames {
-		services = append(services, model.Service{Name: name})
+	for _, name := range serviceResp.GetServiceNames() {
+		services = append(services, model.Service{Name: name, Ext: map[string]string{
+			"namespaceId": r.Get("namespaceId"),
+			"groupName":   r.Get("groupName"),
+		}})
 	}
-	return services, nil
+	return services, serviceResp.Total, nil
+}
+
+// fetchCatalogPage list services of all groups, catalog api only exists in v1
+func (nacosClient *NacosClient) fetchCatalogPage(namespaceId string, pageNo int, pageSize int) ([]model.Service, int, error) {
+	r := url.Values{}
+	r.Set("namespaceId", namespaceId)
+	r.Set("withInstances", "false")
+	r.Set("pageNo", strconv.Itoa(pageNo))
+	r.Set("pageSize", strconv.Itoa(pageSize))
+
+	uri := nacosClient.getPrefix(model.NACOS_V1) + "ns/catalog/services?" + r.Encode()
+	body, err := nacosClient.httpDo("GET", uri, nil)
+	if err != nil {
+		nacosClient.Logger.Errorf("fetch nacos catalog service error, uri:%s,err:%s", uri, err)
+		return nil, 0, errors.New("fetch nacos catalog service error")
+	}
+	catalogResp := &model.NacosCatalogServiceResp{}
+	err = json.Unmarshal(body, catalogResp)
+	if err != nil {
+		nacosClient.Logger.Errorf("fetch nacos catalog service error, uri:%s,err:%s", uri, err)
+		return nil, 0, errors.New("fetch nacos catalog service error")
+	}
+	nacosClient.Logger.Debugf("fetch nacos catalog service, uri:%s, catalogResp:%#v", uri, catalogResp)
+	services := []model.Service{}
+	for _, service := range catalogResp.ServiceList {
+		services = append(services, model.Service{Name: service.Name, Ext: map[string]string{
+			"namespaceId": namespaceId,
+			"groupName":   service.GroupName,
+		}})
+	}
+	return services, catalogResp.Count, nil
+}
+
+// getNamespaceIds "*" means all namespaces, or comma separated namespace ids
+func (nacosClient *NacosClient) getNamespaceIds(namespaceId string) ([]string, error) {
+	if strings.TrimSpace(namespaceId) != "*" {
+		namespaceIds := splitAndTrim(namespaceId)
+		if len(namespaceIds) == 0 {
+			namespaceIds = []string{""}
+		}
+		return namespaceIds, nil
+	}
+	uri := nacosClient.getPrefix(model.NACOS_V1) + "console/namespaces"
+	body, err := nacosClient.httpDo("GET", uri, nil)
+	if err != nil {
+		nacosClient.Logger.Errorf("fetch nacos namespaces error, uri:%s,err:%s", uri, err)
+		return nil, errors.New("fetch nacos namespaces error")
+	}
+	namespaceResp := &model.NacosNamespaceResp{}
+	err = json.Unmarshal(body, namespaceResp)
+	if err != nil {
+		nacosClient.Logger.Errorf("fetch nacos namespaces error, uri:%s,err:%s", uri, err)
+		return nil, errors.New("fetch nacos namespaces error")
+	}
+	nacosClient.Logger.Debugf("fetch nacos namespaces, uri:%s, namespaceResp:%#v", uri, namespaceResp)
+	namespaceIds := []string{}
+	for _, namespace := range namespaceResp.Data {
+		namespaceIds = append(namespaceIds, namespace.Namespace)
+	}
+	return namespaceIds, nil
 }
 
+// getPrefix replace the version of prefix, /nacos/v1/ -> /nacos/v2/, /nacos/ -> /nacos/v2/
+// some apis only exist in v1, so prefix is built from version instead of used as is
+func (nacosClient *NacosClient) getPrefix(version model.NacosApiVersion) string {
+	base := strings.TrimSuffix(nacosClient.Config.Prefix, "/")
+	if index := strings.LastIndex(base, "/"); index >= 0 {
+		switch model.NacosApiVersion(base[index+1:]) {
+		case model.NACOS_V1, model.NACOS_V2:
+			base = base[:index]
+		}
+	}
+	if len(base) == 0 && len(nacosClient.Config.Prefix) == 0 {
+		base = "/nacos"
+	}
+	return base + "/" + string(version) + "/"
+}
+
+func matchGroupName(patterns []string, groupName string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, groupName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func splitAndTrim(s string) []string {
+	result := []string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// getDefaultMap returns a copy of data with defaultMap filled in
 func getDefaultMap(data map[string]string, defaultMap map[string]string) map[string]string {
+	result := map[string]string{}
+	for key, val := range data {
+		result[key] = val
+	}
 	for key, val := range defaultMap {
-		_, ok := data[key]
+		_, ok := result[key]
 		if !ok {
-			data[key] = val
+			result[key] = val
 		}
 	}
-	return data
+	return result
 }
 func (nacosClient *NacosClient) GetServiceAllInstances(vo model.GetInstanceVo) ([]model.Instance, error) {
-	vo.ExtData["serviceName"] = vo.ServiceName
-	r := url.Values{}
+	extData := map[string]string{}
 	for k, v := range vo.ExtData {
-		if k == "template" {
+		extData[k] = v
+	}
+	extData["serviceName"] = vo.ServiceName
+	r := url.Values{}
+	for k, v := range extData {
+		if slices.Contains(nacosIgnoreParams, k) {
 			continue
 		}
 		r.Set(k, v)
 	}
+	// v2 use clusterName instead of clusters
+	if clusters, ok := extData["clusters"]; ok && nacosClient.ApiVersion == model.NACOS_V2 {
+		r.Del("clusters")
+		r.Set("clusterName", clusters)
+	}
 
-	uri := nacosClient.Config.Host + nacosClient.Config.Prefix + "ns/instance/list?" + r.Encode()
-	hc := &http.Client{Timeout: 30 * time.Second}
-
-	req, _ := http.NewRequest("GET", uri, nil)
-	req.Header.Add("Accept", "application/json")
-	resp, err := hc.Do(req)
-
+	uri := nacosClient.getPrefix(nacosClient.ApiVersion) + "ns/instance/list?" + r.Encode()
+	body, err := nacosClient.httpDo("GET", uri, nil)
 	if err != nil {
 		nacosClient.Logger.Errorf("fetch nacos service instance error, uri:%s, err:%s", uri, err)
 		return nil, errors.New("fetch nacos service instance error")
 	}
 
 	nacosResp := model.NacosInstanceResp{}
-	err = json.NewDecoder(resp.Body).Decode(&nacosResp)
-
-	_, _ = io.Copy(ioutil.Discard, resp.Body)
-	_ = resp.Body.Close()
+	err = nacosClient.decodeResp(body, &nacosResp)
 	if err != nil {
 		nacosClient.Logger.Errorf("fetch nacos service instance error, uri:%s, err:%s", uri, err)
 		return nil, errors.New("fetch nacos service instance error")
 	}
 	nacosClient.Logger.Debugf("fetch nacos service:%s,instances:%#v", uri, nacosResp.Hosts)
+	unhealthyPolicy := nacosClient.getPolicy(extData, "unhealthy-policy", model.NACOS_POLICY_KEEP)
+	disabledPolicy := nacosClient.getPolicy(extData, "disabled-policy", model.NACOS_POLICY_DROP)
 	instances := []model.Instance{}
 	for _, host := range nacosResp.Hosts {
+		policy := model.NACOS_POLICY_KEEP
+		if !host.Enabled {
+			policy = disabledPolicy
+		}
+		// disabled and unhealthy, the stricter policy wins
+		if !host.Healthy && policy != model.NACOS_POLICY_DROP && unhealthyPolicy != model.NACOS_POLICY_KEEP {
+			policy = unhealthyPolicy
+		}
+		if policy == model.NACOS_POLICY_DROP {
+			nacosClient.Logger.Debugf("drop nacos instance, service:%s, ip:%s, port:%d, enabled:%t, healthy:%t",
+				vo.ServiceName, host.Ip, host.Port, host.Enabled, host.Healthy)
+			continue
+		}
+		if policy == model.NACOS_POLICY_ZERO_WEIGHT {
+			host.Weight = 0
+		}
 		instance := model.Instance{
 			Ip:       host.Ip,
 			Port:     host.Port,
@@ -123,7 +396,11 @@ func (nacosClient *NacosClient) GetServiceAllInstances(vo model.GetInstanceVo) (
 				"clusterName": host.ClusterName,
 				"namespaceId": host.NamespaceId,
 				"ephemeral":   strconv.FormatBool(host.Ephemeral)}}
-		for k, v := range vo.ExtData {
+		// ext is sent back to nacos when registration is changed
+		for k, v := range extData {
+			if slices.Contains(nacosIgnoreParams, k) {
+				continue
+			}
 			instance.Ext[k] = v
 		}
 		instances = append(instances, instance)
@@ -132,6 +409,23 @@ func (nacosClient *NacosClient) GetServiceAllInstances(vo model.GetInstanceVo) (
 	return instances, err
 }
 
+// getPolicy unhealthy-policy and disabled-policy, drop, keep or zero-weight
+func (nacosClient *NacosClient) getPolicy(data map[string]string, key string,
+	defaultPolicy model.NacosInstancePolicy) model.NacosInstancePolicy {
+	val, ok := data[key]
+	if !ok || len(val) == 0 {
+		return defaultPolicy
+	}
+	policy := model.NacosInstancePolicy(strings.ToLower(val))
+	switch policy {
+	case model.NACOS_POLICY_DROP, model.NACOS_POLICY_KEEP, model.NACOS_POLICY_ZERO_WEIGHT:
+		return policy
+	default:
+		nacosClient.Logger.Warningf("invalid nacos %s:%s, use %s", key, val, defaultPolicy)
+		return defaultPolicy
+	}
+}
+
 func (nacosClient *NacosClient) ModifyRegistration(registration model.Registration, instances []model.Instance) error {
 	for _, instance := range instances {
 		if !instance.Change {
@@ -154,23 +448,190 @@ func (nacosClient *NacosClient) ModifyRegistration(registration model.Registrati
 		}
 		r.Set("metadata", string(metadata))
 
-		uri := nacosClient.Config.Host + nacosClient.Config.Prefix + "ns/instance?" + r.Encode()
-		hc := &http.Client{Timeout: 30 * time.Second}
+		// v1 use query string, v2 use form body
+		uri := nacosClient.getPrefix(nacosClient.ApiVersion) + "ns/instance"
+		var form url.Values
+		if nacosClient.ApiVersion == model.NACOS_V2 {
+			form = r
+		} else {
+			uri = uri + "?" + r.Encode()
+		}
+		body, err := nacosClient.httpDo("PUT", uri, form)
+		if err == nil {
+			err = nacosClient.decodeResp(body, nil)
+		}
+		if err != nil {
+			nacosClient.Logger.Errorf("update nacos instance error, instance:%#v, body:%s, err:%s", instance, body, err)
+			continue
+		}
+	}
+	return nil
+}
+
+// httpDo request nacos peers with path, network error or 5xx will failover to next peer
+func (nacosClient *NacosClient) httpDo(method string, path string, form url.Values) ([]byte, error) {
+	nacosClient.pickerOnce.Do(func() {
+		nacosClient.picker = newHostPicker(nacosClient.Config, nacosClient.Logger)
+	})
+	var body []byte
+	err := nacosClient.picker.do(func(host string) (bool, error) {
+		var (
+			status int
+			err    error
+		)
+		status, body, err = nacosClient.httpDoHost(method, host, path, form)
+		return err != nil && (status == 0 || status >= 500), err
+	})
+	return body, err
+}
+
+func (nacosClient *NacosClient) httpDoHost(method string, host string, path string,
+	form url.Values) (int, []byte, error) {
+	hc := &http.Client{Timeout: 30 * time.Second}
 
-		req, _ := http.NewRequest("PUT", uri, nil)
+	for retry := 0; ; retry++ {
+		u, err := url.Parse(host + path)
+		if err != nil {
+			return 0, nil, err
+		}
+		params := u.Query()
+		if err = nacosClient.injectSecurity(host, params, form); err != nil {
+			return 0, nil, err
+		}
+		u.RawQuery = params.Encode()
+
+		var reqBody io.Reader
+		if form != nil {
+			reqBody = strings.NewReader(form.Encode())
+		}
+		req, _ := http.NewRequest(method, u.String(), reqBody)
 		req.Header.Add("Accept", "application/json")
+		if form != nil {
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		}
 		resp, err := hc.Do(req)
 		if err != nil {
-			nacosClient.Logger.Errorf("update nacos instance error, instance:%#v, err:%s", instance, err)
-			continue
+			return 0, nil, err
 		}
-		body, err := ioutil.ReadAll(resp.Body)
+		body, err := io.ReadAll(resp.Body)
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
 		if err != nil {
-			nacosClient.Logger.Errorf("update nacos instance error, instance:%#v, body:%s, err:%s", instance, body, err)
+			return 0, nil, err
+		}
+		// token expired or revoked, login again
+		if resp.StatusCode == http.StatusForbidden && retry == 0 && nacosClient.hasAuth() {
+			nacosClient.mutex.Lock()
+			nacosClient.accessToken = ""
+			nacosClient.mutex.Unlock()
 			continue
 		}
-		_, _ = io.Copy(ioutil.Discard, resp.Body)
-		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, body, errors.New(fmt.Sprintf("status:%s, body:%s", resp.Status, body))
+		}
+		return resp.StatusCode, body, nil
+	}
+}
+
+func (nacosClient *NacosClient) hasAuth() bool {
+	return len(nacosClient.Config.Config["username"]) > 0
+}
+
+// injectSecurity add accessToken, and ak/sk signature same as nacos java client,
+// serviceName and groupName of v2 are in form body
+func (nacosClient *NacosClient) injectSecurity(host string, params url.Values, form url.Values) error {
+	if nacosClient.hasAuth() {
+		token, err := nacosClient.getAccessToken(host)
+		if err != nil {
+			return err
+		}
+		params.Set("accessToken", token)
+	}
+	ak, sk := nacosClient.Config.Config["access-key"], nacosClient.Config.Config["secret-key"]
+	if len(ak) > 0 && len(sk) > 0 {
+		signData := strconv.FormatInt(time.Now().UnixMilli(), 10)
+		// sign timestamp@@groupName@@serviceName, unless serviceName already contains the group
+		signParams := params
+		if form != nil {
+			signParams = form
+		}
+		if serviceName := signParams.Get("serviceName"); len(serviceName) > 0 {
+			groupName := signParams.Get("groupName")
+			if len(groupName) > 0 && !strings.Contains(serviceName, "@@") {
+				serviceName = groupName + "@@" + serviceName
+			}
+			signData = signData + "@@" + serviceName
+		}
+		mac := hmac.New(sha1.New, []byte(sk))
+		mac.Write([]byte(signData))
+		params.Set("signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+		params.Set("data", signData)
+		params.Set("ak", ak)
 	}
 	return nil
 }
+
+// getAccessToken login by username and password, refresh before tokenTtl expires,
+// token is shared by all peers of the cluster
+func (nacosClient *NacosClient) getAccessToken(host string) (string, error) {
+	nacosClient.mutex.Lock()
+	defer nacosClient.mutex.Unlock()
+	if len(nacosClient.accessToken) > 0 && time.Now().Before(nacosClient.tokenRefreshAt) {
+		return nacosClient.accessToken, nil
+	}
+
+	authPrefix, ok := nacosClient.Config.Config["auth-prefix"]
+	if !ok || len(authPrefix) == 0 {
+		// login api only exists in v1
+		authPrefix = nacosClient.getPrefix(model.NACOS_V1)
+	}
+	uri := host + authPrefix + "auth/login"
+	form := url.Values{}
+	form.Set("username", nacosClient.Config.Config["username"])
+	form.Set("password", nacosClient.Config.Config["password"])
+
+	hc := &http.Client{Timeout: 30 * time.Second}
+	resp, err := hc.PostForm(uri, form)
+	if err != nil {
+		nacosClient.Logger.Errorf("nacos login error, uri:%s, err:%s", uri, err)
+		return "", err
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		nacosClient.Logger.Errorf("nacos login error, uri:%s, status:%s, body:%s", uri, resp.Status, body)
+		return "", errors.New("nacos login error")
+	}
+	loginResp := model.NacosLoginResp{}
+	if err = json.Unmarshal(body, &loginResp); err != nil {
+		nacosClient.Logger.Errorf("nacos login error, uri:%s, body:%s, err:%s", uri, body, err)
+		return "", err
+	}
+	// same as nacos java client, refresh at 90% of tokenTtl
+	ttl := time.Duration(loginResp.TokenTtl) * time.Second
+	nacosClient.accessToken = loginResp.AccessToken
+	nacosClient.tokenRefreshAt = time.Now().Add(ttl - ttl/10)
+	nacosClient.Logger.Debugf("nacos login success, uri:%s, tokenTtl:%d", uri, loginResp.TokenTtl)
+	return nacosClient.accessToken, nil
+}
+
+// decodeResp v2 response is wrapped by {"code":0,"message":"success","data":{}}
+func (nacosClient *NacosClient) decodeResp(body []byte, v interface{}) error {
+	if nacosClient.ApiVersion != model.NACOS_V2 {
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(body, v)
+	}
+	v2Resp := model.NacosV2Resp{}
+	if err := json.Unmarshal(body, &v2Resp); err != nil {
+		return err
+	}
+	if v2Resp.Code != 0 {
+		return errors.New(fmt.Sprintf("code:%d, message:%s, data:%s", v2Resp.Code, v2Resp.Message, v2Resp.Data))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(v2Resp.Data, v)
+}
@@ -0,0 +1,622 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package discovery
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeNacos write v1 response as is, v2 response wrapped by {"code":0,"message":"success","data":{}}
+func writeNacos(w http.ResponseWriter, version model.NacosApiVersion, data interface{}) {
+	if version == model.NACOS_V2 {
+		data = map[string]interface{}{"code": 0, "message": "success", "data": data}
+	}
+	writeJson(w, http.StatusOK, data)
+}
+
+// requestPaths requests without query string, like "GET /nacos/v1/ns/instance/list"
+func requestPaths(requests []string) []string {
+	paths := []string{}
+	for _, request := range requests {
+		paths = append(paths, strings.SplitN(request, "?", 2)[0])
+	}
+	return paths
+}
+
+// requestQuery query string of request, like "GET /nacos/v1/ns/instance/list?serviceName=orders"
+func requestQuery(request string) url.Values {
+	u, _ := url.Parse(strings.SplitN(request, " ", 2)[1])
+	return u.Query()
+}
+
+func TestNacosGetPrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		version model.NacosApiVersion
+		want    string
+	}{
+		{prefix: "/nacos/v1/", version: model.NACOS_V1, want: "/nacos/v1/"},
+		{prefix: "/nacos/v1/", version: model.NACOS_V2, want: "/nacos/v2/"},
+		{prefix: "/nacos/v2/", version: model.NACOS_V1, want: "/nacos/v1/"},
+		{prefix: "/nacos/", version: model.NACOS_V2, want: "/nacos/v2/"},
+		{prefix: "/nacos", version: model.NACOS_V1, want: "/nacos/v1/"},
+		{prefix: "/gateway/nacos/v1", version: model.NACOS_V2, want: "/gateway/nacos/v2/"},
+		{prefix: "", version: model.NACOS_V2, want: "/nacos/v2/"},
+		{prefix: "/", version: model.NACOS_V1, want: "/v1/"},
+	}
+	for _, tt := range tests {
+		client := &NacosClient{Config: model.Discovery{Prefix: tt.prefix}}
+		if got := client.getPrefix(tt.version); got != tt.want {
+			t.Errorf("getPrefix of %s, %s got %s, want %s", tt.prefix, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestNacosApiVersion(t *testing.T) {
+	for _, version := range []model.NacosApiVersion{model.NACOS_V1, model.NACOS_V2} {
+		t.Run(string(version), func(t *testing.T) {
+			forms := []url.Values{}
+			server := newFakeServer(t, false, func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/nacos/" + string(version) + "/ns/service/list":
+					// v1 returns doms, v2 returns services
+					if version == model.NACOS_V2 {
+						writeNacos(w, version, map[string]interface{}{"count": 1, "services": []string{"orders"}})
+					} else {
+						writeNacos(w, version, map[string]interface{}{"count": 1, "doms": []string{"orders"}})
+					}
+				case "/nacos/" + string(version) + "/ns/instance/list":
+					writeNacos(w, version, map[string]interface{}{"hosts": []map[string]interface{}{
+						{"ip": "10.0.0.1", "port": 8080, "weight": 1, "serviceName": "DEFAULT_GROUP@@orders"},
+					}})
+				case "/nacos/" + string(version) + "/ns/instance":
+					_ = r.ParseForm()
+					forms = append(forms, r.PostForm)
+					writeNacos(w, version, "ok")
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			})
+			// prefix of v1 is replaced by configured version
+			client := &NacosClient{Config: model.Discovery{Type: model.NACOS_DISCOVERY, Host: server.URL,
+				Prefix: "/nacos/v1/", Weight: 10}, ApiVersion: version, Logger: go_logger.NewLogger()}
+
+			services, err := client.GetAllService(map[string]string{})
+			if err != nil {
+				t.Fatalf("GetAllService err:%s", err)
+			}
+			if len(services) != 1 || services[0].Name != "orders" {
+				t.Errorf("services got %#v", services)
+			}
+			instances, err := client.GetServiceAllInstances(model.GetInstanceVo{ServiceName: "orders",
+				ExtData: map[string]string{"clusters": "c1"}})
+			if err != nil {
+				t.Fatalf("GetServiceAllInstances err:%s", err)
+			}
+			if got := fmt.Sprint(sortedInstances(instances)); got != "[10.0.0.1:8080/1]" {
+				t.Errorf("instances got %s", got)
+			}
+			instances[0].Change = true
+			if err = client.ModifyRegistration(model.Registration{ServiceName: "orders"}, instances); err != nil {
+				t.Fatalf("ModifyRegistration err:%s", err)
+			}
+
+			requests := server.takeRequests()
+			prefix := "/nacos/" + string(version) + "/"
+			want := []string{"GET " + prefix + "ns/service/list", "GET " + prefix + "ns/instance/list",
+				"PUT " + prefix + "ns/instance"}
+			if fmt.Sprint(requestPaths(requests)) != fmt.Sprint(want) {
+				t.Fatalf("requests got %v, want %v", requests, want)
+			}
+			// v2 use clusterName instead of clusters
+			query := requestQuery(requests[1])
+			if version == model.NACOS_V2 && (query.Get("clusterName") != "c1" || query.Has("clusters")) ||
+				version == model.NACOS_V1 && query.Get("clusters") != "c1" {
+				t.Errorf("clusters of %s got %s", version, requests[1])
+			}
+			// v1 update instance by query string, v2 by form body
+			params := requestQuery(requests[2])
+			if version == model.NACOS_V2 {
+				params = forms[0]
+			}
+			if params.Get("ip") != "10.0.0.1" || params.Get("port") != "8080" || params.Get("enabled") != "false" ||
+				params.Get("serviceName") != "orders" {
+				t.Errorf("update instance of %s got %v", version, params)
+			}
+		})
+	}
+}
+
+func TestNacosV2ErrorCode(t *testing.T) {
+	server := newFakeServer(t, false, func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, map[string]interface{}{"code": 20004, "message": "service not found",
+			"data": nil})
+	})
+	client := &NacosClient{Config: model.Discovery{Type: model.NACOS_DISCOVERY, Host: server.URL,
+		Prefix: "/nacos/v2/"}, ApiVersion: model.NACOS_V2, Logger: go_logger.NewLogger()}
+	if _, err := client.GetServiceAllInstances(model.GetInstanceVo{ServiceName: "orders"}); err == nil {
+		t.Errorf("GetServiceAllInstances should fail with code of v2 response")
+	}
+	if _, err := client.GetAllService(map[string]string{}); err == nil {
+		t.Errorf("GetAllService should fail with code of v2 response")
+	}
+}
+
+func TestNacosSignature(t *testing.T) {
+	server := newFakeServer(t, false, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/ns/service/list"):
+			writeNacos(w, model.NACOS_V1, map[string]interface{}{"count": 0, "doms": []string{}})
+		case strings.HasSuffix(r.URL.Path, "/ns/instance/list"):
+			writeNacos(w, model.NACOS_V1, map[string]interface{}{"hosts": []interface{}{}})
+		default:
+			writeNacos(w, model.NACOS_V2, "ok")
+		}
+	})
+	client := &NacosClient{Config: model.Discovery{Type: model.NACOS_DISCOVERY, Host: server.URL,
+		Prefix: "/nacos/v1/", Config: map[string]string{"access-key": "ak", "secret-key": "sk"}},
+		ApiVersion: model.NACOS_V1, Logger: go_logger.NewLogger()}
+
+	tests := []struct {
+		name    string
+		version model.NacosApiVersion
+		call    func() error
+		// signed data without timestamp
+		want string
+	}{
+		{
+			name:    "without service name",
+			version: model.NACOS_V1,
+			call: func() error {
+				_, err := client.GetAllService(map[string]string{"groupName": "g1"})
+				return err
+			},
+			want: "",
+		},
+		{
+			name:    "service name with group name",
+			version: model.NACOS_V1,
+			call: func() error {
+				_, err := client.GetServiceAllInstances(model.GetInstanceVo{ServiceName: "orders",
+					ExtData: map[string]string{"groupName": "g1"}})
+				return err
+			},
+			want: "@@g1@@orders",
+		},
+		{
+			name:    "service name contains group name",
+			version: model.NACOS_V1,
+			call: func() error {
+				_, err := client.GetServiceAllInstances(model.GetInstanceVo{ServiceName: "g2@@orders",
+					ExtData: map[string]string{"groupName": "g1"}})
+				return err
+			},
+			want: "@@g2@@orders",
+		},
+		{
+			name:    "service name without group name",
+			version: model.NACOS_V1,
+			call: func() error {
+				_, err := client.GetServiceAllInstances(model.GetInstanceVo{ServiceName: "orders"})
+				return err
+			},
+			want: "@@orders",
+		},
+		{
+			// v2 service name and group name are in form body
+			name:    "service name of form body",
+			version: model.NACOS_V2,
+			call: func() error {
+				return client.ModifyRegistration(model.Registration{ServiceName: "orders"}, []model.Instance{
+					{Ip: "10.0.0.1", Port: 8080, Change: true, Ext: map[string]string{"groupName": "g1"}}})
+			},
+			want: "@@g1@@orders",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client.ApiVersion = tt.version
+			if err := tt.call(); err != nil {
+				t.Fatalf("call nacos err:%s", err)
+			}
+			requests := server.takeRequests()
+			if len(requests) != 1 {
+				t.Fatalf("requests got %v", requests)
+			}
+			query := requestQuery(requests[0])
+			data := query.Get("data")
+			timestamp := strings.SplitN(data, "@@", 2)[0]
+			if len(timestamp) != 13 || strings.TrimPrefix(data, timestamp) != tt.want {
+				t.Errorf("signed data got %s, want timestamp%s", data, tt.want)
+			}
+			mac := hmac.New(sha1.New, []byte("sk"))
+			mac.Write([]byte(data))
+			if signature := base64.StdEncoding.EncodeToString(mac.Sum(nil)); query.Get("signature") != signature ||
+				query.Get("ak") != "ak" {
+				t.Errorf("signature got %v, want %s", query, signature)
+			}
+		})
+	}
+}
+
+func TestNacosAccessToken(t *testing.T) {
+	logins, token, tokenTtl := 0, "", 18000
+	server := newFakeServer(t, false, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/nacos/v1/auth/login" {
+			_ = r.ParseForm()
+			if r.Method != "POST" || r.PostForm.Get("username") != "nacos" || r.PostForm.Get("password") != "secret" {
+				writeJson(w, http.StatusForbidden, "unknown user!")
+				return
+			}
+			logins++
+			token = fmt.Sprintf("token-%d", logins)
+			writeJson(w, http.StatusOK, map[string]interface{}{"accessToken": token, "tokenTtl": tokenTtl})
+			return
+		}
+		if r.URL.Query().Get("accessToken") != token {
+			writeJson(w, http.StatusForbidden, "token invalid!")
+			return
+		}
+		writeNacos(w, model.NACOS_V2, map[string]interface{}{"count": 0, "services": []string{}})
+	})
+	client := &NacosClient{Config: model.Discovery{Type: model.NACOS_DISCOVERY, Host: server.URL,
+		Prefix: "/nacos/v2/", Config: map[string]string{"username": "nacos", "password": "secret"}},
+		ApiVersion: model.NACOS_V2, Logger: go_logger.NewLogger()}
+
+	tests := []struct {
+		name     string
+		prepare  func()
+		requests []string
+	}{
+		{
+			name:     "login",
+			requests: []string{"POST /nacos/v1/auth/login", "GET /nacos/v2/ns/service/list"},
+		},
+		{
+			name:     "token cached",
+			requests: []string{"GET /nacos/v2/ns/service/list"},
+		},
+		{
+			// token revoked or nacos restarted, 403 then login again
+			name:    "login again after 403",
+			prepare: func() { token = "revoked" },
+			requests: []string{"GET /nacos/v2/ns/service/list", "POST /nacos/v1/auth/login",
+				"GET /nacos/v2/ns/service/list"},
+		},
+		{
+			name:    "token without ttl",
+			prepare: func() { token, tokenTtl = "revoked", 0 },
+			requests: []string{"GET /nacos/v2/ns/service/list", "POST /nacos/v1/auth/login",
+				"GET /nacos/v2/ns/service/list"},
+		},
+		{
+			// refresh before tokenTtl expires, without 403
+			name:     "refresh token",
+			requests: []string{"POST /nacos/v1/auth/login", "GET /nacos/v2/ns/service/list"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.prepare != nil {
+				server.mutex.Lock()
+				tt.prepare()
+				server.mutex.Unlock()
+			}
+			if _, err := client.GetAllService(map[string]string{}); err != nil {
+				t.Fatalf("GetAllService err:%s", err)
+			}
+			if got := requestPaths(server.takeRequests()); fmt.Sprint(got) != fmt.Sprint(tt.requests) {
+				t.Errorf("requests got %v, want %v", got, tt.requests)
+			}
+			if client.accessToken != token {
+				t.Errorf("accessToken got %s, want %s", client.accessToken, token)
+			}
+		})
+	}
+
+	// wrong password is not retried
+	client = &NacosClient{Config: model.Discovery{Type: model.NACOS_DISCOVERY, Host: server.URL,
+		Prefix: "/nacos/v2/", Config: map[string]string{"username": "nacos", "password": "wrong"}},
+		ApiVersion: model.NACOS_V2, Logger: go_logger.NewLogger()}
+	if _, err := client.GetAllService(map[string]string{}); err == nil {
+		t.Errorf("GetAllService with wrong password should fail")
+	}
+	if got := requestPaths(server.takeRequests()); fmt.Sprint(got) != "[POST /nacos/v1/auth/login]" {
+		t.Errorf("requests got %v", got)
+	}
+}
+
+func TestNacosServicePaging(t *testing.T) {
+	tests := []struct {
+		name        string
+		total       int
+		maxPageSize int
+		data        map[string]string
+		// pageNo/pageSize of requests, sorted
+		pages    []string
+		services int
+	}{
+		{name: "no service", total: 0, data: map[string]string{"pageSize": "10"}, pages: []string{"1/10"}},
+		{name: "single page", total: 10, data: map[string]string{"pageSize": "10"}, pages: []string{"1/10"},
+			services: 10},
+		{name: "default page size", total: 150, data: map[string]string{}, pages: []string{"1/100", "2/100"},
+			services: 150},
+		{name: "pages", total: 25, data: map[string]string{"pageSize": "10", "pageConcurrency": "1"},
+			pages: []string{"1/10", "2/10", "3/10"}, services: 25},
+		{
+			// server limits page size, rest pages are fetched by the limited size
+			name: "page size limited by server", total: 25, maxPageSize: 10,
+			data:  map[string]string{"pageSize": "20", "pageConcurrency": "4"},
+			pages: []string{"1/20", "2/10", "3/10"}, services: 25,
+		},
+		{name: "less than page size", total: 5, maxPageSize: 10, data: map[string]string{"pageSize": "100"},
+			pages: []string{"1/100"}, services: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t, false, func(w http.ResponseWriter, r *http.Request) {
+				pageNo, _ := strconv.Atoi(r.URL.Query().Get("pageNo"))
+				pageSize, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+				if tt.maxPageSize > 0 && pageSize > tt.maxPageSize {
+					pageSize = tt.maxPageSize
+				}
+				names := []string{}
+				for i := (pageNo - 1) * pageSize; i < pageNo*pageSize && i < tt.total; i++ {
+					names = append(names, fmt.Sprintf("s%03d", i))
+				}
+				writeNacos(w, model.NACOS_V1, map[string]interface{}{"count": tt.total, "doms": names})
+			})
+			client := &NacosClient{Config: model.Discovery{Type: model.NACOS_DISCOVERY, Host: server.URL,
+				Prefix: "/nacos/v1/"}, ApiVersion: model.NACOS_V1, Logger: go_logger.NewLogger()}
+
+			services, err := client.GetAllService(tt.data)
+			if err != nil {
+				t.Fatalf("GetAllService err:%s", err)
+			}
+			names := map[string]bool{}
+			for _, service := range services {
+				names[service.Name] = true
+			}
+			if len(services) != tt.services || len(names) != tt.services {
+				t.Errorf("services got %d, unique %d, want %d", len(services), len(names), tt.services)
+			}
+			pages := []string{}
+			for _, request := range server.takeRequests() {
+				query := requestQuery(request)
+				pages = append(pages, query.Get("pageNo")+"/"+query.Get("pageSize"))
+				if query.Has("pageConcurrency") {
+					t.Errorf("pageConcurrency is passed to nacos, %s", request)
+				}
+			}
+			sort.Strings(pages)
+			if fmt.Sprint(pages) != fmt.Sprint(tt.pages) {
+				t.Errorf("pages got %v, want %v", pages, tt.pages)
+			}
+		})
+	}
+}
+
+func TestNacosServicePagingShift(t *testing.T) {
+	// a service registered during paging shifts the rest pages, services seen twice are dropped
+	served := 0
+	server := newFakeServer(t, false, func(w http.ResponseWriter, r *http.Request) {
+		names := []string{}
+		for i := 0; i < 20; i++ {
+			names = append(names, fmt.Sprintf("s%03d", i))
+		}
+		if served > 0 {
+			names = append([]string{"new"}, names...)
+		}
+		served++
+		pageNo, _ := strconv.Atoi(r.URL.Query().Get("pageNo"))
+		writeNacos(w, model.NACOS_V1, map[string]interface{}{"count": len(names),
+			"doms": names[(pageNo-1)*10 : pageNo*10]})
+	})
+	client := &NacosClient{Config: model.Discovery{Type: model.NACOS_DISCOVERY, Host: server.URL,
+		Prefix: "/nacos/v1/"}, ApiVersion: model.NACOS_V1, Logger: go_logger.NewLogger()}
+
+	services, err := client.GetAllService(map[string]string{"pageSize": "10"})
+	if err != nil {
+		t.Fatalf("GetAllService err:%s", err)
+	}
+	names := map[string]bool{}
+	for _, service := range services {
+		if names[service.Name] {
+			t.Errorf("duplicate service %s", service.Name)
+		}
+		names[service.Name] = true
+	}
+	if len(services) != 19 || !names["s009"] || !names["s018"] {
+		t.Errorf("services got %d, %v", len(services), names)
+	}
+}
+
+func TestNacosInvalidPageSize(t *testing.T) {
+	client := &NacosClient{Config: model.Discovery{Type: model.NACOS_DISCOVERY, Host: "http://127.0.0.1:1",
+		Prefix: "/nacos/v1/"}, ApiVersion: model.NACOS_V1, Logger: go_logger.NewLogger()}
+	for _, pageSize := range []string{"0", "-1", "abc"} {
+		if _, err := client.GetAllService(map[string]string{"pageSize": pageSize}); err == nil {
+			t.Errorf("GetAllService with pageSize %s should fail", pageSize)
+		}
+	}
+}
+
+func TestNacosNamespacesAndGroups(t *testing.T) {
+	// namespaceId -> groupName -> service names
+	registry := map[string]map[string][]string{
+		"":    {"DEFAULT_GROUP": {"orders"}, "g1": {"users"}, "g2": {"carts"}},
+		"dev": {"DEFAULT_GROUP": {"payments"}, "g1": {"users"}},
+	}
+	server := newFakeServer(t, false, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch r.URL.Path {
+		case "/nacos/v1/console/namespaces":
+			writeJson(w, http.StatusOK, model.NacosNamespaceResp{Code: 200, Data: []model.NacosNamespace{
+				{Namespace: "", NamespaceShowName: "public"}, {Namespace: "dev", NamespaceShowName: "dev"}}})
+		case "/nacos/v1/ns/catalog/services":
+			// catalog api only exists in v1, response is not wrapped
+			resp := model.NacosCatalogServiceResp{ServiceList: []model.NacosCatalogService{}}
+			for groupName, names := range registry[query.Get("namespaceId")] {
+				for _, name := range names {
+					resp.ServiceList = append(resp.ServiceList, model.NacosCatalogService{Name: name,
+						GroupName: groupName})
+				}
+			}
+			resp.Count = len(resp.ServiceList)
+			writeJson(w, http.StatusOK, resp)
+		case "/nacos/v2/ns/service/list":
+			names := registry[query.Get("namespaceId")][query.Get("groupName")]
+			writeNacos(w, model.NACOS_V2, map[string]interface{}{"count": len(names), "services": names})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	client := &NacosClient{Config: model.Discovery{Type: model.NACOS_DISCOVERY, Host: server.URL,
+		Prefix: "/nacos/v2/"}, ApiVersion: model.NACOS_V2, Logger: go_logger.NewLogger()}
+
+	tests := []struct {
+		name     string
+		data     map[string]string
+		services []string
+		requests []string
+	}{
+		{
+			name:     "default namespace and group",
+			data:     map[string]string{},
+			services: []string{"/DEFAULT_GROUP/orders"},
+			requests: []string{"GET /nacos/v2/ns/service/list"},
+		},
+		{
+			name:     "namespaces and groups",
+			data:     map[string]string{"namespaceId": "dev, test", "groupName": "DEFAULT_GROUP, g1"},
+			services: []string{"dev/DEFAULT_GROUP/payments", "dev/g1/users"},
+			requests: []string{"GET /nacos/v2/ns/service/list", "GET /nacos/v2/ns/service/list",
+				"GET /nacos/v2/ns/service/list", "GET /nacos/v2/ns/service/list"},
+		},
+		{
+			name:     "all namespaces",
+			data:     map[string]string{"namespaceId": "*", "groupName": "g1"},
+			services: []string{"/g1/users", "dev/g1/users"},
+			requests: []string{"GET /nacos/v1/console/namespaces", "GET /nacos/v2/ns/service/list",
+				"GET /nacos/v2/ns/service/list"},
+		},
+		{
+			name:     "group pattern",
+			data:     map[string]string{"groupName": "g?"},
+			services: []string{"/g1/users", "/g2/carts"},
+			requests: []string{"GET /nacos/v1/ns/catalog/services"},
+		},
+		{
+			name: "all namespaces and groups",
+			data: map[string]string{"namespaceId": "*", "groupName": "*"},
+			services: []string{"/DEFAULT_GROUP/orders", "/g1/users", "/g2/carts", "dev/DEFAULT_GROUP/payments",
+				"dev/g1/users"},
+			requests: []string{"GET /nacos/v1/console/namespaces", "GET /nacos/v1/ns/catalog/services",
+				"GET /nacos/v1/ns/catalog/services"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			services, err := client.GetAllService(tt.data)
+			if err != nil {
+				t.Fatalf("GetAllService err:%s", err)
+			}
+			got := []string{}
+			for _, service := range services {
+				got = append(got, service.Ext["namespaceId"]+"/"+service.Ext["groupName"]+"/"+service.Name)
+			}
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.services) {
+				t.Errorf("services got %v, want %v", got, tt.services)
+			}
+			if paths := requestPaths(server.takeRequests()); fmt.Sprint(paths) != fmt.Sprint(tt.requests) {
+				t.Errorf("requests got %v, want %v", paths, tt.requests)
+			}
+		})
+	}
+}
+
+func TestNacosInstancePolicy(t *testing.T) {
+	server := newFakeServer(t, false, func(w http.ResponseWriter, r *http.Request) {
+		// enabled and healthy are true if absent
+		writeNacos(w, model.NACOS_V1, map[string]interface{}{"hosts": []map[string]interface{}{
+			{"ip": "10.0.0.1", "port": 8080, "weight": 1},
+			{"ip": "10.0.0.2", "port": 8080, "weight": 1, "healthy": false},
+			{"ip": "10.0.0.3", "port": 8080, "weight": 1, "enabled": false},
+			{"ip": "10.0.0.4", "port": 8080, "weight": 1, "enabled": false, "healthy": false},
+		}})
+	})
+	client := &NacosClient{Config: model.Discovery{Type: model.NACOS_DISCOVERY, Host: server.URL,
+		Prefix: "/nacos/v1/"}, ApiVersion: model.NACOS_V1, Logger: go_logger.NewLogger()}
+
+	tests := []struct {
+		name      string
+		unhealthy string
+		disabled  string
+		want      string
+	}{
+		{name: "default", want: "[10.0.0.1:8080/1 10.0.0.2:8080/1]"},
+		{name: "drop unhealthy", unhealthy: "drop", want: "[10.0.0.1:8080/1]"},
+		{name: "zero weight unhealthy", unhealthy: "zero-weight", want: "[10.0.0.1:8080/1 10.0.0.2:8080/0]"},
+		{name: "keep disabled", disabled: "keep",
+			want: "[10.0.0.1:8080/1 10.0.0.2:8080/1 10.0.0.3:8080/1 10.0.0.4:8080/1]"},
+		{name: "keep disabled and zero weight unhealthy", unhealthy: "zero-weight", disabled: "keep",
+			want: "[10.0.0.1:8080/1 10.0.0.2:8080/0 10.0.0.3:8080/1 10.0.0.4:8080/0]"},
+		// disabled and unhealthy, the stricter policy wins
+		{name: "zero weight disabled and drop unhealthy", unhealthy: "drop", disabled: "zero-weight",
+			want: "[10.0.0.1:8080/1 10.0.0.3:8080/0]"},
+		{name: "zero weight disabled and keep unhealthy", unhealthy: "keep", disabled: "Zero-Weight",
+			want: "[10.0.0.1:8080/1 10.0.0.2:8080/1 10.0.0.3:8080/0 10.0.0.4:8080/0]"},
+		{name: "invalid policy", unhealthy: "remove", disabled: "remove", want: "[10.0.0.1:8080/1 10.0.0.2:8080/1]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instances, err := client.GetServiceAllInstances(model.GetInstanceVo{ServiceName: "orders",
+				ExtData: map[string]string{"unhealthy-policy": tt.unhealthy, "disabled-policy": tt.disabled,
+					"template": "default", "clusters": "c1"}})
+			if err != nil {
+				t.Fatalf("GetServiceAllInstances err:%s", err)
+			}
+			if got := fmt.Sprint(sortedInstances(instances)); got != tt.want {
+				t.Errorf("instances got %s, want %s", got, tt.want)
+			}
+			// syncer params are neither passed to nacos nor kept in ext, ext is sent back to nacos
+			query := requestQuery(server.takeRequests()[0])
+			for _, key := range []string{"unhealthy-policy", "disabled-policy", "template"} {
+				if query.Has(key) {
+					t.Errorf("%s is passed to nacos", key)
+				}
+				for _, instance := range instances {
+					if _, ok := instance.Ext[key]; ok {
+						t.Errorf("%s is kept in ext of %s", key, instance.Ip)
+					}
+				}
+			}
+			if query.Get("clusters") != "c1" || instances[0].Ext["clusters"] != "c1" {
+				t.Errorf("clusters got %v, ext %v", query, instances[0].Ext)
+			}
+		})
+	}
+}
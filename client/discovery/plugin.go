@@ -0,0 +1,61 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package discovery
+
+import (
+	"github.com/anjia0532/apisix-discovery-syncer/client/plugin"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+)
+
+// PluginClient discovery implemented by external plugin executable, see model.PluginRequest
+type PluginClient struct {
+	Config model.Discovery
+	Plugin model.Plugin
+	Logger *go_logger.Logger
+}
+
+func (pluginClient *PluginClient) GetAllService(data map[string]string) ([]model.Service, error) {
+	services := []model.Service{}
+	err := plugin.Call(pluginClient.Plugin, "GetAllService", pluginClient.Config,
+		map[string]interface{}{"data": data}, &services)
+	if err != nil {
+		pluginClient.Logger.Errorf("fetch plugin %s service error, err:%s", pluginClient.Config.Type, err)
+		return nil, err
+	}
+	return services, nil
+}
+
+func (pluginClient *PluginClient) GetServiceAllInstances(vo model.GetInstanceVo) ([]model.Instance, error) {
+	instances := []model.Instance{}
+	err := plugin.Call(pluginClient.Plugin, "GetServiceAllInstances", pluginClient.Config, vo, &instances)
+	if err != nil {
+		pluginClient.Logger.Errorf("fetch plugin %s service instance error, vo:%#v, err:%s",
+			pluginClient.Config.Type, vo, err)
+		return nil, err
+	}
+	pluginClient.Logger.Debugf("fetch plugin %s service:%s,instances:%#v", pluginClient.Config.Type,
+		vo.ServiceName, instances)
+	return instances, nil
+}
+
+func (pluginClient *PluginClient) ModifyRegistration(registration model.Registration, instances []model.Instance) error {
+	err := plugin.Call(pluginClient.Plugin, "ModifyRegistration", pluginClient.Config,
+		map[string]interface{}{"registration": registration, "instances": instances}, nil)
+	if err != nil {
+		pluginClient.Logger.Errorf("update plugin %s instance error, registration:%#v, err:%s",
+			pluginClient.Config.Type, registration, err)
+	}
+	return err
+}
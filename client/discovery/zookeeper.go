@@ -0,0 +1,314 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	"github.com/go-zookeeper/zk"
+	go_logger "github.com/phachon/go-logger"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ZookeeperClient struct {
+	Config model.Discovery
+	Logger *go_logger.Logger
+}
+
+var defaultZookeeperRootPath = map[model.ZookeeperLayout]string{
+	model.ZK_DUBBO_LAYOUT:        "/dubbo",
+	model.ZK_DUBBO3_LAYOUT:       "/services",
+	model.ZK_SPRING_CLOUD_LAYOUT: "/services",
+}
+
+var (
+	// zk connection is kept alive between config reload, host and digest credentials -> conn
+	zkConnMap   = map[string]*zk.Conn{}
+	zkConnMutex sync.Mutex
+)
+
+func (zookeeperClient *ZookeeperClient) GetAllService(data map[string]string) ([]model.Service, error) {
+	layout, rootPath := zookeeperClient.getLayout(data)
+	conn, err := zookeeperClient.getConn()
+	if err != nil {
+		zookeeperClient.Logger.Errorf("connect zookeeper error, host:%s, err:%s", zookeeperClient.Config.Host, err)
+		return nil, errors.New("fetch zookeeper service error")
+	}
+	names, _, err := conn.Children(rootPath)
+	if err == zk.ErrNoNode {
+		return []model.Service{}, nil
+	} else if err != nil {
+		zookeeperClient.Logger.Errorf("fetch zookeeper service error, path:%s, err:%s", rootPath, err)
+		return nil, errors.New("fetch zookeeper service error")
+	}
+	zookeeperClient.Logger.Debugf("fetch zookeeper service, path:%s, names:%#v", rootPath, names)
+
+	services := []model.Service{}
+	for _, name := range names {
+		instances, err := zookeeperClient.fetchInstances(conn, layout, rootPath, name, data)
+		if err != nil {
+			zookeeperClient.Logger.Errorf("fetch zookeeper service instance error, service:%s, err:%s", name, err)
+			return nil, errors.New("fetch zookeeper service instance error")
+		}
+		if len(instances) == 0 {
+			continue
+		}
+		services = append(services, model.Service{Name: name, Instances: instances})
+	}
+	return services, nil
+}
+
+func (zookeeperClient *ZookeeperClient) GetServiceAllInstances(vo model.GetInstanceVo) ([]model.Instance, error) {
+	layout, rootPath := zookeeperClient.getLayout(vo.ExtData)
+	conn, err := zookeeperClient.getConn()
+	if err != nil {
+		zookeeperClient.Logger.Errorf("connect zookeeper error, host:%s, err:%s", zookeeperClient.Config.Host, err)
+		return nil, errors.New("fetch zookeeper service instance error")
+	}
+	instances, err := zookeeperClient.fetchInstances(conn, layout, rootPath, vo.ServiceName, vo.ExtData)
+	if err != nil {
+		zookeeperClient.Logger.Errorf("fetch zookeeper service instance error, service:%s, err:%s",
+			vo.ServiceName, err)
+		return nil, errors.New("fetch zookeeper service instance error")
+	}
+	return instances, nil
+}
+
+func (zookeeperClient *ZookeeperClient) ModifyRegistration(model.Registration, []model.Instance) error {
+	return errors.New("zookeeper discovery does not support modify registration")
+}
+
+func (zookeeperClient *ZookeeperClient) getLayout(data map[string]string) (model.ZookeeperLayout, string) {
+	layout := model.ZookeeperLayout(data["layout"])
+	if len(layout) == 0 {
+		layout = model.ZookeeperLayout(zookeeperClient.Config.Config["layout"])
+	}
+	if _, ok := defaultZookeeperRootPath[layout]; !ok {
+		layout = model.ZK_DUBBO_LAYOUT
+	}
+	rootPath := strings.TrimSuffix(zookeeperClient.Config.Prefix, "/")
+	if len(rootPath) == 0 {
+		rootPath = defaultZookeeperRootPath[layout]
+	}
+	return layout, rootPath
+}
+
+func (zookeeperClient *ZookeeperClient) fetchInstances(conn *zk.Conn, layout model.ZookeeperLayout,
+	rootPath string, name string, data map[string]string) ([]model.Instance, error) {
+	protocol, ok := data["protocol"]
+	if !ok || len(protocol) == 0 {
+		protocol = "rest"
+	}
+	protocols := strings.Split(protocol, ",")
+
+	if layout == model.ZK_DUBBO_LAYOUT {
+		providersPath := rootPath + "/" + name + "/providers"
+		providers, _, err := conn.Children(providersPath)
+		if err == zk.ErrNoNode {
+			return []model.Instance{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+		instances := []model.Instance{}
+		for _, provider := range providers {
+			instance, ok := zookeeperClient.convertDubboProvider(provider, protocols, data)
+			if ok {
+				instances = append(instances, instance)
+			}
+		}
+		return instances, nil
+	}
+
+	servicePath := rootPath + "/" + name
+	ids, _, err := conn.Children(servicePath)
+	if err == zk.ErrNoNode {
+		return []model.Instance{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	instances := []model.Instance{}
+	for _, id := range ids {
+		content, _, err := conn.Get(servicePath + "/" + id)
+		if err == zk.ErrNoNode {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		curatorInstance := model.CuratorServiceInstance{}
+		if err = json.Unmarshal(content, &curatorInstance); err != nil {
+			zookeeperClient.Logger.Warningf("skip zookeeper node:%s, content:%s, err:%s", servicePath+"/"+id,
+				content, err)
+			continue
+		}
+		instance, ok := zookeeperClient.convertCuratorInstance(layout, curatorInstance, protocols)
+		if ok {
+			instances = append(instances, instance)
+		}
+	}
+	return instances, nil
+}
+
+// convertDubboProvider provider is url encoded, like
+// rest%3A%2F%2F10.0.0.1%3A8080%2Fcom.foo.DemoService%3Fapplication%3Ddemo%26weight%3D100
+func (zookeeperClient *ZookeeperClient) convertDubboProvider(provider string, protocols []string,
+	data map[string]string) (model.Instance, bool) {
+	rawUrl, err := url.QueryUnescape(provider)
+	if err != nil {
+		zookeeperClient.Logger.Warningf("skip dubbo provider:%s, err:%s", provider, err)
+		return model.Instance{}, false
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		zookeeperClient.Logger.Warningf("skip dubbo provider:%s, err:%s", rawUrl, err)
+		return model.Instance{}, false
+	}
+	if !slices.Contains(protocols, u.Scheme) {
+		return model.Instance{}, false
+	}
+	params := u.Query()
+	if params.Get("enabled") == "false" || params.Get("disabled") == "true" {
+		return model.Instance{}, false
+	}
+	// dubbo group and version filter
+	for _, key := range []string{"group", "version"} {
+		if v, ok := data[key]; ok && len(v) > 0 && v != params.Get(key) {
+			return model.Instance{}, false
+		}
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		zookeeperClient.Logger.Warningf("skip dubbo provider:%s, err:%s", rawUrl, err)
+		return model.Instance{}, false
+	}
+	weight := zookeeperClient.Config.Weight
+	if w, err := strconv.ParseFloat(params.Get("weight"), 32); err == nil {
+		weight = float32(w)
+	}
+	metadata := map[string]string{"protocol": u.Scheme}
+	for k := range params {
+		if k == "methods" {
+			continue
+		}
+		metadata[k] = params.Get(k)
+	}
+	return model.Instance{Ip: u.Hostname(), Port: port, Weight: weight, Metadata: metadata,
+		Ext: map[string]string{"interface": strings.TrimPrefix(u.Path, "/")}}, true
+}
+
+func (zookeeperClient *ZookeeperClient) convertCuratorInstance(layout model.ZookeeperLayout,
+	curatorInstance model.CuratorServiceInstance, protocols []string) (model.Instance, bool) {
+	if curatorInstance.Enabled != nil && !*curatorInstance.Enabled {
+		return model.Instance{}, false
+	}
+	metadata := curatorInstance.Payload.Metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	port := curatorInstance.Port
+	if layout == model.ZK_DUBBO3_LAYOUT {
+		// [{"port":20880,"protocol":"dubbo"},{"port":8080,"protocol":"rest"}]
+		endpoints := []model.DubboEndpoint{}
+		if v, ok := metadata["dubbo.endpoints"]; ok {
+			_ = json.Unmarshal([]byte(v), &endpoints)
+		}
+		port = 0
+		for _, endpoint := range endpoints {
+			if slices.Contains(protocols, endpoint.Protocol) {
+				port = endpoint.Port
+				metadata["protocol"] = endpoint.Protocol
+				break
+			}
+		}
+		if port == 0 && slices.Contains(protocols, "dubbo") {
+			port = curatorInstance.Port
+			metadata["protocol"] = "dubbo"
+		}
+		if port == 0 {
+			return model.Instance{}, false
+		}
+	}
+	weight := zookeeperClient.Config.Weight
+	if w, err := strconv.ParseFloat(metadata["weight"], 32); err == nil {
+		weight = float32(w)
+	}
+	return model.Instance{Ip: curatorInstance.Address, Port: port, Weight: weight, Metadata: metadata,
+		Ext: map[string]string{"id": curatorInstance.Id}}, true
+}
+
+func (zookeeperClient *ZookeeperClient) getConn() (*zk.Conn, error) {
+	zkConnMutex.Lock()
+	defer zkConnMutex.Unlock()
+	host := zookeeperClient.Config.Host
+	key := zkConnKey(zookeeperClient.Config)
+	// zk.Conn reconnects by itself
+	if conn, ok := zkConnMap[key]; ok {
+		return conn, nil
+	}
+	conn, _, err := zk.Connect(strings.Split(host, ","), 10*time.Second,
+		zk.WithLogger(&zkLogger{Logger: zookeeperClient.Logger}))
+	if err != nil {
+		return nil, err
+	}
+	if username, ok := zookeeperClient.Config.Config["username"]; ok && len(username) > 0 {
+		auth := username + ":" + zookeeperClient.Config.Config["password"]
+		if err = conn.AddAuth("digest", []byte(auth)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	zkConnMap[key] = conn
+	return conn, nil
+}
+
+// zkConnKey connections with different digest credentials have different acl identities
+func zkConnKey(config model.Discovery) string {
+	username := config.Config["username"]
+	if len(username) == 0 {
+		return config.Host
+	}
+	return config.Host + "|" + username + ":" + config.Config["password"]
+}
+
+// ReleaseZookeeperConns close connections not used by discoveries, all connections if discoveries is empty
+func ReleaseZookeeperConns(discoveries map[string]model.Discovery) {
+	zkConnMutex.Lock()
+	defer zkConnMutex.Unlock()
+	used := map[string]bool{}
+	for _, discovery := range discoveries {
+		if discovery.Type == model.ZK_DISCOVERY {
+			used[zkConnKey(discovery)] = true
+		}
+	}
+	for key, conn := range zkConnMap {
+		if used[key] {
+			continue
+		}
+		conn.Close()
+		delete(zkConnMap, key)
+	}
+}
+
+type zkLogger struct {
+	Logger *go_logger.Logger
+}
+
+func (l *zkLogger) Printf(format string, args ...interface{}) {
+	l.Logger.Debugf(format, args...)
+}
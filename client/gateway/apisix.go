@@ -162,17 +162,18 @@ func (apisixClient *ApisixClient) SyncInstances(name string, tpl string, discove
 		}
 		tmpl, err := template.New("UpstreamTemplate").Parse(tpl)
 		if err != nil {
-			apisixClient.Logger.Errorf("parse apisix UpstreamTemplate failed,tmpl:%s", tmpl)
+			apisixClient.Logger.Errorf("parse apisix UpstreamTemplate failed,tmpl:%s", tpl)
 			return err
 		}
 		var buf bytes.Buffer
 		data := struct {
-			Name  string
-			Nodes string
-		}{Name: name, Nodes: string(nodesJson)}
+			Name   string
+			Nodes  string
+			Scheme string
+		}{Name: name, Nodes: string(nodesJson), Scheme: getScheme(discoveryInstances)}
 		err = tmpl.Execute(&buf, data)
 		if err != nil {
-			apisixClient.Logger.Errorf("parse apisix UpstreamTemplate failed,tmpl:%s,data:%#v", tmpl, data)
+			apisixClient.Logger.Errorf("parse apisix UpstreamTemplate failed,tmpl:%s,data:%#v", tpl, data)
 		} else {
 			body = buf.String()
 		}
@@ -254,9 +255,13 @@ func (apisixClient *ApisixClient) MigrateTo(gateway GatewayClient) error {
 	// 拉取 origin 网关配置
 	// 拉取 目标 网关配置
 	// 仅创建/创建或更新
+	// kong 目标网关需要转换, 见 migrateToKong
+	if targetKongClient, ok := gateway.(*KongClient); ok {
+		return apisixClient.migrateToKong(targetKongClient)
+	}
 	targetApisixClient, ok := gateway.(*ApisixClient)
 	if !ok {
-		return errors.New("Target GatewayClient is not ApisixClient")
+		return errors.New("Target GatewayClient is not ApisixClient or KongClient")
 	}
 
 	for uri, field := range model.ApisixUris {
@@ -355,7 +360,7 @@ func (apisixClient *ApisixClient) httpDoRaw(uri string, method string, body io.R
 func (apisixClient *ApisixClient) httpDo(uri string, method string, body io.Reader) (model.ANode, string, error) {
 	respBody, url, err := apisixClient.httpDoRaw(uri, method, body)
 	resp := model.ANode{}
-	err = resp.UnmarshalJSON(respBody, apisixClient.ApiVersion)
+	err = resp.UnmarshalVersionedJSON(respBody, apisixClient.ApiVersion)
 	if err != nil {
 		apisixClient.Logger.Errorf("apisix respone decode error,%s,%s", url, err.Error())
 		return model.ANode{}, url, err
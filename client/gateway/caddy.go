@@ -0,0 +1,339 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// CaddyClient upstream is the reverse_proxy handler with @id of upstream name, updated by caddy admin api
+type CaddyClient struct {
+	Config model.Gateway
+	Logger *go_logger.Logger
+	mutex  sync.Mutex
+}
+
+// DefaultCaddyRouteTemplate route appended to routes-path when the handler @id not found
+var DefaultCaddyRouteTemplate = `
+{
+    "match": [{"path": ["/{{.Name}}/*"]}],
+    "handle": [
+        {"handler": "rewrite", "strip_path_prefix": "/{{.Name}}"},
+        {
+            "@id": "{{.Name}}",
+            "handler": "reverse_proxy",
+            {{- if eq .Scheme "https"}}
+            "transport": {"protocol": "http", "tls": {}},
+            {{- end}}
+            "load_balancing": {"selection_policy": {"policy": "weighted_round_robin", "weights": {{.Weights}}}},
+            "upstreams": {{.Upstreams}}
+        }
+    ]
+}
+`
+
+const caddyWeightedRoundRobin = "weighted_round_robin"
+
+func (caddyClient *CaddyClient) GetServiceAllInstances(upstreamName string) ([]model.Instance, error) {
+	instances := []model.Instance{}
+	handler, err := caddyClient.getHandler(upstreamName)
+	if err != nil || handler == nil {
+		return instances, err
+	}
+	weights := caddyWeights(handler)
+	for i, upstream := range handler.Upstreams {
+		host, portStr, err := net.SplitHostPort(upstream.Dial())
+		if err != nil {
+			continue
+		}
+		port, _ := strconv.Atoi(portStr)
+		// caddy weight is 1 if not weighted round robin
+		weight := float32(1)
+		if i < len(weights) {
+			weight = float32(weights[i])
+		}
+		instances = append(instances, model.Instance{Ip: host, Port: port, Weight: weight})
+	}
+	return instances, nil
+}
+
+func (caddyClient *CaddyClient) SyncInstances(name string, tpl string, discoveryInstances []model.Instance,
+	diffIns []model.Instance) error {
+	caddyClient.mutex.Lock()
+	defer caddyClient.mutex.Unlock()
+
+	// zero weight instances are not served
+	dials := []string{}
+	weightMap := map[string]int{}
+	for _, instance := range discoveryInstances {
+		dial := net.JoinHostPort(instance.Ip, strconv.Itoa(instance.Port))
+		// caddy weight is integer and at least 1
+		weightMap[dial] = max(int(math.Round(float64(instance.Weight))), 1)
+		if instance.Weight > 0 {
+			dials = append(dials, dial)
+		}
+	}
+	// stable order, weights are matched by index of upstreams
+	sort.Strings(dials)
+	weights := []int{}
+	for _, dial := range dials {
+		weights = append(weights, weightMap[dial])
+	}
+
+	handler, err := caddyClient.getHandler(name)
+	if err != nil {
+		return err
+	}
+	if handler == nil {
+		return caddyClient.createRoute(name, tpl, mergeCaddyUpstreams(nil, dials), weights, discoveryInstances)
+	}
+	upstreams := mergeCaddyUpstreams(handler.Upstreams, dials)
+
+	weighted := handler.LoadBalancing != nil && handler.LoadBalancing.SelectionPolicy != nil &&
+		handler.LoadBalancing.SelectionPolicy.Policy == caddyWeightedRoundRobin
+	sameUpstreams := len(handler.Upstreams) == 0 && len(upstreams) == 0 ||
+		reflect.DeepEqual(handler.Upstreams, upstreams)
+	if sameUpstreams && (!weighted || slices.Equal(caddyWeights(handler), weights)) {
+		return nil
+	}
+	// PATCH replaces existing value, PUT creates missing value
+	method := "PATCH"
+	if handler.Upstreams == nil {
+		method = "PUT"
+	}
+	if _, err = caddyClient.httpDo(method, "/id/"+url.PathEscape(name)+"/upstreams", upstreams, nil); err != nil {
+		return err
+	}
+	if weighted {
+		method = "PATCH"
+		if handler.LoadBalancing.SelectionPolicy.Weights == nil {
+			method = "PUT"
+		}
+		_, err = caddyClient.httpDo(method, "/id/"+url.PathEscape(name)+"/load_balancing/selection_policy/weights",
+			weights, nil)
+		if err != nil {
+			return err
+		}
+	}
+	caddyClient.Logger.Debugf("update caddy reverse_proxy: %s, upstreams:%d", name, len(upstreams))
+	return nil
+}
+
+// mergeCaddyUpstreams upstreams of dials, existing upstreams of the same dial are kept with other fields like
+// max_requests, new upstreams copy other fields of the first existing upstream
+func mergeCaddyUpstreams(existing []model.CaddyUpstream, dials []string) []model.CaddyUpstream {
+	dialMap := map[string]model.CaddyUpstream{}
+	var base model.CaddyUpstream
+	for _, upstream := range existing {
+		if dial := upstream.Dial(); len(dial) > 0 {
+			dialMap[dial] = upstream
+			if base == nil {
+				base = upstream
+			}
+		}
+	}
+	upstreams := []model.CaddyUpstream{}
+	for _, dial := range dials {
+		upstream, ok := dialMap[dial]
+		if !ok {
+			upstream = model.CaddyUpstream{}
+			for k, v := range base {
+				upstream[k] = v
+			}
+			upstream["dial"] = dial
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams
+}
+
+// createRoute render route from template and append it to routes-path
+func (caddyClient *CaddyClient) createRoute(name string, tpl string, upstreams []model.CaddyUpstream,
+	weights []int, discoveryInstances []model.Instance) error {
+	if len(tpl) == 0 {
+		tpl = caddyClient.Config.Config["template"]
+	}
+	if len(tpl) == 0 {
+		tpl = DefaultCaddyRouteTemplate
+	}
+	tmpl, err := template.New("CaddyRouteTemplate").Parse(tpl)
+	if err != nil {
+		caddyClient.Logger.Errorf("parse caddy RouteTemplate failed, tmpl:%s, err:%s", tpl, err)
+		return err
+	}
+	upstreamsJson, _ := json.Marshal(upstreams)
+	weightsJson, _ := json.Marshal(weights)
+	var buf bytes.Buffer
+	data := struct {
+		Name      string
+		Upstreams string
+		Weights   string
+		Scheme    string
+	}{Name: name, Upstreams: string(upstreamsJson), Weights: string(weightsJson),
+		Scheme: getScheme(discoveryInstances)}
+	if err = tmpl.Execute(&buf, data); err != nil {
+		caddyClient.Logger.Errorf("parse caddy RouteTemplate failed, tmpl:%s, data:%#v, err:%s", tpl, data, err)
+		return err
+	}
+	var route interface{}
+	if err = json.Unmarshal(buf.Bytes(), &route); err != nil {
+		caddyClient.Logger.Errorf("invalid caddy route, route:%s, err:%s", buf.String(), err)
+		return err
+	}
+	// without @id the route would be appended again on next sync
+	if !caddyHasId(route, name) {
+		return errors.New(fmt.Sprintf("caddy route template must have a reverse_proxy handler with @id:%s", name))
+	}
+	routesPath, ok := caddyClient.Config.Config["routes-path"]
+	if !ok || len(routesPath) == 0 {
+		routesPath = "/config/apps/http/servers/srv0/routes"
+	}
+	if _, err = caddyClient.httpDo("POST", routesPath, route, nil); err != nil {
+		return err
+	}
+	caddyClient.Logger.Debugf("create caddy route: %s, upstreams:%d", name, len(upstreams))
+	return nil
+}
+
+// getHandler reverse_proxy handler by @id, nil if not found
+func (caddyClient *CaddyClient) getHandler(name string) (*model.CaddyReverseProxy, error) {
+	handler := &model.CaddyReverseProxy{}
+	statusCode, err := caddyClient.httpDo("GET", "/id/"+url.PathEscape(name), nil, handler)
+	if statusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if handler.Handler != "reverse_proxy" {
+		return nil, errors.New(fmt.Sprintf("caddy @id:%s is not a reverse_proxy handler", name))
+	}
+	return handler, nil
+}
+
+func caddyWeights(handler *model.CaddyReverseProxy) []int {
+	if handler.LoadBalancing == nil || handler.LoadBalancing.SelectionPolicy == nil ||
+		handler.LoadBalancing.SelectionPolicy.Policy != caddyWeightedRoundRobin {
+		return nil
+	}
+	return handler.LoadBalancing.SelectionPolicy.Weights
+}
+
+func caddyHasId(value interface{}, id string) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if v["@id"] == id {
+			return true
+		}
+		for _, item := range v {
+			if caddyHasId(item, id) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if caddyHasId(item, id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// httpDo call caddy admin api, decode json response into result if not nil
+func (caddyClient *CaddyClient) httpDo(method string, path string, body interface{},
+	result interface{}) (int, error) {
+	uri := caddyClient.Config.AdminUrl + path
+	var reqBody io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reqBody = bytes.NewReader(content)
+	}
+	hc := &http.Client{Timeout: 30 * time.Second}
+	req, _ := http.NewRequest(method, uri, reqBody)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := hc.Do(req)
+	if err != nil {
+		caddyClient.Logger.Errorf("call caddy admin api error, uri:%s, err:%s", uri, err)
+		return 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	respRawByte, err := io.ReadAll(resp.Body)
+	if err != nil {
+		caddyClient.Logger.Errorf("call caddy admin api error, uri:%s, err:%s", uri, err)
+		return resp.StatusCode, err
+	}
+	caddyClient.Logger.Debugf("call caddy admin api uri:%s,method:%s,status:%d,resp:%s", uri, method,
+		resp.StatusCode, respRawByte)
+	if resp.StatusCode >= 300 {
+		if resp.StatusCode != http.StatusNotFound {
+			caddyClient.Logger.Errorf("call caddy admin api error, uri:%s, method:%s, status:%d, resp:%s",
+				uri, method, resp.StatusCode, respRawByte)
+		}
+		return resp.StatusCode, errors.New(fmt.Sprintf("call caddy admin api error, uri:%s, status:%d, resp:%s",
+			uri, resp.StatusCode, respRawByte))
+	}
+	if result != nil && len(respRawByte) > 0 {
+		if err = json.Unmarshal(respRawByte, result); err != nil {
+			caddyClient.Logger.Errorf("decode caddy admin api json error, uri:%s, err:%s", uri, err)
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// FetchAdminApiToFile dump full json config of caddy
+func (caddyClient *CaddyClient) FetchAdminApiToFile() (string, string, error) {
+	var config interface{}
+	if _, err := caddyClient.httpDo("GET", "/config/", nil, &config); err != nil {
+		return "", "", err
+	}
+	content, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", "", err
+	}
+	caddyFilePath := filepath.Join(os.TempDir(), "caddy.json")
+	if err = os.WriteFile(caddyFilePath, content, 0644); err != nil {
+		caddyClient.Logger.Errorf("failed to write caddy.json, err:%s", err)
+		return "", "", err
+	}
+	return string(content), caddyFilePath, nil
+}
+
+func (caddyClient *CaddyClient) MigrateTo(GatewayClient) error {
+	return errors.New("caddy gateway does not support migrate")
+}
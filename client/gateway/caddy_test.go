@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	"testing"
+)
+
+func TestMergeCaddyUpstreams(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		dials    []string
+		want     string
+	}{
+		{
+			name:  "no existing upstreams",
+			dials: []string{"10.0.0.1:80", "10.0.0.2:80"},
+			want:  `[{"dial":"10.0.0.1:80"},{"dial":"10.0.0.2:80"}]`,
+		},
+		{
+			name:     "keep other fields",
+			existing: `[{"dial":"10.0.0.2:80","max_requests":10},{"dial":"10.0.0.3:80","max_requests":20}]`,
+			dials:    []string{"10.0.0.2:80"},
+			want:     `[{"dial":"10.0.0.2:80","max_requests":10}]`,
+		},
+		{
+			name:     "new upstream copies fields of the first upstream",
+			existing: `[{"lookup_srv":"orders.service"},{"dial":"10.0.0.2:80","max_requests":10}]`,
+			dials:    []string{"10.0.0.1:80", "10.0.0.2:80"},
+			want:     `[{"dial":"10.0.0.1:80","max_requests":10},{"dial":"10.0.0.2:80","max_requests":10}]`,
+		},
+		{
+			name:     "no dials",
+			existing: `[{"dial":"10.0.0.2:80"}]`,
+			want:     `[]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var existing []model.CaddyUpstream
+			if len(tt.existing) > 0 {
+				if err := json.Unmarshal([]byte(tt.existing), &existing); err != nil {
+					t.Fatalf("invalid existing upstreams, err:%s", err)
+				}
+			}
+			got, _ := json.Marshal(mergeCaddyUpstreams(existing, tt.dials))
+			if string(got) != tt.want {
+				t.Errorf("mergeCaddyUpstreams got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
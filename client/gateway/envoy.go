@@ -0,0 +1,346 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	resourcev3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	go_logger "github.com/phachon/go-logger"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/template"
+)
+
+// EnvoyClient serve clusters and endpoints by xDS(CDS/EDS, ADS), upstream name is the cluster name
+type EnvoyClient struct {
+	Config model.Gateway
+	Logger *go_logger.Logger
+	server *envoyServer
+	mutex  sync.Mutex
+}
+
+// envoyServer xDS server of a listen address, kept after config reload if the listen is still used
+type envoyServer struct {
+	listen     string
+	listener   net.Listener
+	grpcServer *grpc.Server
+	cdsCache   *cachev3.LinearCache
+	edsCache   *cachev3.LinearCache
+	instances  map[string][]model.Instance
+	mutex      sync.Mutex
+}
+
+var (
+	envoyServerMap   = map[string]*envoyServer{}
+	envoyServerMutex sync.Mutex
+)
+
+// DefaultEnvoyClusterTemplate cluster in json, endpoints are discovered by EDS over ADS
+var DefaultEnvoyClusterTemplate = `
+{
+    "name": "{{.Name}}",
+    "type": "EDS",
+    "connect_timeout": "5s",
+    "lb_policy": "ROUND_ROBIN",
+    "eds_cluster_config": {
+        "eds_config": {
+            "ads": {},
+            "resource_api_version": "V3"
+        }
+    }
+}
+`
+
+// Start listen xDS server, the server of the same listen address is reused
+func (envoyClient *EnvoyClient) Start() error {
+	_, err := envoyClient.getServer()
+	return err
+}
+
+func (envoyClient *EnvoyClient) getServer() (*envoyServer, error) {
+	envoyClient.mutex.Lock()
+	defer envoyClient.mutex.Unlock()
+	if envoyClient.server != nil {
+		return envoyClient.server, nil
+	}
+	listen := envoyClient.Config.GetEnvoyListen()
+
+	envoyServerMutex.Lock()
+	defer envoyServerMutex.Unlock()
+	if server, ok := envoyServerMap[listen]; ok {
+		envoyClient.server = server
+		return server, nil
+	}
+
+	lis, err := net.Listen("tcp", listen)
+	if err != nil {
+		envoyClient.Logger.Errorf("listen envoy xDS server failed, listen:%s, err:%s", listen, err)
+		return nil, err
+	}
+	server := &envoyServer{
+		listen:    listen,
+		cdsCache:  cachev3.NewLinearCache(resourcev3.ClusterType),
+		edsCache:  cachev3.NewLinearCache(resourcev3.EndpointType),
+		instances: map[string][]model.Instance{},
+	}
+	muxCache := &cachev3.MuxCache{
+		Classify: func(request *cachev3.Request) string {
+			return request.TypeUrl
+		},
+		ClassifyDelta: func(request *cachev3.DeltaRequest) string {
+			return request.TypeUrl
+		},
+		Caches: map[string]cachev3.Cache{
+			resourcev3.ClusterType:  server.cdsCache,
+			resourcev3.EndpointType: server.edsCache,
+		},
+	}
+	logger := envoyClient.Logger
+	callbacks := serverv3.CallbackFuncs{
+		StreamOpenFunc: func(_ context.Context, id int64, typeUrl string) error {
+			logger.Debugf("envoy xDS stream open, id:%d, type:%s", id, typeUrl)
+			return nil
+		},
+		StreamClosedFunc: func(id int64, node *corev3.Node) {
+			logger.Debugf("envoy xDS stream closed, id:%d, node:%s", id, node.GetId())
+		},
+	}
+	xdsServer := serverv3.NewServer(context.Background(), muxCache, callbacks)
+	grpcServer := grpc.NewServer()
+	discoverygrpc.RegisterAggregatedDiscoveryServiceServer(grpcServer, xdsServer)
+	clusterservice.RegisterClusterDiscoveryServiceServer(grpcServer, xdsServer)
+	endpointservice.RegisterEndpointDiscoveryServiceServer(grpcServer, xdsServer)
+	go func() {
+		if err := grpcServer.Serve(lis); err != nil {
+			logger.Errorf("envoy xDS server stopped, listen:%s, err:%s", listen, err)
+		}
+	}()
+	logger.Infof("envoy xDS server started, listen:%s", listen)
+
+	server.listener, server.grpcServer = lis, grpcServer
+	envoyServerMap[listen] = server
+	envoyClient.server = server
+	return server, nil
+}
+
+// ReleaseEnvoyServers stop xDS servers not used by gateways, all servers if gateways is empty
+func ReleaseEnvoyServers(gateways map[string]model.Gateway) {
+	envoyServerMutex.Lock()
+	defer envoyServerMutex.Unlock()
+	used := map[string]bool{}
+	for _, gateway := range gateways {
+		if gateway.Type == model.ENVOY_GATEWAY {
+			used[gateway.GetEnvoyListen()] = true
+		}
+	}
+	for listen, server := range envoyServerMap {
+		if used[listen] {
+			continue
+		}
+		// listener is closed by Stop only if Serve has started
+		server.grpcServer.Stop()
+		_ = server.listener.Close()
+		delete(envoyServerMap, listen)
+	}
+}
+
+func (envoyClient *EnvoyClient) GetServiceAllInstances(upstreamName string) ([]model.Instance, error) {
+	server, err := envoyClient.getServer()
+	if err != nil {
+		return nil, err
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	instances := []model.Instance{}
+	instances = append(instances, server.instances[upstreamName]...)
+	return instances, nil
+}
+
+func (envoyClient *EnvoyClient) SyncInstances(name string, tpl string, discoveryInstances []model.Instance,
+	diffIns []model.Instance) error {
+	server, err := envoyClient.getServer()
+	if err != nil {
+		return err
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	// render on every sync for template or scheme changes, only push when the cluster changed
+	cluster, err := envoyClient.renderCluster(name, tpl, discoveryInstances)
+	if err != nil {
+		return err
+	}
+	if origin, ok := server.cdsCache.GetResources()[name]; !ok || !proto.Equal(origin, cluster) {
+		if err = server.cdsCache.UpdateResource(name, cluster); err != nil {
+			envoyClient.Logger.Errorf("update envoy cluster: %s failed, err:%s", name, err)
+			return err
+		}
+	}
+
+	// zero weight instances are kept for diff, but not served
+	lbEndpoints := []*endpointv3.LbEndpoint{}
+	for _, instance := range discoveryInstances {
+		if instance.Weight <= 0 {
+			continue
+		}
+		lbEndpoint := &endpointv3.LbEndpoint{
+			HostIdentifier: &endpointv3.LbEndpoint_Endpoint{
+				Endpoint: &endpointv3.Endpoint{
+					Address: &corev3.Address{
+						Address: &corev3.Address_SocketAddress{
+							SocketAddress: &corev3.SocketAddress{
+								Address:       instance.Ip,
+								PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: uint32(instance.Port)},
+							},
+						},
+					},
+				},
+			},
+			// envoy weight is integer and at least 1
+			LoadBalancingWeight: wrapperspb.UInt32(uint32(math.Max(1, math.Round(float64(instance.Weight))))),
+		}
+		if len(instance.Metadata) > 0 {
+			fields := map[string]interface{}{}
+			for k, v := range instance.Metadata {
+				fields[k] = v
+			}
+			if metadata, err := structpb.NewStruct(fields); err == nil {
+				lbEndpoint.Metadata = &corev3.Metadata{FilterMetadata: map[string]*structpb.Struct{"envoy.lb": metadata}}
+			}
+		}
+		lbEndpoints = append(lbEndpoints, lbEndpoint)
+	}
+	// stable order, avoid pushing the same endpoints
+	sort.Slice(lbEndpoints, func(i, j int) bool {
+		a := lbEndpoints[i].GetEndpoint().GetAddress().GetSocketAddress()
+		b := lbEndpoints[j].GetEndpoint().GetAddress().GetSocketAddress()
+		if a.GetAddress() != b.GetAddress() {
+			return a.GetAddress() < b.GetAddress()
+		}
+		return a.GetPortValue() < b.GetPortValue()
+	})
+	assignment := &endpointv3.ClusterLoadAssignment{
+		ClusterName: name,
+		Endpoints:   []*endpointv3.LocalityLbEndpoints{{LbEndpoints: lbEndpoints}},
+	}
+	if origin, ok := server.edsCache.GetResources()[name]; !ok || !proto.Equal(origin, assignment) {
+		if err = server.edsCache.UpdateResource(name, assignment); err != nil {
+			envoyClient.Logger.Errorf("update envoy endpoints: %s failed, err:%s", name, err)
+			return err
+		}
+	}
+	instances := []model.Instance{}
+	for _, instance := range discoveryInstances {
+		instances = append(instances, model.Instance{Ip: instance.Ip, Port: instance.Port, Weight: instance.Weight,
+			Metadata: instance.Metadata})
+	}
+	server.instances[name] = instances
+	envoyClient.Logger.Debugf("update envoy cluster: %s, endpoints:%d", name, len(lbEndpoints))
+	return nil
+}
+
+func (envoyClient *EnvoyClient) renderCluster(name string, tpl string,
+	discoveryInstances []model.Instance) (*clusterv3.Cluster, error) {
+	if len(tpl) == 0 {
+		tpl = envoyClient.Config.Config["template"]
+	}
+	if len(tpl) == 0 {
+		tpl = DefaultEnvoyClusterTemplate
+	}
+	tmpl, err := template.New("EnvoyClusterTemplate").Parse(tpl)
+	if err != nil {
+		envoyClient.Logger.Errorf("parse envoy ClusterTemplate failed, tmpl:%s, err:%s", tpl, err)
+		return nil, err
+	}
+	var buf bytes.Buffer
+	data := map[string]string{"Name": name, "Scheme": getScheme(discoveryInstances)}
+	if err = tmpl.Execute(&buf, data); err != nil {
+		envoyClient.Logger.Errorf("parse envoy ClusterTemplate failed, tmpl:%s, data:%#v, err:%s", tpl, data, err)
+		return nil, err
+	}
+	cluster := &clusterv3.Cluster{}
+	if err = protojson.Unmarshal(buf.Bytes(), cluster); err != nil {
+		envoyClient.Logger.Errorf("invalid envoy cluster, cluster:%s, err:%s", buf.String(), err)
+		return nil, err
+	}
+	// name must be the same as cluster load assignment
+	cluster.Name = name
+	return cluster, nil
+}
+
+// FetchAdminApiToFile dump clusters and endpoints of xDS server to json file
+func (envoyClient *EnvoyClient) FetchAdminApiToFile() (string, string, error) {
+	server, err := envoyClient.getServer()
+	if err != nil {
+		return "", "", err
+	}
+	resources := []types.Resource{}
+	for _, cache := range []*cachev3.LinearCache{server.cdsCache, server.edsCache} {
+		resourceMap := cache.GetResources()
+		names := []string{}
+		for name := range resourceMap {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			resources = append(resources, resourceMap[name])
+		}
+	}
+	var buf bytes.Buffer
+	buf.WriteString("[\n")
+	for i, resource := range resources {
+		content, err := protojson.MarshalOptions{Multiline: true}.Marshal(resource)
+		if err != nil {
+			return "", "", err
+		}
+		buf.Write(content)
+		if i < len(resources)-1 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("]\n")
+
+	envoyFilePath := filepath.Join(os.TempDir(), "envoy.json")
+	if err = os.WriteFile(envoyFilePath, buf.Bytes(), 0644); err != nil {
+		envoyClient.Logger.Errorf("failed to write envoy json, err:%s", err)
+		return "", "", err
+	}
+	return buf.String(), envoyFilePath, nil
+}
+
+func (envoyClient *EnvoyClient) MigrateTo(GatewayClient) error {
+	return errors.New("envoy gateway does not support migrate")
+}
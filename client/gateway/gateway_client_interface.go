@@ -26,3 +26,13 @@ type GatewayClient interface {
 
 	MigrateTo(gateway GatewayClient) error
 }
+
+// getScheme scheme of discovery instances for upstream template, e.g. https if eureka securePort enabled
+func getScheme(instances []model.Instance) string {
+	for _, instance := range instances {
+		if scheme, ok := instance.Ext["scheme"]; ok && len(scheme) > 0 {
+			return scheme
+		}
+	}
+	return "http"
+}
@@ -0,0 +1,477 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// HaproxyClient upstream is haproxy backend, servers are updated by data plane api transactions,
+// or by runtime api on pre-allocated server-template slots without reload
+type HaproxyClient struct {
+	Config model.Gateway
+	Logger *go_logger.Logger
+	mutex  sync.Mutex
+}
+
+var DefaultHaproxyBackendTemplate = `
+{
+    "name": "{{.Name}}",
+    "mode": "http",
+    "balance": {"algorithm": "roundrobin"}
+}
+`
+
+// haproxyServerNameRE chars not allowed in haproxy server name
+var haproxyServerNameRE = regexp.MustCompile(`[^\w.-]`)
+
+// haproxyMaintMask srv_admin_state of forced, inherited, configured, resolution and hostname maintenance
+const haproxyMaintMask = 0x01 | 0x02 | 0x04 | 0x20 | 0x40
+
+// haproxySlot server of server-template in show servers state
+type haproxySlot struct {
+	Name   string
+	Addr   string
+	Port   int
+	Weight int
+	Maint  bool
+}
+
+func (haproxyClient *HaproxyClient) isRuntime() bool {
+	return haproxyClient.Config.Config["mode"] == string(model.HAPROXY_RUNTIME)
+}
+
+func (haproxyClient *HaproxyClient) GetServiceAllInstances(upstreamName string) ([]model.Instance, error) {
+	instances := []model.Instance{}
+	if haproxyClient.isRuntime() {
+		slots, err := haproxyClient.getSlots(upstreamName)
+		if err != nil {
+			return nil, err
+		}
+		for _, slot := range slots {
+			if slot.Maint {
+				continue
+			}
+			instances = append(instances, model.Instance{Ip: slot.Addr, Port: slot.Port, Weight: float32(slot.Weight)})
+		}
+		return instances, nil
+	}
+
+	servers, _, err := haproxyClient.getServers(upstreamName)
+	if err != nil {
+		return nil, err
+	}
+	for _, server := range servers {
+		port, weight := 0, 1
+		if server.Port != nil {
+			port = *server.Port
+		}
+		if server.Weight != nil {
+			weight = *server.Weight
+		}
+		instances = append(instances, model.Instance{Ip: server.Address, Port: port, Weight: float32(weight)})
+	}
+	return instances, nil
+}
+
+func (haproxyClient *HaproxyClient) SyncInstances(name string, tpl string, discoveryInstances []model.Instance,
+	diffIns []model.Instance) error {
+	haproxyClient.mutex.Lock()
+	defer haproxyClient.mutex.Unlock()
+
+	// haproxy weight is integer between 0 and 256
+	desired := map[string]int{}
+	for _, instance := range discoveryInstances {
+		weight := int(math.Round(float64(instance.Weight)))
+		desired[net.JoinHostPort(instance.Ip, strconv.Itoa(instance.Port))] = min(max(weight, 0), 256)
+	}
+	if haproxyClient.isRuntime() {
+		return haproxyClient.syncSlots(name, desired)
+	}
+	return haproxyClient.syncServers(name, tpl, desired, discoveryInstances)
+}
+
+// syncSlots disable stale slots first, then fill free slots with new servers
+func (haproxyClient *HaproxyClient) syncSlots(name string, desired map[string]int) error {
+	slots, err := haproxyClient.getSlots(name)
+	if err != nil {
+		return err
+	}
+	if len(slots) == 0 {
+		return errors.New(fmt.Sprintf("haproxy backend %s not found or has no server-template slots", name))
+	}
+	free := []haproxySlot{}
+	stale := []haproxySlot{}
+	weights := map[string]int{}
+	for _, slot := range slots {
+		if slot.Maint {
+			free = append(free, slot)
+			continue
+		}
+		key := net.JoinHostPort(slot.Addr, strconv.Itoa(slot.Port))
+		weight, ok := desired[key]
+		if !ok {
+			stale = append(stale, slot)
+			continue
+		}
+		delete(desired, key)
+		if weight != slot.Weight {
+			weights[slot.Name] = weight
+		}
+	}
+	keys := []string{}
+	for key := range desired {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	// check before any change, stale slots are reused
+	if len(keys) > len(free)+len(stale) {
+		return errors.New(fmt.Sprintf("haproxy backend %s has %d free server-template slots, but needs %d",
+			name, len(free)+len(stale), len(keys)))
+	}
+
+	for _, slot := range stale {
+		if err = haproxyClient.runtimeSet(fmt.Sprintf("disable server %s/%s", name, slot.Name)); err != nil {
+			return err
+		}
+		free = append(free, slot)
+	}
+	for slotName, weight := range weights {
+		err = haproxyClient.runtimeSet(fmt.Sprintf("set server %s/%s weight %d", name, slotName, weight))
+		if err != nil {
+			return err
+		}
+	}
+	for i, key := range keys {
+		host, port, _ := net.SplitHostPort(key)
+		server := name + "/" + free[i].Name
+		output, err := haproxyClient.runtimeCommand(fmt.Sprintf("set server %s addr %s port %s", server, host, port))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(output, "changed") && !strings.Contains(output, "no need to change") {
+			return errors.New(fmt.Sprintf("set haproxy server %s addr failed, output:%s", server, output))
+		}
+		if err = haproxyClient.runtimeSet(fmt.Sprintf("set server %s weight %d", server, desired[key])); err != nil {
+			return err
+		}
+		if err = haproxyClient.runtimeSet(fmt.Sprintf("enable server %s", server)); err != nil {
+			return err
+		}
+	}
+	haproxyClient.Logger.Debugf("update haproxy backend slots: %s, servers:%d, free slots:%d", name,
+		len(slots)-len(free)+len(keys), len(free)-len(keys))
+	return nil
+}
+
+// getSlots parse show servers state, columns are named by the header line
+func (haproxyClient *HaproxyClient) getSlots(backend string) ([]haproxySlot, error) {
+	output, err := haproxyClient.runtimeCommand("show servers state " + backend)
+	if err != nil {
+		return nil, err
+	}
+	slots := []haproxySlot{}
+	columns := map[string]int{}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "# ") {
+			for i, column := range strings.Fields(strings.TrimPrefix(line, "# ")) {
+				columns[column] = i
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(columns) == 0 || len(fields) < len(columns) {
+			continue
+		}
+		port, _ := strconv.Atoi(fields[columns["srv_port"]])
+		weight, _ := strconv.Atoi(fields[columns["srv_uweight"]])
+		adminState, _ := strconv.Atoi(fields[columns["srv_admin_state"]])
+		slots = append(slots, haproxySlot{Name: fields[columns["srv_name"]], Addr: fields[columns["srv_addr"]],
+			Port: port, Weight: weight, Maint: adminState&haproxyMaintMask != 0})
+	}
+	return slots, nil
+}
+
+// runtimeSet run command which outputs nothing when succeeded
+func (haproxyClient *HaproxyClient) runtimeSet(command string) error {
+	output, err := haproxyClient.runtimeCommand(command)
+	if err != nil {
+		return err
+	}
+	if len(strings.TrimSpace(output)) > 0 {
+		haproxyClient.Logger.Errorf("run haproxy runtime command failed, command:%s, output:%s", command, output)
+		return errors.New(fmt.Sprintf("run haproxy runtime command failed, command:%s, output:%s", command, output))
+	}
+	return nil
+}
+
+// runtimeCommand run one command per connection of haproxy runtime api
+func (haproxyClient *HaproxyClient) runtimeCommand(command string) (string, error) {
+	runtimeApi := haproxyClient.Config.Config["runtime-api"]
+	network, address := "tcp", strings.TrimPrefix(runtimeApi, "tcp://")
+	if strings.HasPrefix(runtimeApi, "unix://") {
+		network, address = "unix", strings.TrimPrefix(runtimeApi, "unix://")
+	}
+	conn, err := net.DialTimeout(network, address, 10*time.Second)
+	if err != nil {
+		haproxyClient.Logger.Errorf("connect haproxy runtime api error, runtime-api:%s, err:%s", runtimeApi, err)
+		return "", err
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err = conn.Write([]byte(command + "\n")); err != nil {
+		haproxyClient.Logger.Errorf("write haproxy runtime api error, command:%s, err:%s", command, err)
+		return "", err
+	}
+	output, err := io.ReadAll(conn)
+	if err != nil {
+		haproxyClient.Logger.Errorf("read haproxy runtime api error, command:%s, err:%s", command, err)
+		return "", err
+	}
+	haproxyClient.Logger.Debugf("run haproxy runtime command:%s, output:%s", command, output)
+	return string(output), nil
+}
+
+// syncServers add, replace and delete servers in one data plane api transaction
+func (haproxyClient *HaproxyClient) syncServers(name string, tpl string, desired map[string]int,
+	discoveryInstances []model.Instance) error {
+	servers, exists, err := haproxyClient.getServers(name)
+	if err != nil {
+		return err
+	}
+	version := 0
+	if _, err = haproxyClient.dataplaneDo("GET", "services/haproxy/configuration/version", nil, &version); err != nil {
+		return err
+	}
+	transaction := model.HaproxyTransaction{}
+	_, err = haproxyClient.dataplaneDo("POST", fmt.Sprintf("services/haproxy/transactions?version=%d", version),
+		nil, &transaction)
+	if err != nil {
+		return err
+	}
+	err = haproxyClient.updateServers(transaction.Id, name, tpl, exists, servers, desired, discoveryInstances)
+	if err != nil {
+		_, _ = haproxyClient.dataplaneDo("DELETE", "services/haproxy/transactions/"+transaction.Id, nil, nil)
+		return err
+	}
+	if _, err = haproxyClient.dataplaneDo("PUT", "services/haproxy/transactions/"+transaction.Id, nil, nil); err != nil {
+		return err
+	}
+	haproxyClient.Logger.Debugf("update haproxy backend: %s, servers:%d, transaction:%s", name, len(discoveryInstances),
+		transaction.Id)
+	return nil
+}
+
+func (haproxyClient *HaproxyClient) updateServers(transactionId string, name string, tpl string, exists bool,
+	servers []model.HaproxyServer, desired map[string]int, discoveryInstances []model.Instance) error {
+	query := fmt.Sprintf("?backend=%s&transaction_id=%s", url.QueryEscape(name), transactionId)
+	if !exists {
+		backend, err := haproxyClient.renderBackend(name, tpl, discoveryInstances)
+		if err != nil {
+			return err
+		}
+		_, err = haproxyClient.dataplaneDo("POST", "services/haproxy/configuration/backends?transaction_id="+
+			transactionId, backend, nil)
+		if err != nil {
+			return err
+		}
+	}
+	check := haproxyClient.Config.Config["check"]
+	for _, server := range servers {
+		port := 0
+		if server.Port != nil {
+			port = *server.Port
+		}
+		key := net.JoinHostPort(server.Address, strconv.Itoa(port))
+		weight, ok := desired[key]
+		path := "services/haproxy/configuration/servers/" + url.PathEscape(server.Name) + query
+		if !ok {
+			if _, err := haproxyClient.dataplaneDo("DELETE", path, nil, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		delete(desired, key)
+		if server.Weight == nil || *server.Weight != weight {
+			body := map[string]interface{}{"name": server.Name, "address": server.Address, "port": port,
+				"weight": weight}
+			if len(check) > 0 {
+				body["check"] = check
+			}
+			if _, err := haproxyClient.dataplaneDo("PUT", path, body, nil); err != nil {
+				return err
+			}
+		}
+	}
+	for key, weight := range desired {
+		host, port, _ := net.SplitHostPort(key)
+		body := map[string]interface{}{"name": haproxyServerNameRE.ReplaceAllString(key, "_"), "address": host,
+			"weight": weight}
+		body["port"], _ = strconv.Atoi(port)
+		if len(check) > 0 {
+			body["check"] = check
+		}
+		if _, err := haproxyClient.dataplaneDo("POST", "services/haproxy/configuration/servers"+query, body,
+			nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (haproxyClient *HaproxyClient) renderBackend(name string, tpl string,
+	discoveryInstances []model.Instance) (map[string]interface{}, error) {
+	if len(tpl) == 0 {
+		tpl = haproxyClient.Config.Config["template"]
+	}
+	if len(tpl) == 0 {
+		tpl = DefaultHaproxyBackendTemplate
+	}
+	tmpl, err := template.New("HaproxyBackendTemplate").Parse(tpl)
+	if err != nil {
+		haproxyClient.Logger.Errorf("parse haproxy BackendTemplate failed, tmpl:%s, err:%s", tpl, err)
+		return nil, err
+	}
+	var buf bytes.Buffer
+	data := map[string]string{"Name": name, "Scheme": getScheme(discoveryInstances)}
+	if err = tmpl.Execute(&buf, data); err != nil {
+		haproxyClient.Logger.Errorf("parse haproxy BackendTemplate failed, tmpl:%s, data:%#v, err:%s", tpl, data, err)
+		return nil, err
+	}
+	backend := map[string]interface{}{}
+	if err = json.Unmarshal(buf.Bytes(), &backend); err != nil {
+		haproxyClient.Logger.Errorf("invalid haproxy backend, backend:%s, err:%s", buf.String(), err)
+		return nil, err
+	}
+	// name must be the same as upstream
+	backend["name"] = name
+	return backend, nil
+}
+
+// getServers servers of backend, exists is false when backend not found
+func (haproxyClient *HaproxyClient) getServers(backend string) ([]model.HaproxyServer, bool, error) {
+	serversResp := model.HaproxyServersResp{}
+	statusCode, err := haproxyClient.dataplaneDo("GET",
+		"services/haproxy/configuration/servers?backend="+url.QueryEscape(backend), nil, &serversResp)
+	if statusCode == http.StatusNotFound {
+		return []model.HaproxyServer{}, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return serversResp.Data, true, nil
+}
+
+// dataplaneDo call data plane api, decode json response into result if not nil
+func (haproxyClient *HaproxyClient) dataplaneDo(method string, path string, body interface{},
+	result interface{}) (int, error) {
+	prefix := haproxyClient.Config.Prefix
+	if len(prefix) == 0 {
+		prefix = "/v2/"
+	}
+	uri := haproxyClient.Config.AdminUrl + prefix + path
+	var reqBody io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reqBody = bytes.NewReader(content)
+	}
+	hc := &http.Client{Timeout: 30 * time.Second}
+	req, _ := http.NewRequest(method, uri, reqBody)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	if username, ok := haproxyClient.Config.Config["username"]; ok {
+		req.SetBasicAuth(username, haproxyClient.Config.Config["password"])
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		haproxyClient.Logger.Errorf("call haproxy data plane api error, uri:%s, err:%s", uri, err)
+		return 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	respRawByte, err := io.ReadAll(resp.Body)
+	if err != nil {
+		haproxyClient.Logger.Errorf("call haproxy data plane api error, uri:%s, err:%s", uri, err)
+		return resp.StatusCode, err
+	}
+	haproxyClient.Logger.Debugf("call haproxy data plane api uri:%s,method:%s,status:%d,resp:%s", uri, method,
+		resp.StatusCode, respRawByte)
+	if resp.StatusCode >= 300 {
+		if resp.StatusCode != http.StatusNotFound {
+			haproxyClient.Logger.Errorf("call haproxy data plane api error, uri:%s, method:%s, status:%d, resp:%s",
+				uri, method, resp.StatusCode, respRawByte)
+		}
+		return resp.StatusCode, errors.New(fmt.Sprintf("call haproxy data plane api error, uri:%s, status:%d",
+			uri, resp.StatusCode))
+	}
+	if result != nil {
+		if err = json.Unmarshal(respRawByte, result); err != nil {
+			haproxyClient.Logger.Errorf("decode haproxy data plane api json error, uri:%s, err:%s", uri, err)
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// FetchAdminApiToFile raw configuration by data plane api, or servers state by runtime api
+func (haproxyClient *HaproxyClient) FetchAdminApiToFile() (string, string, error) {
+	var (
+		content  string
+		fileName string
+	)
+	if haproxyClient.isRuntime() {
+		output, err := haproxyClient.runtimeCommand("show servers state")
+		if err != nil {
+			return "", "", err
+		}
+		content, fileName = output, "haproxy-servers-state.txt"
+	} else {
+		rawResp := model.HaproxyRawResp{}
+		if _, err := haproxyClient.dataplaneDo("GET", "services/haproxy/configuration/raw", nil, &rawResp); err != nil {
+			return "", "", err
+		}
+		content, fileName = rawResp.Data, "haproxy.cfg"
+	}
+	haproxyFilePath := filepath.Join(os.TempDir(), fileName)
+	if err := os.WriteFile(haproxyFilePath, []byte(content), 0644); err != nil {
+		haproxyClient.Logger.Errorf("failed to write %s, err:%s", fileName, err)
+		return "", "", err
+	}
+	return content, haproxyFilePath, nil
+}
+
+func (haproxyClient *HaproxyClient) MigrateTo(GatewayClient) error {
+	return errors.New("haproxy gateway does not support migrate")
+}
@@ -19,10 +19,15 @@ import (
 	"errors"
 	"fmt"
 	"github.com/anjia0532/apisix-discovery-syncer/model"
+	"github.com/ghodss/yaml"
 	go_logger "github.com/phachon/go-logger"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -115,14 +120,14 @@ func (kongClient *KongClient) SyncInstances(name string, tpl string, discoveryIn
 
 		tmpl, err := template.New("UpstreamKongTemplate").Parse(tpl)
 		if err != nil {
-			kongClient.Logger.Errorf("parse kong UpstreamTemplate failed, tmpl:%s, err:%s", tmpl, err)
+			kongClient.Logger.Errorf("parse kong UpstreamTemplate failed, tmpl:%s, err:%s", tpl, err)
 			return err
 		}
-		data := map[string]string{"Name": name}
-		err = tmpl.Execute(&buf, map[string]string{"Name": name})
+		data := map[string]string{"Name": name, "Scheme": getScheme(discoveryInstances)}
+		err = tmpl.Execute(&buf, data)
 
 		if err != nil {
-			kongClient.Logger.Errorf("parse kong UpstreamTemplate failed, tmpl:%s, data:%#v,err:%s", tmpl, data, err)
+			kongClient.Logger.Errorf("parse kong UpstreamTemplate failed, tmpl:%s, data:%#v,err:%s", tpl, data, err)
 		} else {
 			body = buf.String()
 		}
@@ -175,10 +180,283 @@ func (kongClient *KongClient) SyncInstances(name string, tpl string, discoveryIn
 	return nil
 }
 
+var KongConfigTemplate = `# Auto generate by https://github.com/anjia0532/discovery-syncer, Don't Modify
+
+# kong db-less mode, modify kong.conf https://docs.konghq.com/gateway/latest/reference/configuration/
+# database = off
+# declarative_config = /path/to/kong.yml
+
+{{.Value}}`
+
+// kongRegexPathRE kong 2.x paths with regex chars, kong 3.x needs ~ prefix for regex paths
+var kongRegexPathRE = regexp.MustCompile(`[^a-zA-Z0-9._~/%-]`)
+
+// FetchAdminApiToFile export all entities into declarative config, _format_version 3.0
 func (kongClient *KongClient) FetchAdminApiToFile() (string, string, error) {
-	return "", "", errors.New("Unrealized")
+	version, err := kongClient.getVersion()
+	if err != nil {
+		return "", "", err
+	}
+	entities, err := kongClient.fetchEntities()
+	if err != nil {
+		return "", "", err
+	}
+	if isLegacyKong(version) {
+		convertKongRegexPaths(entities["routes"])
+	}
+	kongConfig := map[string]interface{}{"_format_version": "3.0", "_transform": false}
+	for _, entity := range model.KongEntities {
+		if len(entities[entity.Key]) == 0 {
+			continue
+		}
+		values := []map[string]interface{}{}
+		for _, value := range entities[entity.Key] {
+			values = append(values, toKongDeclarative(value))
+		}
+		kongConfig[entity.Key] = values
+	}
+
+	ymlBytes, err := yaml.Marshal(kongConfig)
+	if err != nil {
+		kongClient.Logger.Errorf("[admin_api_to_yaml]convert json to yaml error,err:%s", err)
+		return "", "", err
+	}
+	var tpl bytes.Buffer
+	tmpl, err := template.New("KongConfigTemplate").Parse(KongConfigTemplate)
+	if err != nil {
+		kongClient.Logger.Errorf("[admin_api_to_yaml]parse template error,err:%s", err)
+		return "", "", err
+	}
+	if err = tmpl.Execute(&tpl, map[string]string{"Value": string(ymlBytes)}); err != nil {
+		kongClient.Logger.Errorf("[admin_api_to_yaml]template execute error,err:%s", err)
+		return "", "", err
+	}
+	kongFilePath := filepath.Join(os.TempDir(), "kong.yml")
+	if err = os.WriteFile(kongFilePath, tpl.Bytes(), 0644); err != nil {
+		kongClient.Logger.Errorf("[admin_api_to_yaml]failed to write kong.yml ,err:%s", err)
+		return "", "", err
+	}
+	return tpl.String(), kongFilePath, nil
+}
+
+// fetchEntities all entities of kong by declarative config key
+func (kongClient *KongClient) fetchEntities() (map[string][]map[string]interface{}, error) {
+	entities := map[string][]map[string]interface{}{}
+	for _, entity := range model.KongEntities {
+		uris := []string{entity.Uri}
+		if len(entity.Parent) > 0 {
+			uris = []string{}
+			for _, parent := range entities[entity.Parent] {
+				uris = append(uris, fmt.Sprintf("%s/%s/%s", entity.Parent, parent["id"], entity.Uri))
+			}
+		}
+		for _, uri := range uris {
+			values, statusCode, err := kongClient.fetchAll(uri)
+			// entities of plugins which are not installed
+			if statusCode == http.StatusNotFound {
+				kongClient.Logger.Warningf("[admin_api_to_yaml]kong entity not found, uri:%s", uri)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			entities[entity.Key] = append(entities[entity.Key], values...)
+		}
+	}
+	return entities, nil
+}
+
+// isLegacyKong kong before 3.x, all paths are regex
+func isLegacyKong(version string) bool {
+	return strings.HasPrefix(version, "0.") || strings.HasPrefix(version, "1.") || strings.HasPrefix(version, "2.")
+}
+
+// convertKongRegexPaths add ~ prefix to regex paths of kong 2.x routes for kong 3.x
+func convertKongRegexPaths(routes []map[string]interface{}) {
+	for _, route := range routes {
+		paths, _ := route["paths"].([]interface{})
+		for i, path := range paths {
+			if p, ok := path.(string); ok && !strings.HasPrefix(p, "~") && kongRegexPathRE.MatchString(p) {
+				paths[i] = "~" + p
+			}
+		}
+	}
+}
+
+// toKongDeclarative foreign keys {"id": "xxx"} of admin api are "xxx" in declarative config, nulls are dropped
+func toKongDeclarative(value map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	for k, v := range value {
+		if v == nil {
+			continue
+		}
+		if foreign, ok := v.(map[string]interface{}); ok && len(foreign) == 1 && foreign["id"] != nil {
+			result[k] = foreign["id"]
+			continue
+		}
+		result[k] = v
+	}
+	return result
+}
+
+func (kongClient *KongClient) getVersion() (string, error) {
+	_, body, err := kongClient.adminDo("GET", "", nil)
+	if err != nil {
+		return "", err
+	}
+	info := struct {
+		Version string `json:"version"`
+	}{}
+	if err = json.Unmarshal(body, &info); err != nil {
+		kongClient.Logger.Errorf("decode kong node info error, err:%s", err)
+		return "", err
+	}
+	return info.Version, nil
+}
+
+// fetchAll page through kong admin api by offset
+func (kongClient *KongClient) fetchAll(uri string) ([]map[string]interface{}, int, error) {
+	values := []map[string]interface{}{}
+	offset := ""
+	for {
+		path := uri + "?size=1000"
+		if len(offset) > 0 {
+			path += "&offset=" + url.QueryEscape(offset)
+		}
+		statusCode, body, err := kongClient.adminDo("GET", path, nil)
+		if err != nil {
+			return nil, statusCode, err
+		}
+		page := model.KongPage{}
+		if err = json.Unmarshal(body, &page); err != nil {
+			kongClient.Logger.Errorf("decode kong page error, uri:%s, err:%s", path, err)
+			return nil, statusCode, err
+		}
+		values = append(values, page.Data...)
+		if page.Next == nil || len(*page.Next) == 0 || len(page.Offset) == 0 {
+			return values, statusCode, nil
+		}
+		offset = page.Offset
+	}
+}
+
+// adminDo call kong admin api by path of admin url
+func (kongClient *KongClient) adminDo(method string, path string, body []byte) (int, []byte, error) {
+	uri := kongClient.Config.AdminUrl + "/" + path
+	hc := &http.Client{Timeout: 30 * time.Second}
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, _ := http.NewRequest(method, uri, reqBody)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := hc.Do(req)
+	if err != nil {
+		kongClient.Logger.Errorf("call kong admin api error, uri:%s, err:%s", uri, err)
+		return 0, nil, err
+	}
+	respRawByte, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		kongClient.Logger.Errorf("call kong admin api error, uri:%s, err:%s", uri, err)
+		return resp.StatusCode, nil, err
+	}
+	kongClient.Logger.Debugf("call kong admin api uri:%s,method:%s,status:%d", uri, method, resp.StatusCode)
+	if resp.StatusCode >= 300 {
+		if resp.StatusCode != http.StatusNotFound {
+			kongClient.Logger.Errorf("call kong admin api error, uri:%s, method:%s, status:%d, resp:%s", uri, method,
+				resp.StatusCode, respRawByte)
+		}
+		return resp.StatusCode, respRawByte, errors.New(fmt.Sprintf("call kong admin api error, uri:%s, status:%d, "+
+			"resp:%s", uri, resp.StatusCode, respRawByte))
+	}
+	return resp.StatusCode, respRawByte, nil
 }
 
+// MigrateTo upsert all entities by id into target kong in dependency order, ids and tags are kept.
+// apisix target is translated, see migrateToApisix
 func (kongClient *KongClient) MigrateTo(gateway GatewayClient) error {
-	return errors.New("Unrealized")
+	if targetApisixClient, ok := gateway.(*ApisixClient); ok {
+		return kongClient.migrateToApisix(targetApisixClient)
+	}
+	targetKongClient, ok := gateway.(*KongClient)
+	if !ok {
+		return errors.New("Target GatewayClient is not KongClient or ApisixClient")
+	}
+	originVersion, err := kongClient.getVersion()
+	if err != nil {
+		return err
+	}
+	targetVersion, err := targetKongClient.getVersion()
+	if err != nil {
+		return err
+	}
+	entities, err := kongClient.fetchEntities()
+	if err != nil {
+		return err
+	}
+	if isLegacyKong(originVersion) && !isLegacyKong(targetVersion) {
+		convertKongRegexPaths(entities["routes"])
+	}
+
+	report := migrateReport{}
+	for _, entity := range model.KongEntities {
+		for _, value := range entities[entity.Key] {
+			id, _ := value["id"].(string)
+			// password of basic-auth is hashed, it would be hashed again when created by admin api
+			if entity.Key == "basicauth_credentials" {
+				report.add(entity.Uri, id, "hashed password can not be migrated, please recreate it")
+				continue
+			}
+			uri := entity.Uri + "/" + id
+			if len(entity.Parent) > 0 {
+				parent, _ := value[strings.TrimSuffix(entity.Parent, "s")].(map[string]interface{})
+				uri = fmt.Sprintf("%s/%s/%s/%s", entity.Parent, parent["id"], entity.Uri, id)
+			}
+			targetKongClient.upsertEntity(uri, toKongUpsert(value), &report)
+		}
+	}
+	if len(report) > 0 {
+		return errors.New(fmt.Sprintf("%d kong entities failed to migrate:\n%s", len(report),
+			strings.Join(report, "\n")))
+	}
+	return nil
+}
+
+// migrateReport entities which could not be migrated
+type migrateReport []string
+
+func (report *migrateReport) add(kind string, id string, format string, args ...interface{}) {
+	*report = append(*report, fmt.Sprintf("%s %s: %s", kind, id, fmt.Sprintf(format, args...)))
+}
+
+// upsertEntity PUT kong entity by uri with id, error is added to report
+func (kongClient *KongClient) upsertEntity(uri string, value map[string]interface{}, report *migrateReport) {
+	body, _ := json.Marshal(value)
+	statusCode, respBody, err := kongClient.adminDo("PUT", uri, body)
+	// targets of kong 2.x can not be updated
+	if statusCode == http.StatusMethodNotAllowed && strings.Contains(uri, "/targets/") {
+		uri = uri[:strings.LastIndex(uri, "/")]
+		statusCode, respBody, err = kongClient.adminDo("POST", uri, body)
+	}
+	if err != nil {
+		kongClient.Logger.Errorf("[migrate]save or update target kong info error,uri:%s,err:%s", uri, err)
+		kind, id, _ := strings.Cut(uri, "/")
+		report.add(kind, id, "%d %s", statusCode, respBody)
+		return
+	}
+	kongClient.Logger.Infof("[migrate]save or update target kong info,uri:%s, %s", uri, respBody)
+}
+
+// toKongUpsert body of PUT, nulls and timestamps are dropped
+func toKongUpsert(value map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	for k, v := range value {
+		if v == nil || k == "created_at" || k == "updated_at" {
+			continue
+		}
+		result[k] = v
+	}
+	return result
 }
@@ -0,0 +1,1177 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	"maps"
+	"net"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// translation of the shared concepts between kong and apisix,
+// kong service+route <-> apisix service+route, upstream targets <-> upstream nodes,
+// key-auth/basic-auth consumers and common plugins (rate limiting, cors, ip-restriction, key-auth, basic-auth)
+
+var (
+	apisixConsumerNameRE = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+	kongNameRE           = regexp.MustCompile(`[^a-zA-Z0-9._~-]`)
+	kongHostNameRE       = regexp.MustCompile(`[^a-z0-9.-]`)
+	kongUuidRE           = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+	httpProtocols        = []string{"http", "https", "grpc", "grpcs"}
+	// limit-count time_window of rate-limiting config fields
+	kongRateLimitWindows = []struct {
+		Key     string
+		Seconds int
+	}{{"second", 1}, {"minute", 60}, {"hour", 3600}, {"day", 86400}}
+)
+
+// toError entities which could not be translated, or were translated partially
+func (report migrateReport) toError(from string, to string) error {
+	if len(report) == 0 {
+		return nil
+	}
+	return errors.New(fmt.Sprintf("%d entities could not be translated from %s to %s:\n%s", len(report), from, to,
+		strings.Join(report, "\n")))
+}
+
+// migrateToApisix translate kong entities into apisix, ids of kong are kept
+func (kongClient *KongClient) migrateToApisix(target *ApisixClient) error {
+	version, err := kongClient.getVersion()
+	if err != nil {
+		return err
+	}
+	legacy := isLegacyKong(version)
+	entities, err := kongClient.fetchEntities()
+	if err != nil {
+		return err
+	}
+	report := migrateReport{}
+
+	// upstreams and targets
+	targets := map[string][]map[string]interface{}{}
+	for _, value := range entities["targets"] {
+		upstreamId := kongForeignId(value, "upstream")
+		targets[upstreamId] = append(targets[upstreamId], value)
+	}
+	upstreams := map[string]map[string]interface{}{}
+	upstreamIds := []string{}
+	upstreamIdByName := map[string]string{}
+	for _, value := range entities["upstreams"] {
+		id := fieldString(value, "id")
+		upstreams[id] = kongUpstreamToApisix(value, targets[id], &report)
+		upstreamIds = append(upstreamIds, id)
+		upstreamIdByName[fieldString(value, "name")] = id
+	}
+
+	// services, upstream is the kong upstream named by host, or the host itself
+	services := map[string]map[string]interface{}{}
+	apisixServices := []map[string]interface{}{}
+	// scheme, timeout and retries of kong upstreams, set by the first service using it
+	upstreamSettings := map[string]map[string]interface{}{}
+	for _, value := range entities["services"] {
+		id := fieldString(value, "id")
+		protocol := fieldString(value, "protocol")
+		if !slices.Contains(httpProtocols, protocol) {
+			report.add("services", id, "protocol %s is not supported", protocol)
+			continue
+		}
+		upstreamId, ok := upstreamIdByName[fieldString(value, "host")]
+		if !ok {
+			upstreamId = id
+			port, ok := fieldNumber(value, "port")
+			if !ok {
+				port = 80
+			}
+			upstreams[id] = map[string]interface{}{
+				"id":        id,
+				"name":      kongDefaultString(fieldString(value, "name"), id),
+				"type":      "roundrobin",
+				"pass_host": "node",
+				"nodes": []map[string]interface{}{
+					{"host": fieldString(value, "host"), "port": int(port), "weight": 1},
+				},
+			}
+			upstreamIds = append(upstreamIds, id)
+		}
+		settings := map[string]interface{}{"scheme": protocol}
+		timeout := map[string]interface{}{}
+		for kongKey, apisixKey := range map[string]string{"connect_timeout": "connect", "write_timeout": "send",
+			"read_timeout": "read"} {
+			if ms, ok := fieldNumber(value, kongKey); ok {
+				timeout[apisixKey] = ms / 1000
+			}
+		}
+		if len(timeout) > 0 {
+			settings["timeout"] = timeout
+		}
+		if retries, ok := fieldNumber(value, "retries"); ok {
+			settings["retries"] = int(retries)
+		}
+		// services sharing a kong upstream with different settings get their own copy of the upstream
+		if applied, ok := upstreamSettings[upstreamId]; ok && !reflect.DeepEqual(applied, settings) {
+			copyId := kongUuid("upstreams/service", upstreamId+"/"+id)
+			upstream := maps.Clone(upstreams[upstreamId])
+			upstream["id"] = copyId
+			upstream["name"] = fmt.Sprintf("%s-%s", upstream["name"], kongDefaultString(fieldString(value, "name"), id))
+			upstream["desc"] = fmt.Sprintf("migrated from kong upstream %s for service %s", upstreamId, id)
+			kongClient.Logger.Warningf("[migrate]kong upstream %s is shared by services with different protocol, "+
+				"timeouts or retries, service %s uses upstream %s", upstreamId, id, copyId)
+			upstreams[copyId] = upstream
+			upstreamIds = append(upstreamIds, copyId)
+			upstreamId = copyId
+		}
+		upstreamSettings[upstreamId] = settings
+		for key, setting := range settings {
+			upstreams[upstreamId][key] = setting
+		}
+		services[id] = value
+		apisixServices = append(apisixServices, map[string]interface{}{
+			"id":          id,
+			"name":        kongDefaultString(fieldString(value, "name"), id),
+			"upstream_id": upstreamId,
+			"desc":        "migrated from kong service " + id,
+		})
+	}
+
+	// plugins by scope
+	servicePlugins := map[string]map[string]interface{}{}
+	routePlugins := map[string]map[string]interface{}{}
+	consumerPlugins := map[string]map[string]interface{}{}
+	globalRules := []map[string]interface{}{}
+	for _, value := range entities["plugins"] {
+		id := fieldString(value, "id")
+		name, conf, notes := kongPluginToApisix(value, target.ApiVersion)
+		for _, note := range notes {
+			report.add("plugins", id, "%s: %s", fieldString(value, "name"), note)
+		}
+		if conf == nil {
+			continue
+		}
+		serviceId, routeId, consumerId := kongForeignId(value, "service"), kongForeignId(value, "route"),
+			kongForeignId(value, "consumer")
+		scopes := 0
+		for _, scopeId := range []string{serviceId, routeId, consumerId} {
+			if len(scopeId) > 0 {
+				scopes++
+			}
+		}
+		switch {
+		case scopes > 1:
+			report.add("plugins", id, "%s: plugin scoped by more than one of service, route and consumer "+
+				"is not supported", fieldString(value, "name"))
+		case len(serviceId) > 0:
+			kongAddPlugin(servicePlugins, serviceId, name, conf)
+		case len(routeId) > 0:
+			kongAddPlugin(routePlugins, routeId, name, conf)
+		case len(consumerId) > 0:
+			kongAddPlugin(consumerPlugins, consumerId, name, conf)
+		default:
+			globalRules = append(globalRules, map[string]interface{}{"id": id,
+				"plugins": map[string]interface{}{name: conf}})
+		}
+	}
+	for _, service := range apisixServices {
+		if plugins, ok := servicePlugins[service["id"].(string)]; ok {
+			service["plugins"] = plugins
+		}
+	}
+
+	// routes
+	apisixRoutes := []map[string]interface{}{}
+	for _, value := range entities["routes"] {
+		if route := kongRouteToApisix(value, services, routePlugins, legacy, &report); route != nil {
+			apisixRoutes = append(apisixRoutes, route)
+		}
+	}
+
+	// consumers and credentials
+	keyAuths := map[string][]map[string]interface{}{}
+	for _, value := range entities["keyauth_credentials"] {
+		consumerId := kongForeignId(value, "consumer")
+		keyAuths[consumerId] = append(keyAuths[consumerId], value)
+	}
+	basicAuths := map[string][]map[string]interface{}{}
+	for _, value := range entities["basicauth_credentials"] {
+		consumerId := kongForeignId(value, "consumer")
+		basicAuths[consumerId] = append(basicAuths[consumerId], value)
+	}
+	for _, key := range []string{"hmacauth_credentials", "jwt_secrets", "acls", "oauth2_credentials"} {
+		for _, value := range entities[key] {
+			report.add(key, fieldString(value, "id"), "credential of consumer %s is not supported",
+				kongForeignId(value, "consumer"))
+		}
+	}
+	apisixConsumers := []map[string]interface{}{}
+	usernames := map[string]bool{}
+	for _, value := range entities["consumers"] {
+		id := fieldString(value, "id")
+		username := kongDefaultString(fieldString(value, "username"), kongDefaultString(
+			fieldString(value, "custom_id"), id))
+		name := apisixConsumerNameRE.ReplaceAllString(username, "_")
+		if usernames[name] {
+			name = name + "_" + apisixConsumerNameRE.ReplaceAllString(id, "_")
+		}
+		usernames[name] = true
+		if name != username {
+			report.add("consumers", id, "username %s is renamed to %s", username, name)
+		}
+		plugins := consumerPlugins[id]
+		if plugins == nil {
+			plugins = map[string]interface{}{}
+		}
+		for i, credential := range keyAuths[id] {
+			if i == 0 {
+				plugins["key-auth"] = map[string]interface{}{"key": fieldString(credential, "key")}
+				continue
+			}
+			report.add("keyauth_credentials", fieldString(credential, "id"), "apisix consumer %s has only one key",
+				name)
+		}
+		// password of basic-auth is hashed by kong
+		for _, credential := range basicAuths[id] {
+			report.add("basicauth_credentials", fieldString(credential, "id"), "hashed password can not be "+
+				"migrated, please recreate basic-auth of consumer %s", name)
+		}
+		consumer := map[string]interface{}{"username": name, "desc": "migrated from kong consumer " + id}
+		if len(plugins) > 0 {
+			consumer["plugins"] = plugins
+		}
+		apisixConsumers = append(apisixConsumers, consumer)
+	}
+
+	// upstreams before services, services before routes
+	for _, id := range upstreamIds {
+		target.putEntity("upstreams/"+id, upstreams[id], &report)
+	}
+	for _, service := range apisixServices {
+		target.putEntity("services/"+service["id"].(string), service, &report)
+	}
+	for _, consumer := range apisixConsumers {
+		// consumers are identified by username
+		target.putEntity("consumers", consumer, &report)
+	}
+	for _, route := range apisixRoutes {
+		target.putEntity("routes/"+route["id"].(string), route, &report)
+	}
+	for _, rule := range globalRules {
+		target.putEntity("global_rules/"+rule["id"].(string), rule, &report)
+	}
+	return report.toError("kong", "apisix")
+}
+
+// kongUpstreamToApisix upstream with targets as nodes, health checks are not translated
+func kongUpstreamToApisix(upstream map[string]interface{}, targets []map[string]interface{},
+	report *migrateReport) map[string]interface{} {
+	id := fieldString(upstream, "id")
+	nodes := []map[string]interface{}{}
+	for _, value := range targets {
+		host, portStr, err := net.SplitHostPort(fieldString(value, "target"))
+		if err != nil {
+			// kong default port of target
+			host, portStr = fieldString(value, "target"), "8000"
+		}
+		port, _ := strconv.Atoi(portStr)
+		weight, ok := fieldNumber(value, "weight")
+		if !ok {
+			weight = 100
+		}
+		nodes = append(nodes, map[string]interface{}{"host": host, "port": port, "weight": int(weight)})
+	}
+	result := map[string]interface{}{
+		"id":    id,
+		"name":  fieldString(upstream, "name"),
+		"type":  "roundrobin",
+		"nodes": nodes,
+		"desc":  "migrated from kong upstream " + id,
+	}
+	// kong sends upstream name as host header, unless host_header is set
+	result["pass_host"] = "rewrite"
+	result["upstream_host"] = kongDefaultString(fieldString(upstream, "host_header"), fieldString(upstream, "name"))
+
+	switch fieldString(upstream, "algorithm") {
+	case "least-connections":
+		result["type"] = "least_conn"
+	case "latency":
+		result["type"] = "ewma"
+	case "consistent-hashing":
+		result["type"] = "chash"
+		switch hashOn := fieldString(upstream, "hash_on"); hashOn {
+		case "ip":
+			result["hash_on"], result["key"] = "vars", "remote_addr"
+		case "header":
+			result["hash_on"], result["key"] = "header", fieldString(upstream, "hash_on_header")
+		case "cookie":
+			result["hash_on"], result["key"] = "cookie", fieldString(upstream, "hash_on_cookie")
+		case "consumer":
+			result["hash_on"] = "consumer"
+		default:
+			result["type"] = "roundrobin"
+			report.add("upstreams", id, "hash_on %s is not supported, roundrobin is used", hashOn)
+		}
+	}
+	active := fieldMap(fieldMap(upstream, "healthchecks"), "active")
+	healthy, _ := fieldNumber(fieldMap(active, "healthy"), "interval")
+	unhealthy, _ := fieldNumber(fieldMap(active, "unhealthy"), "interval")
+	if healthy > 0 || unhealthy > 0 {
+		report.add("upstreams", id, "active health checks are not translated")
+	}
+	return result
+}
+
+// kongRouteToApisix prefix paths are translated to uris with *, strip_path and service path by proxy-rewrite
+func kongRouteToApisix(route map[string]interface{}, services map[string]map[string]interface{},
+	routePlugins map[string]map[string]interface{}, legacy bool, report *migrateReport) map[string]interface{} {
+	id := fieldString(route, "id")
+	serviceId := kongForeignId(route, "service")
+	service, ok := services[serviceId]
+	if !ok {
+		report.add("routes", id, "route without a translated service is not supported")
+		return nil
+	}
+	for _, protocol := range fieldStrings(route, "protocols") {
+		if !slices.Contains(httpProtocols, protocol) {
+			report.add("routes", id, "protocol %s is not supported", protocol)
+			return nil
+		}
+	}
+	for _, key := range []string{"headers", "snis", "sources", "destinations"} {
+		if !fieldEmpty(route, key) {
+			report.add("routes", id, "%s is not supported", key)
+			return nil
+		}
+	}
+	paths := fieldStrings(route, "paths")
+	uris := []string{}
+	for _, path := range paths {
+		if strings.HasPrefix(path, "~") || (legacy && kongRegexPathRE.MatchString(path)) {
+			report.add("routes", id, "regex path %s is not supported", path)
+			return nil
+		}
+		uris = append(uris, path+"*")
+	}
+	if len(uris) == 0 {
+		uris = []string{"/*"}
+	}
+	result := map[string]interface{}{
+		"id":         id,
+		"uris":       uris,
+		"service_id": serviceId,
+		"desc":       "migrated from kong route " + id,
+	}
+	if name := fieldString(route, "name"); len(name) > 0 {
+		result["name"] = name
+	}
+	if hosts := fieldStrings(route, "hosts"); len(hosts) > 0 {
+		result["hosts"] = hosts
+	}
+	if methods := fieldStrings(route, "methods"); len(methods) > 0 {
+		result["methods"] = methods
+	}
+	plugins := map[string]interface{}{}
+	for name, conf := range routePlugins[id] {
+		plugins[name] = conf
+	}
+	servicePath := strings.TrimSuffix(fieldString(service, "path"), "/")
+	if len(paths) > 0 && fieldBool(route, "strip_path", true) {
+		prefixes := []string{}
+		for _, path := range paths {
+			prefixes = append(prefixes, regexp.QuoteMeta(strings.TrimSuffix(path, "/")))
+		}
+		if len(servicePath) == 0 {
+			plugins["proxy-rewrite"] = map[string]interface{}{
+				"regex_uri": []string{"^(?:" + strings.Join(prefixes, "|") + ")/?(.*)", "/$1"}}
+		} else {
+			plugins["proxy-rewrite"] = map[string]interface{}{
+				"regex_uri": []string{"^(?:" + strings.Join(prefixes, "|") + ")(.*)", servicePath + "$1"}}
+		}
+	} else if len(servicePath) > 0 {
+		plugins["proxy-rewrite"] = map[string]interface{}{"regex_uri": []string{"^(.*)", servicePath + "$1"}}
+	}
+	if len(plugins) > 0 {
+		result["plugins"] = plugins
+	}
+	if fieldBool(route, "preserve_host", false) {
+		report.add("routes", id, "preserve_host is not translated, host of upstream is used")
+	}
+	return result
+}
+
+// kongPluginToApisix translate common plugin, conf is nil if not supported, notes are added to report
+func kongPluginToApisix(plugin map[string]interface{}, version model.ApisixAdminApiVersion) (string,
+	map[string]interface{}, []string) {
+	name := fieldString(plugin, "name")
+	config := fieldMap(plugin, "config")
+	conf := map[string]interface{}{}
+	notes := []string{}
+	switch name {
+	case "rate-limiting":
+		name = "limit-count"
+		for _, window := range kongRateLimitWindows {
+			count, ok := fieldNumber(config, window.Key)
+			if !ok {
+				continue
+			}
+			if _, ok = conf["count"]; ok {
+				notes = append(notes, fmt.Sprintf("only the smallest window is translated, %s is dropped",
+					window.Key))
+				continue
+			}
+			conf["count"], conf["time_window"] = int(count), window.Seconds
+		}
+		for _, key := range []string{"month", "year"} {
+			if _, ok := fieldNumber(config, key); ok {
+				notes = append(notes, fmt.Sprintf("window %s is not supported", key))
+			}
+		}
+		if _, ok := conf["count"]; !ok {
+			return name, nil, notes
+		}
+		switch limitBy := kongDefaultString(fieldString(config, "limit_by"), "consumer"); limitBy {
+		case "ip":
+			conf["key_type"], conf["key"] = "var", "remote_addr"
+		case "consumer", "credential":
+			conf["key_type"], conf["key"] = "var", "consumer_name"
+		case "header":
+			header := strings.ToLower(strings.ReplaceAll(fieldString(config, "header_name"), "-", "_"))
+			conf["key_type"], conf["key"] = "var", "http_"+header
+		case "service":
+			conf["key_type"], conf["key"] = "constant", "service"
+		default:
+			notes = append(notes, fmt.Sprintf("limit_by %s is not supported", limitBy))
+			return name, nil, notes
+		}
+		conf["rejected_code"] = http.StatusTooManyRequests
+		conf["allow_degradation"] = fieldBool(config, "fault_tolerant", true)
+		conf["show_limit_quota_header"] = !fieldBool(config, "hide_client_headers", false)
+		switch policy := kongDefaultString(fieldString(config, "policy"), "local"); policy {
+		case "local":
+			conf["policy"] = "local"
+		case "cluster":
+			conf["policy"] = "local"
+			notes = append(notes, "policy cluster is translated to local")
+		case "redis":
+			// redis fields are nested since kong 3.6
+			redis := fieldMap(config, "redis")
+			for _, key := range []string{"host", "port", "password", "database", "timeout"} {
+				value, ok := config["redis_"+key]
+				if nested, nestedOk := redis[key]; nestedOk && nested != nil {
+					value, ok = nested, true
+				}
+				if !ok || value == nil {
+					continue
+				}
+				conf["redis_"+key] = value
+			}
+			conf["policy"] = "redis"
+		}
+	case "cors":
+		origins, regexOrigins := []string{}, []string{}
+		for _, origin := range fieldStrings(config, "origins") {
+			if origin == "*" || !kongCorsRegexRE.MatchString(origin) {
+				origins = append(origins, origin)
+			} else {
+				regexOrigins = append(regexOrigins, origin)
+			}
+		}
+		if len(origins) > 0 {
+			conf["allow_origins"] = strings.Join(origins, ",")
+		} else if len(regexOrigins) == 0 {
+			conf["allow_origins"] = "*"
+		}
+		if len(regexOrigins) > 0 {
+			conf["allow_origins_by_regex"] = regexOrigins
+		}
+		conf["allow_methods"] = kongDefaultString(strings.Join(fieldStrings(config, "methods"), ","), "*")
+		conf["allow_headers"] = kongDefaultString(strings.Join(fieldStrings(config, "headers"), ","), "*")
+		if exposed := fieldStrings(config, "exposed_headers"); len(exposed) > 0 {
+			conf["expose_headers"] = strings.Join(exposed, ",")
+		}
+		if maxAge, ok := fieldNumber(config, "max_age"); ok {
+			conf["max_age"] = int(maxAge)
+		}
+		credentials := fieldBool(config, "credentials", false)
+		// apisix rejects credentials with wildcard origins
+		if credentials && conf["allow_origins"] == "*" {
+			credentials = false
+			notes = append(notes, "credentials with wildcard origins is not supported, credentials is disabled")
+		}
+		// apisix rejects * of methods, headers and expose_headers(default is *) with credentials, ** allows all
+		if credentials {
+			for _, key := range []string{"allow_methods", "allow_headers", "expose_headers"} {
+				if value, ok := conf[key]; !ok || value == "*" {
+					conf[key] = "**"
+				}
+			}
+		}
+		conf["allow_credential"] = credentials
+	case "ip-restriction":
+		allow := append(fieldStrings(config, "allow"), fieldStrings(config, "whitelist")...)
+		deny := append(fieldStrings(config, "deny"), fieldStrings(config, "blacklist")...)
+		switch {
+		case len(allow) > 0:
+			conf["whitelist"] = allow
+			if len(deny) > 0 {
+				notes = append(notes, "apisix supports either allow or deny, deny is dropped")
+			}
+		case len(deny) > 0:
+			conf["blacklist"] = deny
+		default:
+			notes = append(notes, "neither allow nor deny is set")
+			return name, nil, notes
+		}
+		if message := fieldString(config, "message"); len(message) > 0 {
+			conf["message"] = message
+		}
+	case "key-auth":
+		keyNames := fieldStrings(config, "key_names")
+		keyName := "apikey"
+		if len(keyNames) > 0 {
+			keyName = keyNames[0]
+		}
+		if len(keyNames) > 1 {
+			notes = append(notes, fmt.Sprintf("only key name %s is translated", keyName))
+		}
+		conf["header"], conf["query"] = keyName, keyName
+		conf["hide_credentials"] = fieldBool(config, "hide_credentials", false)
+	case "basic-auth":
+		conf["hide_credentials"] = fieldBool(config, "hide_credentials", false)
+	default:
+		notes = append(notes, "plugin is not supported")
+		return name, nil, notes
+	}
+	if !fieldBool(plugin, "enabled", true) {
+		if version == model.APISIX_V3 {
+			conf["_meta"] = map[string]interface{}{"disable": true}
+		} else {
+			conf["disable"] = true
+		}
+	}
+	return name, conf, notes
+}
+
+// kongCorsRegexRE kong origins are regex when containing characters other than these
+var kongCorsRegexRE = regexp.MustCompile(`[^a-zA-Z0-9.:/_-]`)
+
+// putEntity create or update apisix entity by id, error is added to report
+func (apisixClient *ApisixClient) putEntity(uri string, value map[string]interface{}, report *migrateReport) {
+	reqBody, _ := json.Marshal(value)
+	respBody, url, err := apisixClient.httpDoRaw(uri, "PUT", bytes.NewReader(reqBody))
+	if err == nil {
+		resp := struct {
+			ErrorMsg string `json:"error_msg"`
+		}{}
+		if json.Unmarshal(respBody, &resp) == nil && len(resp.ErrorMsg) > 0 {
+			err = errors.New(resp.ErrorMsg)
+		}
+	}
+	if err != nil {
+		apisixClient.Logger.Errorf("[migrate]create target apisix info error,url:%s,err:%s", url, err.Error())
+		kind, id, _ := strings.Cut(uri, "/")
+		report.add(kind, kongDefaultString(id, fieldString(value, "username")), "%s", err)
+		return
+	}
+	apisixClient.Logger.Infof("[migrate]save or update target apisix info,url:%s, %s", url, respBody)
+}
+
+// kongService fields of kong service translated from apisix upstream
+type kongService struct {
+	Id           string
+	Fields       map[string]interface{}
+	PreserveHost bool
+	Protocol     string
+}
+
+// apisixKongMigration kong entities translated from apisix, in dependency order
+type apisixKongMigration struct {
+	legacy      bool
+	report      migrateReport
+	names       map[string]map[string]bool
+	upstreams   []map[string]interface{}
+	targets     []map[string]interface{}
+	services    []map[string]interface{}
+	routes      []map[string]interface{}
+	consumers   []map[string]interface{}
+	credentials []kongCredential
+	plugins     []map[string]interface{}
+}
+
+// kongCredential credential by uri of consumer
+type kongCredential struct {
+	Uri   string
+	Value map[string]interface{}
+}
+
+// migrateToKong translate apisix entities into kong, ids are hashed to uuid if not uuid
+func (apisixClient *ApisixClient) migrateToKong(target *KongClient) error {
+	version, err := target.getVersion()
+	if err != nil {
+		return err
+	}
+	values := map[string][]map[string]interface{}{}
+	for _, uri := range []string{"upstreams", "services", "routes", "consumers", "global_rules"} {
+		if values[uri], err = apisixClient.fetchInfoFromApisix(uri); err != nil {
+			return err
+		}
+	}
+	migration := &apisixKongMigration{legacy: isLegacyKong(version), names: map[string]map[string]bool{}}
+	for _, uri := range []string{"plugin_configs", "consumer_groups", "stream_routes", "ssl", "ssls"} {
+		field := model.ApisixUris[uri]
+		if !slices.Contains(field.Version, apisixClient.ApiVersion) {
+			continue
+		}
+		nodes, err := apisixClient.fetchInfoFromApisix(uri)
+		if err != nil {
+			continue
+		}
+		for _, value := range nodes {
+			migration.report.add(uri, fieldString(value, "id"), "is not supported")
+		}
+	}
+
+	upstreams := map[string]*kongService{}
+	for _, value := range values["upstreams"] {
+		id := fieldString(value, "id")
+		if service := migration.addUpstream("upstreams", id, value); service != nil {
+			upstreams[id] = service
+		}
+	}
+	services := map[string]*kongService{}
+	servicePlugins := map[string]map[string]interface{}{}
+	for _, value := range values["services"] {
+		id := fieldString(value, "id")
+		backend := upstreams[fieldString(value, "upstream_id")]
+		if upstream := fieldMap(value, "upstream"); len(upstream) > 0 {
+			backend = migration.addUpstream("services", id, upstream)
+		}
+		if backend == nil {
+			migration.report.add("services", id, "service without a translated upstream is not supported")
+			continue
+		}
+		servicePlugins[id] = fieldMap(value, "plugins")
+		services[id] = migration.addService("services", id, fieldString(value, "name"), backend)
+		migration.addPlugins("services", id, fieldMap(value, "plugins"), map[string]interface{}{
+			"service": map[string]interface{}{"id": services[id].Id}})
+	}
+	for _, value := range values["routes"] {
+		migration.addRoute(value, upstreams, services, servicePlugins)
+	}
+	for _, value := range values["consumers"] {
+		migration.addConsumer(value)
+	}
+	for _, value := range values["global_rules"] {
+		migration.addPlugins("global_rules", fieldString(value, "id"), fieldMap(value, "plugins"),
+			map[string]interface{}{})
+	}
+
+	// upstreams before targets, services before routes, consumers before credentials, plugins last
+	for _, value := range migration.upstreams {
+		target.upsertEntity("upstreams/"+value["id"].(string), value, &migration.report)
+	}
+	for _, value := range migration.targets {
+		target.upsertEntity(fmt.Sprintf("upstreams/%s/targets/%s", kongForeignId(value, "upstream"), value["id"]),
+			value, &migration.report)
+	}
+	for _, value := range migration.services {
+		target.upsertEntity("services/"+value["id"].(string), value, &migration.report)
+	}
+	for _, value := range migration.routes {
+		target.upsertEntity("routes/"+value["id"].(string), value, &migration.report)
+	}
+	for _, value := range migration.consumers {
+		target.upsertEntity("consumers/"+value["id"].(string), value, &migration.report)
+	}
+	for _, credential := range migration.credentials {
+		target.upsertEntity(credential.Uri, credential.Value, &migration.report)
+	}
+	for _, value := range migration.plugins {
+		target.upsertEntity("plugins/"+value["id"].(string), value, &migration.report)
+	}
+	return migration.report.toError("apisix", "kong")
+}
+
+// addUpstream kong upstream with nodes as targets, returns fields of service proxying to it
+func (migration *apisixKongMigration) addUpstream(kind string, id string,
+	upstream map[string]interface{}) *kongService {
+	if len(fieldString(upstream, "service_name")) > 0 || len(fieldString(upstream, "discovery_type")) > 0 {
+		migration.report.add(kind, id, "upstream of service discovery is not supported")
+		return nil
+	}
+	protocol := kongDefaultString(fieldString(upstream, "scheme"), "http")
+	if !slices.Contains(httpProtocols, protocol) {
+		migration.report.add(kind, id, "scheme %s is not supported", protocol)
+		return nil
+	}
+	name := kongHostNameRE.ReplaceAllString(strings.ToLower(kongDefaultString(fieldString(upstream, "name"),
+		kind+"-"+id)), "-")
+	upstreamId := kongUuid(kind+"/upstream", id)
+	result := map[string]interface{}{
+		"id":        upstreamId,
+		"name":      migration.uniqueName("upstreams", strings.Trim(name, "-."), upstreamId),
+		"algorithm": "round-robin",
+		"tags":      []string{"apisix-" + strings.TrimSuffix(kind, "s") + "-" + id},
+	}
+	switch upstreamType := fieldString(upstream, "type"); upstreamType {
+	case "", "roundrobin":
+	case "least_conn":
+		result["algorithm"] = "least-connections"
+	case "ewma":
+		result["algorithm"] = "latency"
+	case "chash":
+		result["algorithm"] = "consistent-hashing"
+		key := fieldString(upstream, "key")
+		switch hashOn := kongDefaultString(fieldString(upstream, "hash_on"), "vars"); {
+		case hashOn == "vars" && key == "remote_addr":
+			result["hash_on"] = "ip"
+		case hashOn == "header":
+			result["hash_on"], result["hash_on_header"] = "header", key
+		case hashOn == "cookie":
+			result["hash_on"], result["hash_on_cookie"] = "cookie", key
+		case hashOn == "consumer":
+			result["hash_on"] = "consumer"
+		default:
+			result["algorithm"] = "round-robin"
+			migration.report.add(kind, id, "hash_on %s with key %s is not supported, round-robin is used",
+				hashOn, key)
+		}
+	default:
+		migration.report.add(kind, id, "type %s is not supported, round-robin is used", upstreamType)
+	}
+	if fieldString(upstream, "pass_host") == "rewrite" {
+		result["host_header"] = fieldString(upstream, "upstream_host")
+	}
+	if len(fieldMap(upstream, "checks")) > 0 {
+		migration.report.add(kind, id, "health checks are not translated")
+	}
+	migration.upstreams = append(migration.upstreams, result)
+
+	nodes, _ := upstream["nodes"].([]interface{})
+	for _, item := range nodes {
+		node, _ := item.(map[string]interface{})
+		port, ok := fieldNumber(node, "port")
+		if !ok {
+			port = 80
+			if protocol == "https" || protocol == "grpcs" {
+				port = 443
+			}
+		}
+		weight, ok := fieldNumber(node, "weight")
+		if !ok {
+			weight = 1
+		}
+		address := net.JoinHostPort(fieldString(node, "host"), strconv.Itoa(int(port)))
+		migration.targets = append(migration.targets, map[string]interface{}{
+			"id":       kongUuid(kind+"/target", id+"/"+address),
+			"target":   address,
+			"weight":   int(weight),
+			"upstream": map[string]interface{}{"id": upstreamId},
+		})
+	}
+
+	fields := map[string]interface{}{"host": result["name"], "protocol": protocol}
+	for apisixKey, kongKey := range map[string]string{"connect": "connect_timeout", "send": "write_timeout",
+		"read": "read_timeout"} {
+		if seconds, ok := fieldNumber(fieldMap(upstream, "timeout"), apisixKey); ok {
+			fields[kongKey] = int(seconds * 1000)
+		}
+	}
+	if retries, ok := fieldNumber(upstream, "retries"); ok {
+		fields["retries"] = int(retries)
+	}
+	// pass_host of apisix is pass by default, kong sends upstream host unless preserve_host
+	passHost := kongDefaultString(fieldString(upstream, "pass_host"), "pass")
+	return &kongService{Fields: fields, PreserveHost: passHost == "pass", Protocol: protocol}
+}
+
+// addService kong service proxying to translated upstream
+func (migration *apisixKongMigration) addService(kind string, id string, name string,
+	backend *kongService) *kongService {
+	serviceId := kongUuid(kind+"/service", id)
+	name = kongNameRE.ReplaceAllString(kongDefaultString(name, "apisix-"+strings.TrimSuffix(kind, "s")+"-"+id),
+		"-")
+	service := map[string]interface{}{
+		"id":   serviceId,
+		"name": migration.uniqueName("services", name, serviceId),
+		"tags": []string{"apisix-" + strings.TrimSuffix(kind, "s") + "-" + id},
+	}
+	for key, value := range backend.Fields {
+		service[key] = value
+	}
+	migration.services = append(migration.services, service)
+	return &kongService{Id: serviceId, Fields: backend.Fields, PreserveHost: backend.PreserveHost,
+		Protocol: backend.Protocol}
+}
+
+// addRoute kong route of apisix route, route with its own upstream gets a dedicated service
+func (migration *apisixKongMigration) addRoute(value map[string]interface{}, upstreams map[string]*kongService,
+	services map[string]*kongService, servicePlugins map[string]map[string]interface{}) {
+	id := fieldString(value, "id")
+	for _, key := range []string{"vars", "remote_addr", "remote_addrs", "filter_func", "script",
+		"plugin_config_id"} {
+		if !fieldEmpty(value, key) {
+			migration.report.add("routes", id, "%s is not supported", key)
+			return
+		}
+	}
+	paths := []string{}
+	for _, uri := range append(fieldStrings(value, "uris"), fieldString(value, "uri")) {
+		if len(uri) == 0 {
+			continue
+		}
+		if strings.Contains(uri, ":") {
+			migration.report.add("routes", id, "parameterized uri %s is not supported", uri)
+			return
+		}
+		if strings.HasSuffix(uri, "*") {
+			paths = append(paths, kongDefaultString(strings.TrimSuffix(uri, "*"), "/"))
+		} else if migration.legacy {
+			paths = append(paths, regexp.QuoteMeta(uri)+"$")
+		} else {
+			paths = append(paths, "~"+regexp.QuoteMeta(uri)+"$")
+		}
+	}
+	hosts := fieldStrings(value, "hosts")
+	if host := fieldString(value, "host"); len(host) > 0 {
+		hosts = append(hosts, host)
+	}
+	if len(paths) == 0 && len(hosts) == 0 && len(fieldStrings(value, "methods")) == 0 {
+		paths = append(paths, "/")
+	}
+
+	serviceId := fieldString(value, "service_id")
+	plugins := map[string]interface{}{}
+	var backend *kongService
+	if upstreamId := fieldString(value, "upstream_id"); len(upstreamId) > 0 || len(fieldMap(value, "upstream")) > 0 {
+		backend = upstreams[upstreamId]
+		if upstream := fieldMap(value, "upstream"); len(upstream) > 0 {
+			backend = migration.addUpstream("routes", id, upstream)
+		}
+		if backend != nil {
+			backend = migration.addService("routes", id, fieldString(value, "name"), backend)
+		}
+		// plugins of apisix service still apply to the route
+		for name, conf := range servicePlugins[serviceId] {
+			plugins[name] = conf
+		}
+	} else {
+		backend = services[serviceId]
+	}
+	if backend == nil {
+		migration.report.add("routes", id, "route without a translated upstream or service is not supported")
+		return
+	}
+	for name, conf := range fieldMap(value, "plugins") {
+		plugins[name] = conf
+	}
+	if _, ok := plugins["proxy-rewrite"]; ok {
+		migration.report.add("routes", id, "proxy-rewrite is not translated")
+		delete(plugins, "proxy-rewrite")
+	}
+
+	routeId := kongUuid("routes", id)
+	name := kongNameRE.ReplaceAllString(kongDefaultString(fieldString(value, "name"), "apisix-route-"+id), "-")
+	route := map[string]interface{}{
+		"id":            routeId,
+		"name":          migration.uniqueName("routes", name, routeId),
+		"strip_path":    false,
+		"preserve_host": backend.PreserveHost,
+		"service":       map[string]interface{}{"id": backend.Id},
+		"tags":          []string{"apisix-route-" + id},
+	}
+	if strings.HasPrefix(backend.Protocol, "grpc") {
+		route["protocols"] = []string{"grpc", "grpcs"}
+	}
+	if len(paths) > 0 {
+		route["paths"] = paths
+	}
+	if len(hosts) > 0 {
+		route["hosts"] = hosts
+	}
+	if methods := fieldStrings(value, "methods"); len(methods) > 0 {
+		route["methods"] = methods
+	}
+	migration.routes = append(migration.routes, route)
+	migration.addPlugins("routes", id, plugins, map[string]interface{}{"route": map[string]interface{}{
+		"id": routeId}})
+}
+
+// addConsumer kong consumer, key-auth and basic-auth become credentials, other plugins are consumer scoped
+func (migration *apisixKongMigration) addConsumer(value map[string]interface{}) {
+	username := fieldString(value, "username")
+	if len(fieldString(value, "group_id")) > 0 {
+		migration.report.add("consumers", username, "group_id is not supported")
+	}
+	consumerId := kongUuid("consumers", username)
+	migration.consumers = append(migration.consumers, map[string]interface{}{
+		"id":       consumerId,
+		"username": username,
+		"tags":     []string{"apisix-consumer"},
+	})
+	plugins := map[string]interface{}{}
+	for name, conf := range fieldMap(value, "plugins") {
+		plugin, _ := conf.(map[string]interface{})
+		switch name {
+		case "key-auth":
+			migration.credentials = append(migration.credentials, kongCredential{
+				Uri:   fmt.Sprintf("consumers/%s/key-auth/%s", consumerId, kongUuid("consumers/key-auth", username)),
+				Value: map[string]interface{}{"key": fieldString(plugin, "key")}})
+		case "basic-auth":
+			migration.credentials = append(migration.credentials, kongCredential{
+				Uri: fmt.Sprintf("consumers/%s/basic-auth/%s", consumerId, kongUuid("consumers/basic-auth", username)),
+				Value: map[string]interface{}{"username": fieldString(plugin, "username"),
+					"password": fieldString(plugin, "password")}})
+		default:
+			plugins[name] = conf
+		}
+	}
+	migration.addPlugins("consumers", username, plugins, map[string]interface{}{
+		"consumer": map[string]interface{}{"id": consumerId}})
+}
+
+// addPlugins kong plugins of apisix plugins, scoped by scope fields
+func (migration *apisixKongMigration) addPlugins(kind string, id string, plugins map[string]interface{},
+	scope map[string]interface{}) {
+	names := []string{}
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		conf, _ := plugins[name].(map[string]interface{})
+		kongName, config, notes := apisixPluginToKong(name, conf, migration.legacy)
+		for _, note := range notes {
+			migration.report.add(kind, id, "%s: %s", name, note)
+		}
+		if config == nil {
+			continue
+		}
+		disable := fieldBool(conf, "disable", false) || fieldBool(fieldMap(conf, "_meta"), "disable", false)
+		plugin := map[string]interface{}{
+			"id":      kongUuid(kind+"/plugin", id+"/"+name),
+			"name":    kongName,
+			"config":  config,
+			"enabled": !disable,
+		}
+		for key, value := range scope {
+			plugin[key] = value
+		}
+		migration.plugins = append(migration.plugins, plugin)
+	}
+}
+
+// uniqueName kong names are unique by entity, suffixed by id if duplicated
+func (migration *apisixKongMigration) uniqueName(kind string, name string, id string) string {
+	if migration.names[kind] == nil {
+		migration.names[kind] = map[string]bool{}
+	}
+	if migration.names[kind][name] {
+		name = name + "-" + id[:8]
+	}
+	migration.names[kind][name] = true
+	return name
+}
+
+// apisixPluginToKong translate common plugin, config is nil if not supported, notes are added to report
+func apisixPluginToKong(name string, conf map[string]interface{}, legacy bool) (string,
+	map[string]interface{}, []string) {
+	config := map[string]interface{}{}
+	notes := []string{}
+	switch name {
+	case "limit-count":
+		name = "rate-limiting"
+		count, _ := fieldNumber(conf, "count")
+		timeWindow, _ := fieldNumber(conf, "time_window")
+		for _, window := range kongRateLimitWindows {
+			if float64(window.Seconds) == timeWindow {
+				config[window.Key] = int(count)
+			}
+		}
+		if len(config) == 0 {
+			notes = append(notes, fmt.Sprintf("time_window %v is not supported", timeWindow))
+			return name, nil, notes
+		}
+		key := kongDefaultString(fieldString(conf, "key"), "remote_addr")
+		switch keyType := kongDefaultString(fieldString(conf, "key_type"), "var"); {
+		case keyType == "constant":
+			config["limit_by"] = "service"
+		case keyType == "var" && key == "remote_addr":
+			config["limit_by"] = "ip"
+		case keyType == "var" && key == "consumer_name":
+			config["limit_by"] = "consumer"
+		case keyType == "var" && strings.HasPrefix(key, "http_"):
+			config["limit_by"] = "header"
+			config["header_name"] = strings.ReplaceAll(strings.TrimPrefix(key, "http_"), "_", "-")
+		default:
+			notes = append(notes, fmt.Sprintf("key_type %s with key %s is not supported", keyType, key))
+			return name, nil, notes
+		}
+		switch policy := kongDefaultString(fieldString(conf, "policy"), "local"); policy {
+		case "local":
+			config["policy"] = "local"
+		case "redis":
+			config["policy"] = "redis"
+			for _, key := range []string{"host", "port", "password", "database", "timeout"} {
+				if value, ok := conf["redis_"+key]; ok {
+					config["redis_"+key] = value
+				}
+			}
+		default:
+			notes = append(notes, fmt.Sprintf("policy %s is not supported", policy))
+			return name, nil, notes
+		}
+		config["fault_tolerant"] = fieldBool(conf, "allow_degradation", false)
+		config["hide_client_headers"] = !fieldBool(conf, "show_limit_quota_header", true)
+	case "cors":
+		// kong origins are regex when not plain origins
+		origins := fieldStrings(conf, "allow_origins_by_regex")
+		switch allowOrigins := fieldString(conf, "allow_origins"); {
+		case allowOrigins == "*" || allowOrigins == "**" || (len(allowOrigins) == 0 && len(origins) == 0):
+			origins = append(origins, "*")
+		case len(allowOrigins) > 0:
+			origins = append(origins, strings.Split(allowOrigins, ",")...)
+		}
+		config["origins"] = origins
+		for apisixKey, kongKey := range map[string]string{"allow_methods": "methods", "allow_headers": "headers",
+			"expose_headers": "exposed_headers"} {
+			// kong allows all methods and headers when not set
+			if value := fieldString(conf, apisixKey); len(value) > 0 && value != "*" && value != "**" {
+				config[kongKey] = strings.Split(value, ",")
+			}
+		}
+		if maxAge, ok := fieldNumber(conf, "max_age"); ok {
+			config["max_age"] = int(maxAge)
+		}
+		config["credentials"] = fieldBool(conf, "allow_credential", false)
+	case "ip-restriction":
+		// whitelist and blacklist of kong are replaced by allow and deny since 2.1
+		if whitelist := fieldStrings(conf, "whitelist"); len(whitelist) > 0 {
+			config["allow"] = whitelist
+		}
+		if blacklist := fieldStrings(conf, "blacklist"); len(blacklist) > 0 {
+			config["deny"] = blacklist
+		}
+		if message := fieldString(conf, "message"); len(message) > 0 && !legacy {
+			config["message"] = message
+		}
+	case "key-auth":
+		header := kongDefaultString(fieldString(conf, "header"), "apikey")
+		keyNames := []string{header}
+		if query := kongDefaultString(fieldString(conf, "query"), "apikey"); query != header {
+			keyNames = append(keyNames, query)
+		}
+		config["key_names"] = keyNames
+		config["hide_credentials"] = fieldBool(conf, "hide_credentials", false)
+	case "basic-auth":
+		config["hide_credentials"] = fieldBool(conf, "hide_credentials", false)
+	default:
+		notes = append(notes, "plugin is not supported")
+		return name, nil, notes
+	}
+	return name, config, notes
+}
+
+// kongUuid ids of kong are uuid, other ids and entities derived from another entity (kind with /)
+// are hashed to the same uuid on every migration
+func kongUuid(kind string, id string) string {
+	if kongUuidRE.MatchString(id) && !strings.Contains(kind, "/") {
+		return id
+	}
+	sum := md5.Sum([]byte(kind + "/" + id))
+	// version 3 uuid
+	sum[6] = (sum[6] & 0x0f) | 0x30
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+func kongAddPlugin(plugins map[string]map[string]interface{}, id string, name string, conf map[string]interface{}) {
+	if plugins[id] == nil {
+		plugins[id] = map[string]interface{}{}
+	}
+	plugins[id][name] = conf
+}
+
+// kongForeignId id of foreign key like {"id": "..."}
+func kongForeignId(value map[string]interface{}, key string) string {
+	return fieldString(fieldMap(value, key), "id")
+}
+
+func kongDefaultString(value string, defaultValue string) string {
+	if len(value) == 0 {
+		return defaultValue
+	}
+	return value
+}
+
+func fieldString(value map[string]interface{}, key string) string {
+	s, _ := value[key].(string)
+	return s
+}
+
+func fieldStrings(value map[string]interface{}, key string) []string {
+	items, _ := value[key].([]interface{})
+	result := []string{}
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func fieldNumber(value map[string]interface{}, key string) (float64, bool) {
+	switch n := value[key].(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func fieldEmpty(value map[string]interface{}, key string) bool {
+	switch v := value[key].(type) {
+	case nil:
+		return true
+	case string:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+func fieldBool(value map[string]interface{}, key string, defaultValue bool) bool {
+	if b, ok := value[key].(bool); ok {
+		return b
+	}
+	return defaultValue
+}
+
+func fieldMap(value map[string]interface{}, key string) map[string]interface{} {
+	m, _ := value[key].(map[string]interface{})
+	return m
+}
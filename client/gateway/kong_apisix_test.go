@@ -0,0 +1,477 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// decodeJson entities of admin api are decoded into interface{}, numbers are float64
+func decodeJson(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+	if len(s) == 0 {
+		return nil
+	}
+	value := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(s), &value); err != nil {
+		t.Fatalf("invalid json:%s, err:%s", s, err)
+	}
+	return value
+}
+
+// assertJson compare by json, keys of maps are sorted
+func assertJson(t *testing.T, got interface{}, want string) {
+	t.Helper()
+	gotBytes, _ := json.Marshal(got)
+	var wantValue interface{}
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		t.Fatalf("invalid json:%s, err:%s", want, err)
+	}
+	wantBytes, _ := json.Marshal(wantValue)
+	if string(gotBytes) != string(wantBytes) {
+		t.Errorf("got %s, want %s", gotBytes, wantBytes)
+	}
+}
+
+func TestKongRouteToApisix(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   string
+		service string
+		legacy  bool
+		want    string
+		notes   int
+	}{
+		{
+			name:    "strip path without service path",
+			route:   `{"id":"r1","service":{"id":"s1"},"paths":["/api/"],"methods":["GET"],"hosts":["a.com"]}`,
+			service: `{"id":"s1"}`,
+			want: `{"id":"r1","uris":["/api/*"],"service_id":"s1","desc":"migrated from kong route r1",
+				"hosts":["a.com"],"methods":["GET"],
+				"plugins":{"proxy-rewrite":{"regex_uri":["^(?:/api)/?(.*)","/$1"]}}}`,
+		},
+		{
+			name:    "strip path with service path",
+			route:   `{"id":"r1","service":{"id":"s1"},"paths":["/api","/a.b"],"strip_path":true}`,
+			service: `{"id":"s1","path":"/v1/"}`,
+			want: `{"id":"r1","uris":["/api*","/a.b*"],"service_id":"s1","desc":"migrated from kong route r1",
+				"plugins":{"proxy-rewrite":{"regex_uri":["^(?:/api|/a\\.b)(.*)","/v1$1"]}}}`,
+		},
+		{
+			name:    "service path without strip path",
+			route:   `{"id":"r1","name":"orders","service":{"id":"s1"},"paths":["/api"],"strip_path":false}`,
+			service: `{"id":"s1","path":"/v1"}`,
+			want: `{"id":"r1","name":"orders","uris":["/api*"],"service_id":"s1","desc":"migrated from kong route r1",
+				"plugins":{"proxy-rewrite":{"regex_uri":["^(.*)","/v1$1"]}}}`,
+		},
+		{
+			name:    "no paths",
+			route:   `{"id":"r1","service":{"id":"s1"},"paths":null,"hosts":["a.com"]}`,
+			service: `{"id":"s1","path":null}`,
+			want:    `{"id":"r1","uris":["/*"],"service_id":"s1","desc":"migrated from kong route r1","hosts":["a.com"]}`,
+		},
+		{
+			name:    "regex path",
+			route:   `{"id":"r1","service":{"id":"s1"},"paths":["~/api/\\d+"]}`,
+			service: `{"id":"s1"}`,
+			notes:   1,
+		},
+		{
+			name:    "legacy regex path",
+			route:   `{"id":"r1","service":{"id":"s1"},"paths":["/api/\\d+"]}`,
+			service: `{"id":"s1"}`,
+			legacy:  true,
+			notes:   1,
+		},
+		{
+			name:    "headers",
+			route:   `{"id":"r1","service":{"id":"s1"},"paths":["/api"],"headers":{"x-version":["1"]}}`,
+			service: `{"id":"s1"}`,
+			notes:   1,
+		},
+		{
+			name:    "tcp protocol",
+			route:   `{"id":"r1","service":{"id":"s1"},"protocols":["tcp"]}`,
+			service: `{"id":"s1"}`,
+			notes:   1,
+		},
+		{
+			name:    "service not translated",
+			route:   `{"id":"r1","service":{"id":"s2"},"paths":["/api"]}`,
+			service: `{"id":"s1"}`,
+			notes:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := migrateReport{}
+			services := map[string]map[string]interface{}{"s1": decodeJson(t, tt.service)}
+			route := kongRouteToApisix(decodeJson(t, tt.route), services, map[string]map[string]interface{}{},
+				tt.legacy, &report)
+			if len(tt.want) == 0 {
+				if route != nil {
+					t.Errorf("route got %#v, want nil", route)
+				}
+			} else {
+				assertJson(t, route, tt.want)
+			}
+			if len(report) != tt.notes {
+				t.Errorf("report got %v, want %d notes", report, tt.notes)
+			}
+		})
+	}
+}
+
+func TestKongPluginToApisix(t *testing.T) {
+	tests := []struct {
+		name     string
+		plugin   string
+		version  model.ApisixAdminApiVersion
+		wantName string
+		want     string
+		notes    int
+	}{
+		{
+			name:     "rate limiting by ip",
+			plugin:   `{"name":"rate-limiting","config":{"minute":10,"limit_by":"ip","policy":"local"}}`,
+			wantName: "limit-count",
+			want: `{"count":10,"time_window":60,"key_type":"var","key":"remote_addr","rejected_code":429,
+				"allow_degradation":true,"show_limit_quota_header":true,"policy":"local"}`,
+		},
+		{
+			name: "rate limiting smallest window",
+			plugin: `{"name":"rate-limiting","config":{"second":5,"hour":1000,"month":100000,"limit_by":"header",
+				"header_name":"X-Api-Key","policy":"cluster","hide_client_headers":true}}`,
+			wantName: "limit-count",
+			want: `{"count":5,"time_window":1,"key_type":"var","key":"http_x_api_key","rejected_code":429,
+				"allow_degradation":true,"show_limit_quota_header":false,"policy":"local"}`,
+			notes: 3,
+		},
+		{
+			name:     "rate limiting without supported window",
+			plugin:   `{"name":"rate-limiting","config":{"year":100}}`,
+			wantName: "limit-count",
+			notes:    1,
+		},
+		{
+			name: "rate limiting by redis",
+			plugin: `{"name":"rate-limiting","config":{"day":100,"limit_by":"service","policy":"redis",
+				"redis_host":"old","redis":{"host":"redis","port":6379}}}`,
+			wantName: "limit-count",
+			want: `{"count":100,"time_window":86400,"key_type":"constant","key":"service","rejected_code":429,
+				"allow_degradation":true,"show_limit_quota_header":true,"policy":"redis","redis_host":"redis",
+				"redis_port":6379}`,
+		},
+		{
+			name: "cors with regex origins",
+			plugin: `{"name":"cors","config":{"origins":["https://a.com","https://.*\\.b\\.com"],
+				"methods":["GET","POST"],"max_age":3600,"credentials":true}}`,
+			wantName: "cors",
+			want: `{"allow_origins":"https://a.com","allow_origins_by_regex":["https://.*\\.b\\.com"],
+				"allow_methods":"GET,POST","allow_headers":"**","expose_headers":"**","max_age":3600,
+				"allow_credential":true}`,
+		},
+		{
+			name: "cors with credentials and wildcard headers",
+			plugin: `{"name":"cors","config":{"origins":["https://a.com"],"headers":["*"],"exposed_headers":["X-Id"],
+				"credentials":true}}`,
+			wantName: "cors",
+			want: `{"allow_origins":"https://a.com","allow_methods":"**","allow_headers":"**","expose_headers":"X-Id",
+				"allow_credential":true}`,
+		},
+		{
+			name:     "cors with only regex origins",
+			plugin:   `{"name":"cors","config":{"origins":["https?://(a|b)\\.com"]}}`,
+			wantName: "cors",
+			want: `{"allow_origins_by_regex":["https?://(a|b)\\.com"],"allow_methods":"*","allow_headers":"*",
+				"allow_credential":false}`,
+		},
+		{
+			name:     "cors wildcard with credentials",
+			plugin:   `{"name":"cors","config":{"origins":["*"],"credentials":true,"exposed_headers":["X-Id"]}}`,
+			wantName: "cors",
+			want: `{"allow_origins":"*","allow_methods":"*","allow_headers":"*","expose_headers":"X-Id",
+				"allow_credential":false}`,
+			notes: 1,
+		},
+		{
+			name:     "ip restriction allow and deny",
+			plugin:   `{"name":"ip-restriction","config":{"allow":["10.0.0.0/8"],"deny":["10.0.0.1"],"message":"no"}}`,
+			wantName: "ip-restriction",
+			want:     `{"whitelist":["10.0.0.0/8"],"message":"no"}`,
+			notes:    1,
+		},
+		{
+			name:     "ip restriction legacy blacklist",
+			plugin:   `{"name":"ip-restriction","config":{"blacklist":["10.0.0.1"]}}`,
+			wantName: "ip-restriction",
+			want:     `{"blacklist":["10.0.0.1"]}`,
+		},
+		{
+			name:     "ip restriction empty",
+			plugin:   `{"name":"ip-restriction","config":{"allow":null,"deny":[]}}`,
+			wantName: "ip-restriction",
+			notes:    1,
+		},
+		{
+			name:     "disabled plugin of apisix v3",
+			plugin:   `{"name":"basic-auth","enabled":false,"config":{"hide_credentials":true}}`,
+			version:  model.APISIX_V3,
+			wantName: "basic-auth",
+			want:     `{"hide_credentials":true,"_meta":{"disable":true}}`,
+		},
+		{
+			name:     "disabled plugin of apisix v2",
+			plugin:   `{"name":"key-auth","enabled":false,"config":{"key_names":["apikey","token"]}}`,
+			version:  model.APISIX_V2,
+			wantName: "key-auth",
+			want:     `{"header":"apikey","query":"apikey","hide_credentials":false,"disable":true}`,
+			notes:    1,
+		},
+		{
+			name:     "unsupported plugin",
+			plugin:   `{"name":"request-transformer","config":{}}`,
+			wantName: "request-transformer",
+			notes:    1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, conf, notes := kongPluginToApisix(decodeJson(t, tt.plugin), tt.version)
+			if name != tt.wantName {
+				t.Errorf("name got %s, want %s", name, tt.wantName)
+			}
+			if len(tt.want) == 0 {
+				if conf != nil {
+					t.Errorf("conf got %#v, want nil", conf)
+				}
+			} else {
+				assertJson(t, conf, tt.want)
+			}
+			if len(notes) != tt.notes {
+				t.Errorf("notes got %v, want %d notes", notes, tt.notes)
+			}
+		})
+	}
+}
+
+func TestApisixPluginToKong(t *testing.T) {
+	tests := []struct {
+		name       string
+		pluginName string
+		conf       string
+		legacy     bool
+		wantName   string
+		want       string
+		notes      int
+	}{
+		{
+			name:       "limit count by header",
+			pluginName: "limit-count",
+			conf: `{"count":100,"time_window":3600,"key_type":"var","key":"http_x_api_key",
+				"show_limit_quota_header":false}`,
+			wantName: "rate-limiting",
+			want: `{"hour":100,"limit_by":"header","header_name":"x-api-key","policy":"local","fault_tolerant":false,
+				"hide_client_headers":true}`,
+		},
+		{
+			name:       "limit count default key",
+			pluginName: "limit-count",
+			conf: `{"count":5,"time_window":1,"policy":"redis","redis_host":"redis","redis_port":6379,
+				"allow_degradation":true}`,
+			wantName: "rate-limiting",
+			want: `{"second":5,"limit_by":"ip","policy":"redis","redis_host":"redis","redis_port":6379,
+				"fault_tolerant":true,"hide_client_headers":false}`,
+		},
+		{
+			name:       "limit count window not supported",
+			pluginName: "limit-count",
+			conf:       `{"count":5,"time_window":120}`,
+			wantName:   "rate-limiting",
+			notes:      1,
+		},
+		{
+			name:       "limit count policy not supported",
+			pluginName: "limit-count",
+			conf:       `{"count":5,"time_window":60,"key_type":"constant","policy":"redis-cluster"}`,
+			wantName:   "rate-limiting",
+			notes:      1,
+		},
+		{
+			name:       "cors with regex origins",
+			pluginName: "cors",
+			conf: `{"allow_origins":"https://a.com,https://b.com","allow_origins_by_regex":["https://.*\\.c\\.com"],
+				"allow_methods":"GET,POST","allow_headers":"**","max_age":60,"allow_credential":true}`,
+			wantName: "cors",
+			want: `{"origins":["https://.*\\.c\\.com","https://a.com","https://b.com"],"methods":["GET","POST"],
+				"max_age":60,"credentials":true}`,
+		},
+		{
+			name:       "cors default origins",
+			pluginName: "cors",
+			conf:       `{"expose_headers":"X-Id"}`,
+			wantName:   "cors",
+			want:       `{"origins":["*"],"exposed_headers":["X-Id"],"credentials":false}`,
+		},
+		{
+			name:       "ip restriction",
+			pluginName: "ip-restriction",
+			conf:       `{"whitelist":["10.0.0.0/8"],"message":"no"}`,
+			wantName:   "ip-restriction",
+			want:       `{"allow":["10.0.0.0/8"],"message":"no"}`,
+		},
+		{
+			name:       "ip restriction of legacy kong",
+			pluginName: "ip-restriction",
+			conf:       `{"blacklist":["10.0.0.1"],"message":"no"}`,
+			legacy:     true,
+			wantName:   "ip-restriction",
+			want:       `{"deny":["10.0.0.1"]}`,
+		},
+		{
+			name:       "unsupported plugin",
+			pluginName: "proxy-mirror",
+			conf:       `{"host":"http://127.0.0.1"}`,
+			wantName:   "proxy-mirror",
+			notes:      1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, config, notes := apisixPluginToKong(tt.pluginName, decodeJson(t, tt.conf), tt.legacy)
+			if name != tt.wantName {
+				t.Errorf("name got %s, want %s", name, tt.wantName)
+			}
+			if len(tt.want) == 0 {
+				if config != nil {
+					t.Errorf("config got %#v, want nil", config)
+				}
+			} else {
+				assertJson(t, config, tt.want)
+			}
+			if len(notes) != tt.notes {
+				t.Errorf("notes got %v, want %d notes", notes, tt.notes)
+			}
+		})
+	}
+}
+
+func TestKongUuid(t *testing.T) {
+	const id = "7d0f4b7e-3b1c-4f8e-9b61-0d8a1c2e3f40"
+	tests := []struct {
+		kind string
+		id   string
+		want string
+	}{
+		// uuid of kong entity is kept
+		{"routes", id, id},
+		// derived entities and other ids are hashed, and stable between migrations
+		{"routes", "1", "392f84bc-6371-3211-8d5d-4bccdabf342a"},
+		{"routes/service", id, "3069a988-261e-3d80-83e7-e4ccd72d8f62"},
+		{"consumers", "jack", "a317e463-ef59-3647-b761-9c0cdc5eaf82"},
+	}
+	for _, tt := range tests {
+		got := kongUuid(tt.kind, tt.id)
+		if !kongUuidRE.MatchString(got) || got[14] != '3' && got != tt.id {
+			t.Errorf("kongUuid(%s, %s) got %s, not a version 3 uuid", tt.kind, tt.id, got)
+		}
+		if got != tt.want {
+			t.Errorf("kongUuid(%s, %s) got %s, want %s", tt.kind, tt.id, got, tt.want)
+		}
+		if again := kongUuid(tt.kind, tt.id); again != got {
+			t.Errorf("kongUuid(%s, %s) is not stable, got %s and %s", tt.kind, tt.id, got, again)
+		}
+	}
+	if kongUuid("routes", "1") == kongUuid("services", "1") {
+		t.Errorf("kongUuid of different kinds should be different")
+	}
+}
+
+// fakeKongApisix admin api of kong serving entities, and admin api of apisix recording PUT requests
+type fakeKongApisix struct {
+	entities map[string]string
+	puts     map[string]map[string]interface{}
+	mutex    sync.Mutex
+}
+
+func (fake *fakeKongApisix) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if r.Method == "PUT" {
+		body, _ := io.ReadAll(r.Body)
+		value := map[string]interface{}{}
+		_ = json.Unmarshal(body, &value)
+		fake.puts[strings.TrimPrefix(r.URL.Path, "/apisix/admin/")] = value
+		_, _ = w.Write([]byte(`{}`))
+		return
+	}
+	if r.URL.Path == "/" {
+		_, _ = w.Write([]byte(`{"version":"3.4.0"}`))
+		return
+	}
+	data, ok := fake.entities[strings.TrimPrefix(r.URL.Path, "/")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_, _ = w.Write([]byte(`{"data":` + data + `,"next":null}`))
+}
+
+func TestKongMigrateToApisixSharedUpstream(t *testing.T) {
+	fake := &fakeKongApisix{
+		entities: map[string]string{
+			"upstreams":            `[{"id":"u1","name":"orders.upstream","algorithm":"round-robin"}]`,
+			"upstreams/u1/targets": `[{"id":"t1","target":"10.0.0.1:8080","weight":100,"upstream":{"id":"u1"}}]`,
+			"services": `[
+				{"id":"s1","name":"orders","protocol":"http","host":"orders.upstream","connect_timeout":60000,
+					"write_timeout":60000,"read_timeout":60000,"retries":5},
+				{"id":"s2","name":"orders-slow","protocol":"http","host":"orders.upstream","connect_timeout":60000,
+					"write_timeout":60000,"read_timeout":300000,"retries":5},
+				{"id":"s3","name":"orders-copy","protocol":"http","host":"orders.upstream","connect_timeout":60000,
+					"write_timeout":60000,"read_timeout":60000,"retries":5}
+			]`,
+		},
+		puts: map[string]map[string]interface{}{},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	logger := go_logger.NewLogger()
+	kongClient := &KongClient{Config: model.Gateway{AdminUrl: server.URL}, Logger: logger}
+	apisixClient := &ApisixClient{Config: model.Gateway{AdminUrl: server.URL, Prefix: "/apisix/admin/"},
+		ApiVersion: model.APISIX_V3, Logger: logger}
+
+	if err := kongClient.MigrateTo(apisixClient); err != nil {
+		t.Fatalf("MigrateTo err:%s", err)
+	}
+	copyId := kongUuid("upstreams/service", "u1/s2")
+	if len(fake.puts) != 5 || fake.puts["upstreams/u1"] == nil || fake.puts["upstreams/"+copyId] == nil {
+		t.Fatalf("puts got %v, want upstreams u1 and %s, services s1, s2 and s3", fake.puts, copyId)
+	}
+	assertJson(t, fake.puts["upstreams/u1"]["timeout"], `{"connect":60,"send":60,"read":60}`)
+	assertJson(t, fake.puts["upstreams/"+copyId]["timeout"], `{"connect":60,"send":60,"read":300}`)
+	assertJson(t, fake.puts["upstreams/"+copyId]["nodes"], `[{"host":"10.0.0.1","port":8080,"weight":100}]`)
+	for service, upstreamId := range map[string]string{"s1": "u1", "s2": copyId, "s3": "u1"} {
+		if got := fake.puts["services/"+service]["upstream_id"]; got != upstreamId {
+			t.Errorf("upstream of service %s got %v, want %s", service, got, upstreamId)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// NginxClient render upstream blocks into conf-dir, one file per upstream, test and reload nginx when changed
+type NginxClient struct {
+	Config model.Gateway
+	Logger *go_logger.Logger
+	mutex  sync.Mutex
+}
+
+var DefaultNginxUpstreamTemplate = `# auto sync by https://github.com/anjia0532/discovery-syncer
+upstream {{.Name}} {
+{{- range .Servers}}
+    server {{.Address}}{{if .Down}} down{{else}} weight={{.Weight}}{{end}};
+{{- end}}
+{{- if not .Servers}}
+    server ` + nginxPlaceholderServer + ` down;
+{{- end}}
+}
+`
+
+// nginxPlaceholderServer upstream must have at least one server
+const nginxPlaceholderServer = "127.0.0.1:1"
+
+var nginxServerRE = regexp.MustCompile(`^\s*server\s+(?P<Address>[^\s;]+)(?P<Params>[^;]*);`)
+
+type nginxServer struct {
+	Ip      string
+	Port    int
+	Address string
+	Weight  int
+	Down    bool
+}
+
+func (nginxClient *NginxClient) GetServiceAllInstances(upstreamName string) ([]model.Instance, error) {
+	instances := []model.Instance{}
+	filePath, err := nginxClient.getFilePath(upstreamName)
+	if err != nil {
+		nginxClient.Logger.Errorf("read nginx upstream: %s failed, err:%s", upstreamName, err)
+		return nil, err
+	}
+	content, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return instances, nil
+	}
+	if err != nil {
+		nginxClient.Logger.Errorf("read nginx upstream: %s failed, err:%s", upstreamName, err)
+		return nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		matches := nginxServerRE.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+		address := matches[nginxServerRE.SubexpIndex("Address")]
+		if address == nginxPlaceholderServer {
+			continue
+		}
+		idx := strings.LastIndex(address, ":")
+		if idx <= 0 {
+			continue
+		}
+		port, err := strconv.Atoi(address[idx+1:])
+		if err != nil {
+			continue
+		}
+		// nginx default weight is 1, down is zero weight
+		weight := float32(1)
+		for _, param := range strings.Fields(matches[nginxServerRE.SubexpIndex("Params")]) {
+			if param == "down" {
+				weight = 0
+			} else if strings.HasPrefix(param, "weight=") {
+				if w, err := strconv.Atoi(strings.TrimPrefix(param, "weight=")); err == nil {
+					weight = float32(w)
+				}
+			}
+		}
+		instances = append(instances, model.Instance{Ip: strings.Trim(address[:idx], "[]"), Port: port,
+			Weight: weight})
+	}
+	return instances, nil
+}
+
+func (nginxClient *NginxClient) SyncInstances(name string, tpl string, discoveryInstances []model.Instance,
+	diffIns []model.Instance) error {
+	if len(tpl) == 0 {
+		tpl = nginxClient.Config.Config["template"]
+	}
+	if len(tpl) == 0 {
+		tpl = DefaultNginxUpstreamTemplate
+	}
+	tmpl, err := template.New("NginxUpstreamTemplate").Parse(tpl)
+	if err != nil {
+		nginxClient.Logger.Errorf("parse nginx UpstreamTemplate failed, tmpl:%s, err:%s", tpl, err)
+		return err
+	}
+
+	servers := []nginxServer{}
+	for _, instance := range discoveryInstances {
+		address := fmt.Sprintf("%s:%d", instance.Ip, instance.Port)
+		if strings.Contains(instance.Ip, ":") {
+			address = fmt.Sprintf("[%s]:%d", instance.Ip, instance.Port)
+		}
+		// nginx weight is integer and at least 1
+		weight := int(math.Round(float64(instance.Weight)))
+		servers = append(servers, nginxServer{Ip: instance.Ip, Port: instance.Port, Address: address,
+			Weight: max(weight, 1), Down: instance.Weight <= 0})
+	}
+	// stable content, avoid reload when only order changed
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Address < servers[j].Address
+	})
+	data := struct {
+		Name    string
+		Servers []nginxServer
+		Scheme  string
+	}{Name: name, Servers: servers, Scheme: getScheme(discoveryInstances)}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, data); err != nil {
+		nginxClient.Logger.Errorf("parse nginx UpstreamTemplate failed, tmpl:%s, data:%#v, err:%s", tpl, data, err)
+		return err
+	}
+
+	changed, err := nginxClient.writeAndReload(name, buf.Bytes())
+	if err != nil {
+		nginxClient.Logger.Errorf("update nginx upstream: %s failed, err:%s", name, err)
+		return err
+	}
+	nginxClient.Logger.Debugf("update nginx upstream: %s, changed:%t, content:%s", name, changed, buf.String())
+	return nil
+}
+
+// writeAndReload write content to temp file and rename it, rollback if test command failed
+func (nginxClient *NginxClient) writeAndReload(name string, content []byte) (bool, error) {
+	nginxClient.mutex.Lock()
+	defer nginxClient.mutex.Unlock()
+
+	filePath, err := nginxClient.getFilePath(name)
+	if err != nil {
+		return false, err
+	}
+	origin, err := os.ReadFile(filePath)
+	exists := err == nil
+	if exists && bytes.Equal(origin, content) {
+		return false, nil
+	}
+	if err = writeFileAtomic(filePath, content); err != nil {
+		return false, err
+	}
+
+	if err = nginxClient.runCommand("test-command", "nginx -t"); err != nil {
+		if exists {
+			err2 := writeFileAtomic(filePath, origin)
+			if err2 != nil {
+				nginxClient.Logger.Errorf("rollback nginx upstream: %s failed, err:%s", name, err2)
+			}
+		} else {
+			_ = os.Remove(filePath)
+		}
+		return false, err
+	}
+	return true, nginxClient.runCommand("reload-command", "nginx -s reload")
+}
+
+func (nginxClient *NginxClient) runCommand(key string, defaultCommand string) error {
+	command, ok := nginxClient.Config.Config[key]
+	if !ok {
+		command = defaultCommand
+	}
+	// empty command to skip
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil
+	}
+	output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("run %s failed, command:%s, err:%s, output:%s", key, command, err, output))
+	}
+	nginxClient.Logger.Debugf("run %s, command:%s, output:%s", key, command, output)
+	return nil
+}
+
+// getFilePath file of upstream, name with path separator or escaping conf-dir is rejected
+func (nginxClient *NginxClient) getFilePath(name string) (string, error) {
+	suffix, ok := nginxClient.Config.Config["file-suffix"]
+	if !ok {
+		suffix = ".conf"
+	}
+	if len(name) == 0 || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return "", errors.New(fmt.Sprintf("invalid nginx upstream name:%q", name))
+	}
+	confDir := filepath.Clean(nginxClient.Config.Config["conf-dir"])
+	filePath := filepath.Join(confDir, name+suffix)
+	if filepath.Dir(filePath) != confDir {
+		return "", errors.New(fmt.Sprintf("nginx upstream file:%s is not in conf-dir:%s", filePath, confDir))
+	}
+	return filePath, nil
+}
+
+// FetchAdminApiToFile merge all upstream files of conf-dir into one file
+func (nginxClient *NginxClient) FetchAdminApiToFile() (string, string, error) {
+	suffix, ok := nginxClient.Config.Config["file-suffix"]
+	if !ok {
+		suffix = ".conf"
+	}
+	files, err := filepath.Glob(filepath.Join(nginxClient.Config.Config["conf-dir"], "*"+suffix))
+	if err != nil {
+		return "", "", err
+	}
+	sort.Strings(files)
+	var buf bytes.Buffer
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			nginxClient.Logger.Errorf("read nginx upstream file:%s failed, err:%s", file, err)
+			return "", "", err
+		}
+		buf.Write(content)
+		buf.WriteString("\n")
+	}
+	nginxFilePath := filepath.Join(os.TempDir(), "nginx-upstreams.conf")
+	if err = os.WriteFile(nginxFilePath, buf.Bytes(), 0644); err != nil {
+		nginxClient.Logger.Errorf("failed to write nginx-upstreams.conf, err:%s", err)
+		return "", "", err
+	}
+	return buf.String(), nginxFilePath, nil
+}
+
+func (nginxClient *NginxClient) MigrateTo(GatewayClient) error {
+	return errors.New("nginx gateway does not support migrate")
+}
+
+// writeFileAtomic write to a temp file in the same directory, then rename
+func writeFileAtomic(filePath string, content []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err = tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"errors"
+	"github.com/anjia0532/apisix-discovery-syncer/client/plugin"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	go_logger "github.com/phachon/go-logger"
+)
+
+// PluginClient gateway implemented by external plugin executable, see model.PluginRequest
+type PluginClient struct {
+	Config model.Gateway
+	Plugin model.Plugin
+	Logger *go_logger.Logger
+}
+
+func (pluginClient *PluginClient) GetServiceAllInstances(upstreamName string) ([]model.Instance, error) {
+	instances := []model.Instance{}
+	err := plugin.Call(pluginClient.Plugin, "GetServiceAllInstances", pluginClient.Config,
+		map[string]interface{}{"upstreamName": upstreamName}, &instances)
+	if err != nil {
+		pluginClient.Logger.Errorf("fetch plugin %s upstream: %s failed, err:%s", pluginClient.Config.Type,
+			upstreamName, err)
+		return nil, err
+	}
+	return instances, nil
+}
+
+func (pluginClient *PluginClient) SyncInstances(name string, tpl string, discoveryInstances []model.Instance,
+	diffIns []model.Instance) error {
+	err := plugin.Call(pluginClient.Plugin, "SyncInstances", pluginClient.Config, map[string]interface{}{
+		"name":               name,
+		"template":           tpl,
+		"discoveryInstances": discoveryInstances,
+		"diffInstances":      diffIns,
+	}, nil)
+	if err != nil {
+		pluginClient.Logger.Errorf("update plugin %s upstream: %s failed, err:%s", pluginClient.Config.Type, name, err)
+	}
+	return err
+}
+
+func (pluginClient *PluginClient) FetchAdminApiToFile() (string, string, error) {
+	result := struct {
+		Content string `json:"content"`
+		Path    string `json:"path"`
+	}{}
+	err := plugin.Call(pluginClient.Plugin, "FetchAdminApiToFile", pluginClient.Config, nil, &result)
+	if err != nil {
+		pluginClient.Logger.Errorf("fetch plugin %s admin api to file failed, err:%s", pluginClient.Config.Type, err)
+		return "", "", err
+	}
+	return result.Content, result.Path, nil
+}
+
+func (pluginClient *PluginClient) MigrateTo(GatewayClient) error {
+	return errors.New("plugin gateway does not support migrate")
+}
@@ -0,0 +1,272 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	"github.com/ghodss/yaml"
+	go_logger "github.com/phachon/go-logger"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// TraefikClient render traefik dynamic configuration of http services,
+// served by http provider endpoint /traefik/{gateway-name} and written to file if configured
+type TraefikClient struct {
+	Config model.Gateway
+	Name   string
+	Logger *go_logger.Logger
+	mutex  sync.Mutex
+}
+
+var DefaultTraefikServiceTemplate = `
+{
+    "loadBalancer": {
+        "servers": [
+        {{- range $i, $server := .Servers}}{{if $i}},{{end}}
+            {"url": "{{$server.Url}}", "weight": {{$server.Weight}}}
+        {{- end}}
+        ]
+    }
+}
+`
+
+// traefikStore services of a traefik gateway, kept after config reload, traefik keeps polling during reload
+type traefikStore struct {
+	services  map[string]map[string]interface{}
+	instances map[string][]model.Instance
+	mutex     sync.Mutex
+}
+
+var (
+	traefikStoreMap   = map[string]*traefikStore{}
+	traefikStoreMutex sync.Mutex
+)
+
+type traefikDynamicConfig struct {
+	Http traefikHttpConfig `json:"http"`
+}
+
+type traefikHttpConfig struct {
+	Services map[string]map[string]interface{} `json:"services"`
+}
+
+type traefikServer struct {
+	Ip     string
+	Port   int
+	Url    string
+	Weight int
+}
+
+func (traefikClient *TraefikClient) getStore() *traefikStore {
+	traefikStoreMutex.Lock()
+	defer traefikStoreMutex.Unlock()
+	if store, ok := traefikStoreMap[traefikClient.Name]; ok {
+		return store
+	}
+	store := &traefikStore{services: map[string]map[string]interface{}{}, instances: map[string][]model.Instance{}}
+	// services written before restart
+	if filePath := traefikClient.Config.Config["file"]; len(filePath) > 0 {
+		content, err := os.ReadFile(filePath)
+		if err == nil {
+			dynamicConfig := traefikDynamicConfig{}
+			if err = yaml.Unmarshal(content, &dynamicConfig); err != nil {
+				traefikClient.Logger.Errorf("load traefik file:%s failed, err:%s", filePath, err)
+			}
+			for name, service := range dynamicConfig.Http.Services {
+				store.services[name] = service
+			}
+		} else if !os.IsNotExist(err) {
+			traefikClient.Logger.Errorf("read traefik file:%s failed, err:%s", filePath, err)
+		}
+	}
+	traefikStoreMap[traefikClient.Name] = store
+	return store
+}
+
+func (traefikClient *TraefikClient) GetServiceAllInstances(upstreamName string) ([]model.Instance, error) {
+	store := traefikClient.getStore()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	instances := []model.Instance{}
+	if synced, ok := store.instances[upstreamName]; ok {
+		return append(instances, synced...), nil
+	}
+	// loaded from file, parse servers of load balancer
+	loadBalancer, _ := store.services[upstreamName]["loadBalancer"].(map[string]interface{})
+	servers, _ := loadBalancer["servers"].([]interface{})
+	for _, item := range servers {
+		server, _ := item.(map[string]interface{})
+		rawUrl, _ := server["url"].(string)
+		u, err := url.Parse(rawUrl)
+		if err != nil || len(u.Hostname()) == 0 {
+			continue
+		}
+		port, err := strconv.Atoi(u.Port())
+		if err != nil {
+			port = 80
+			if u.Scheme == "https" {
+				port = 443
+			}
+		}
+		// traefik default weight is 1
+		weight := float32(1)
+		if w, ok := server["weight"].(float64); ok {
+			weight = float32(w)
+		}
+		instances = append(instances, model.Instance{Ip: u.Hostname(), Port: port, Weight: weight})
+	}
+	return instances, nil
+}
+
+func (traefikClient *TraefikClient) SyncInstances(name string, tpl string, discoveryInstances []model.Instance,
+	diffIns []model.Instance) error {
+	if len(tpl) == 0 {
+		tpl = traefikClient.Config.Config["template"]
+	}
+	if len(tpl) == 0 {
+		tpl = DefaultTraefikServiceTemplate
+	}
+	tmpl, err := template.New("TraefikServiceTemplate").Parse(tpl)
+	if err != nil {
+		traefikClient.Logger.Errorf("parse traefik ServiceTemplate failed, tmpl:%s, err:%s", tpl, err)
+		return err
+	}
+
+	scheme := getScheme(discoveryInstances)
+	// zero weight instances are kept for diff, but not served
+	servers := []traefikServer{}
+	for _, instance := range discoveryInstances {
+		if instance.Weight <= 0 {
+			continue
+		}
+		host := instance.Ip
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		// traefik weight is integer and at least 1
+		weight := int(math.Round(float64(instance.Weight)))
+		servers = append(servers, traefikServer{Ip: instance.Ip, Port: instance.Port,
+			Url: fmt.Sprintf("%s://%s:%d", scheme, host, instance.Port), Weight: max(weight, 1)})
+	}
+	// stable content, avoid rewriting file when only order changed
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Url < servers[j].Url
+	})
+	data := struct {
+		Name    string
+		Servers []traefikServer
+		Scheme  string
+	}{Name: name, Servers: servers, Scheme: scheme}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, data); err != nil {
+		traefikClient.Logger.Errorf("parse traefik ServiceTemplate failed, tmpl:%s, data:%#v, err:%s", tpl, data, err)
+		return err
+	}
+	service := map[string]interface{}{}
+	if err = json.Unmarshal(buf.Bytes(), &service); err != nil {
+		traefikClient.Logger.Errorf("invalid traefik service, service:%s, err:%s", buf.String(), err)
+		return err
+	}
+
+	store := traefikClient.getStore()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.services[name] = service
+	instances := []model.Instance{}
+	for _, instance := range discoveryInstances {
+		instances = append(instances, model.Instance{Ip: instance.Ip, Port: instance.Port, Weight: instance.Weight})
+	}
+	store.instances[name] = instances
+
+	if err = traefikClient.writeFile(store); err != nil {
+		traefikClient.Logger.Errorf("update traefik service: %s failed, err:%s", name, err)
+		return err
+	}
+	traefikClient.Logger.Debugf("update traefik service: %s, servers:%d", name, len(servers))
+	return nil
+}
+
+// writeFile write dynamic configuration to file for traefik file provider, only when changed
+func (traefikClient *TraefikClient) writeFile(store *traefikStore) error {
+	filePath := traefikClient.Config.Config["file"]
+	if len(filePath) == 0 {
+		return nil
+	}
+	traefikClient.mutex.Lock()
+	defer traefikClient.mutex.Unlock()
+
+	content, err := marshalTraefikConfig(store, filepath.Ext(filePath) == ".json")
+	if err != nil {
+		return err
+	}
+	origin, err := os.ReadFile(filePath)
+	if err == nil && bytes.Equal(origin, content) {
+		return nil
+	}
+	return writeFileAtomic(filePath, content)
+}
+
+// DynamicConfig dynamic configuration in json for traefik http provider
+func (traefikClient *TraefikClient) DynamicConfig() ([]byte, error) {
+	store := traefikClient.getStore()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	// traefik keeps the last configuration when provider failed
+	if len(store.services) == 0 {
+		return nil, errors.New("traefik services have not been synced yet")
+	}
+	return marshalTraefikConfig(store, true)
+}
+
+func marshalTraefikConfig(store *traefikStore, isJson bool) ([]byte, error) {
+	dynamicConfig := traefikDynamicConfig{Http: traefikHttpConfig{Services: store.services}}
+	if isJson {
+		return json.MarshalIndent(dynamicConfig, "", "  ")
+	}
+	return yaml.Marshal(dynamicConfig)
+}
+
+// FetchAdminApiToFile dump dynamic configuration of traefik to yaml file
+func (traefikClient *TraefikClient) FetchAdminApiToFile() (string, string, error) {
+	store := traefikClient.getStore()
+	store.mutex.Lock()
+	content, err := marshalTraefikConfig(store, false)
+	store.mutex.Unlock()
+	if err != nil {
+		traefikClient.Logger.Errorf("convert traefik dynamic configuration to yaml error, err:%s", err)
+		return "", "", err
+	}
+	traefikFilePath := filepath.Join(os.TempDir(), "traefik.yml")
+	if err = os.WriteFile(traefikFilePath, content, 0644); err != nil {
+		traefikClient.Logger.Errorf("failed to write traefik.yml, err:%s", err)
+		return "", "", err
+	}
+	return string(content), traefikFilePath, nil
+}
+
+func (traefikClient *TraefikClient) MigrateTo(GatewayClient) error {
+	return errors.New("traefik gateway does not support migrate")
+}
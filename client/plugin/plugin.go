@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/anjia0532/apisix-discovery-syncer/model"
+	"os"
+	"os/exec"
+)
+
+// Call run plugin with model.PluginRequest in stdin, decode result of model.PluginResponse in stdout to result
+func Call(plugin model.Plugin, method string, server interface{}, params interface{}, result interface{}) error {
+	request, err := json.Marshal(model.PluginRequest{Method: method, Server: server, Params: params})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), plugin.Timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, plugin.Path, plugin.Args...)
+	cmd.Env = os.Environ()
+	for k, v := range plugin.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return errors.New(fmt.Sprintf("run plugin %s %s failed, err:%s, stderr:%s",
+			plugin.Path, method, err, stderr.String()))
+	}
+
+	response := model.PluginResponse{}
+	if err = json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return errors.New(fmt.Sprintf("invalid response of plugin %s %s, stdout:%s, err:%s",
+			plugin.Path, method, stdout.String(), err))
+	}
+	if len(response.Error) > 0 {
+		return errors.New(response.Error)
+	}
+	if result == nil || len(response.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
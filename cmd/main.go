@@ -18,6 +18,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/anjia0532/apisix-discovery-syncer/client"
+	"github.com/anjia0532/apisix-discovery-syncer/client/discovery"
+	"github.com/anjia0532/apisix-discovery-syncer/client/gateway"
 	"github.com/anjia0532/apisix-discovery-syncer/config"
 	"github.com/anjia0532/apisix-discovery-syncer/model"
 	"github.com/gorilla/mux"
@@ -62,6 +64,7 @@ func main() {
 	r.HandleFunc("/discovery/{discovery-name}", discoveryHandler)
 	r.HandleFunc("/gateway-api-to-file/{gateway-name}", gatewayAdminApiToFile)
 	r.HandleFunc("/migrate/{origin-gateway-name}/to/{target-gateway-name}", migrateApisixGateway)
+	r.HandleFunc("/traefik/{gateway-name}", traefikProviderHandler)
 
 	if err == nil {
 		// default is false
@@ -77,12 +80,14 @@ func main() {
 	go func() {
 		_ = run()
 		job.Start()
-		c := make(chan os.Signal)
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGINT, syscall.SIGTERM)
 		<-c
 
 		logger.Flush()
 		job.Stop()
+		discovery.ReleaseZookeeperConns(nil)
+		gateway.ReleaseEnvoyServers(nil)
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 		if err := srv.Shutdown(ctx); nil != err {
@@ -136,7 +141,7 @@ func healthHandler(w http.ResponseWriter, _ *http.Request) {
 	healthResp.Uptime = fmt.Sprintf("%s", time.Since(startTime).Round(time.Second))
 	data, err := json.Marshal(healthResp)
 	if err != nil {
-		logger.Errorf("failed to get health ", err)
+		logger.Errorf("failed to get health, err:%s", err)
 	}
 	_, _ = fmt.Fprintf(w, "%s", data)
 }
@@ -194,6 +199,33 @@ func gatewayAdminApiToFile(writer http.ResponseWriter, request *http.Request) {
 	}
 	_, _ = fmt.Fprintf(writer, "%s", content)
 }
+
+// traefikProviderHandler endpoint of traefik http provider
+func traefikProviderHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	gatewayName := vars["gateway-name"]
+
+	gatewayClient, ok := client.GetGatewayClient(gatewayName)
+	if !ok {
+		writer.WriteHeader(http.StatusNotFound)
+		_, _ = fmt.Fprintf(writer, "Not Found")
+		return
+	}
+	traefikClient, ok := gatewayClient.(*gateway.TraefikClient)
+	if !ok {
+		writer.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintf(writer, "Gateway is not traefik")
+		return
+	}
+	content, err := traefikClient.DynamicConfig()
+	if err != nil {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintf(writer, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	_, _ = writer.Write(content)
+}
 func discoveryHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["discovery-name"]
@@ -210,8 +242,15 @@ func discoveryHandler(w http.ResponseWriter, r *http.Request) {
 		_, _ = fmt.Fprintf(w, err.Error())
 	}
 	logger.Infof("discoveryHandler: update discovery instances status,param: %#v", registration)
+	// modify registration needs disabled and unhealthy instances with origin weight
+	extData := map[string]string{}
+	for k, v := range registration.ExtData {
+		extData[k] = v
+	}
+	extData["unhealthy-policy"] = string(model.NACOS_POLICY_KEEP)
+	extData["disabled-policy"] = string(model.NACOS_POLICY_KEEP)
 	discoveryInstances, err := discovery.GetServiceAllInstances(
-		model.GetInstanceVo{ServiceName: registration.ServiceName, ExtData: registration.ExtData})
+		model.GetInstanceVo{ServiceName: registration.ServiceName, ExtData: extData})
 	if err != nil {
 		_, _ = fmt.Fprintf(w, err.Error())
 		return
@@ -22,6 +22,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 )
 
@@ -42,6 +43,43 @@ func LoadFile(filename string) (*model.Config, error) {
 	if len(cfg.GatewayServers) == 0 {
 		return nil, errors.New("gateway-servers must not null")
 	}
+	for name, plugin := range cfg.Plugins {
+		if slices.Contains(model.DiscoveryTypes, model.DiscoveryType(name)) ||
+			slices.Contains(model.GatewayTypes, model.GatewayType(name)) {
+			return nil, errors.New(fmt.Sprintf("plugin %s conflicts with builtin type", name))
+		}
+		if _, err = os.Stat(plugin.Path); err != nil {
+			return nil, errors.New(fmt.Sprintf("plugin %s not found, err:%s", name, err))
+		}
+	}
+	for name, server := range cfg.DiscoveryServers {
+		if slices.Contains(model.DiscoveryTypes, server.Type) {
+			continue
+		}
+		if plugin, ok := cfg.Plugins[string(server.Type)]; !ok || plugin.Kind != model.DISCOVERY_PLUGIN {
+			return nil, errors.New(fmt.Sprintf("invalid discovery type:%s of %s", server.Type, name))
+		}
+	}
+	for name, server := range cfg.GatewayServers {
+		if slices.Contains(model.GatewayTypes, server.Type) {
+			continue
+		}
+		if plugin, ok := cfg.Plugins[string(server.Type)]; !ok || plugin.Kind != model.GATEWAY_PLUGIN {
+			return nil, errors.New(fmt.Sprintf("invalid gateway type:%s of %s", server.Type, name))
+		}
+	}
+	// clusters of envoy gateways on the same xDS server would be served to each other
+	envoyListens := map[string]string{}
+	for name, server := range cfg.GatewayServers {
+		if server.Type != model.ENVOY_GATEWAY {
+			continue
+		}
+		listen := server.GetEnvoyListen()
+		if other, ok := envoyListens[listen]; ok {
+			return nil, errors.New(fmt.Sprintf("envoy gateway %s and %s have the same listen:%s", other, name, listen))
+		}
+		envoyListens[listen] = name
+	}
 	for _, target := range cfg.Targets {
 		if _, ok := cfg.DiscoveryServers[target.Discovery]; !ok {
 			return nil, errors.New(fmt.Sprintf("discovery %s not exist", target.Discovery))
@@ -129,7 +129,7 @@ type AUpstream struct {
 	Name  string                   `json:"name,omitempty" yaml:"name,omitempty"`
 }
 
-func (c *ANode) UnmarshalJSON(data []byte, Version ApisixAdminApiVersion) error {
+func (c *ANode) UnmarshalVersionedJSON(data []byte, Version ApisixAdminApiVersion) error {
 	type plain ANode
 
 	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
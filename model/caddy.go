@@ -0,0 +1,38 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package model
+
+// CaddyReverseProxy reverse_proxy handler of caddy json config, GET /id/{@id}
+type CaddyReverseProxy struct {
+	Handler       string              `json:"handler"`
+	Upstreams     []CaddyUpstream     `json:"upstreams"`
+	LoadBalancing *CaddyLoadBalancing `json:"load_balancing,omitempty"`
+}
+
+// CaddyUpstream upstream of reverse_proxy, fields other than dial like max_requests are kept as is
+type CaddyUpstream map[string]interface{}
+
+func (u CaddyUpstream) Dial() string {
+	dial, _ := u["dial"].(string)
+	return dial
+}
+
+type CaddyLoadBalancing struct {
+	SelectionPolicy *CaddySelectionPolicy `json:"selection_policy,omitempty"`
+}
+
+type CaddySelectionPolicy struct {
+	Policy  string `json:"policy"`
+	Weights []int  `json:"weights,omitempty"`
+}
@@ -17,30 +17,62 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
-	"time"
+	"slices"
+	"strings"
 )
 
 var (
-	HostPatternRE   = regexp.MustCompile(`^http(s)?://(.*@)?[\w-._:]+$`)
-	PrefixPatternRE = regexp.MustCompile(`^/[/\w-_.]+/$`)
-	NameRE          = regexp.MustCompile(`^[\w-_.]+$`)
+	HostPatternRE    = regexp.MustCompile(`^http(s)?://(.*@)?[\w-._:]+$`)
+	PrefixPatternRE  = regexp.MustCompile(`^/[/\w-_.]+/$`)
+	NameRE           = regexp.MustCompile(`^[\w-_.]+$`)
+	ZkHostPatternRE  = regexp.MustCompile(`^[\w-_.]+:\d+(,[\w-_.]+:\d+)*$`)
+	DnsHostPatternRE = regexp.MustCompile(`^(udp|tcp)://[\w-_.:\[\]]+:\d+$`)
+	// DockerHostPatternRE unix:///var/run/docker.sock, tcp://host:2375 or https://host:2376
+	DockerHostPatternRE = regexp.MustCompile(`^(unix:///.+|(tcp|https?)://[\w-_.:\[\]]+)$`)
+	// HaproxyRuntimeApiPatternRE unix:///var/run/haproxy.sock or tcp://host:9999
+	HaproxyRuntimeApiPatternRE = regexp.MustCompile(`^(unix:///.+|tcp://[\w-_.:\[\]]+:\d+)$`)
 )
 
 type DiscoveryType string
 type GatewayType string
 type healthCheckType string
 type ApisixAdminApiVersion string
+type NacosApiVersion string
+
+var (
+	// DiscoveryTypes builtin discovery types, others are plugins
+	DiscoveryTypes = []DiscoveryType{NACOS_DISCOVERY, EUREKA_DISCOVERY, CONSUL_DISCOVERY, ETCD_DISCOVERY,
+		ZK_DISCOVERY, K8S_DISCOVERY, DNS_DISCOVERY, FILE_DISCOVERY, HTTP_JSON_DISCOVERY, DOCKER_DISCOVERY}
+	// GatewayTypes builtin gateway types, others are plugins
+	GatewayTypes = []GatewayType{APISIX_GATEWAY, KONG_GATEWAY, NGINX_GATEWAY, ENVOY_GATEWAY, TRAEFIK_GATEWAY,
+		HAPROXY_GATEWAY, CADDY_GATEWAY}
+)
 
 const (
-	NACOS_DISCOVERY  DiscoveryType = "nacos"
-	EUREKA_DISCOVERY DiscoveryType = "eureka"
-
-	APISIX_GATEWAY GatewayType           = "apisix"
-	KONG_GATEWAY   GatewayType           = "kong"
-	HTTP_TYPE      healthCheckType       = "http"
-	HTTPS_TYPE     healthCheckType       = "https"
-	APISIX_V2      ApisixAdminApiVersion = "v2"
-	APISIX_V3      ApisixAdminApiVersion = "v3"
+	NACOS_DISCOVERY     DiscoveryType = "nacos"
+	EUREKA_DISCOVERY    DiscoveryType = "eureka"
+	CONSUL_DISCOVERY    DiscoveryType = "consul"
+	ETCD_DISCOVERY      DiscoveryType = "etcd"
+	ZK_DISCOVERY        DiscoveryType = "zookeeper"
+	K8S_DISCOVERY       DiscoveryType = "kubernetes"
+	DNS_DISCOVERY       DiscoveryType = "dns"
+	FILE_DISCOVERY      DiscoveryType = "file"
+	HTTP_JSON_DISCOVERY DiscoveryType = "http-json"
+	DOCKER_DISCOVERY    DiscoveryType = "docker"
+
+	APISIX_GATEWAY  GatewayType           = "apisix"
+	KONG_GATEWAY    GatewayType           = "kong"
+	NGINX_GATEWAY   GatewayType           = "nginx"
+	ENVOY_GATEWAY   GatewayType           = "envoy"
+	TRAEFIK_GATEWAY GatewayType           = "traefik"
+	HAPROXY_GATEWAY GatewayType           = "haproxy"
+	CADDY_GATEWAY   GatewayType           = "caddy"
+	HTTP_TYPE       healthCheckType       = "http"
+	HTTPS_TYPE      healthCheckType       = "https"
+	APISIX_V2       ApisixAdminApiVersion = "v2"
+	APISIX_V3       ApisixAdminApiVersion = "v3"
+	NACOS_V1        NacosApiVersion       = "v1"
+	NACOS_V2        NacosApiVersion       = "v2"
 )
 
 type Config struct {
@@ -49,6 +81,7 @@ type Config struct {
 	GatewayServers   map[string]Gateway   `yaml:"gateway-servers,omitempty"`
 	Targets          []Target             `yaml:"targets,omitempty"`
 	EnablePprof      bool                 `yaml:"enable-pprof,omitempty"`
+	Plugins          map[string]Plugin    `yaml:"plugins,omitempty"`
 }
 type Logger struct {
 	Level     string `yaml:"level"`
@@ -83,10 +116,11 @@ func (c *Logger) UnmarshalYAML(unmarshal func(interface{}) error) error {
 }
 
 type Discovery struct {
-	Type   DiscoveryType `yaml:"type,omitempty"`
-	Weight float32       `yaml:"weight,omitempty"`
-	Prefix string        `yaml:"prefix,omitempty"`
-	Host   string        `yaml:"host"`
+	Type   DiscoveryType     `yaml:"type,omitempty" json:"type"`
+	Weight float32           `yaml:"weight,omitempty" json:"weight"`
+	Prefix string            `yaml:"prefix,omitempty" json:"prefix"`
+	Host   string            `yaml:"host" json:"host"`
+	Config map[string]string `yaml:"config,omitempty" json:"config,omitempty"`
 }
 
 func (c *Discovery) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -100,28 +134,90 @@ func (c *Discovery) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if c.Weight < 0 || c.Weight > 100 {
 		return errors.New("weight must between 0 ~ 100")
 	}
-	if len(c.Host) == 0 {
+	// type of plugin is checked by config.LoadFile, plugin validates its own config
+	if !slices.Contains(DiscoveryTypes, c.Type) {
+		return nil
+	}
+	// kubernetes use in-cluster config or kubeconfig, dns use system resolver,
+	// docker use DOCKER_HOST or /var/run/docker.sock when host is empty
+	if len(c.Host) == 0 && c.Type != K8S_DISCOVERY && c.Type != DNS_DISCOVERY && c.Type != DOCKER_DISCOVERY {
 		return errors.New("host must not null")
 	}
 	if len(c.Prefix) > 0 && !PrefixPatternRE.MatchString(c.Prefix) {
 		return errors.New("invalid discovery prefix")
 	}
-	if !HostPatternRE.MatchString(c.Host) {
-		return errors.New("invalid host url")
-	}
 	switch c.Type {
+	case ZK_DISCOVERY:
+		if !ZkHostPatternRE.MatchString(c.Host) {
+			return errors.New("invalid zookeeper host, like zk1:2181,zk2:2181")
+		}
+		return nil
+	case K8S_DISCOVERY:
+		if len(c.Host) > 0 && !HostPatternRE.MatchString(c.Host) {
+			return errors.New("invalid host url")
+		}
+		return nil
+	case DNS_DISCOVERY:
+		if len(c.Host) > 0 && !DnsHostPatternRE.MatchString(c.Host) {
+			return errors.New("invalid dns resolver, like udp://10.0.0.2:53")
+		}
+		return nil
+	case FILE_DISCOVERY:
+		// host is the path of file or directory
+		return nil
+	case DOCKER_DISCOVERY:
+		if len(c.Host) > 0 && !DockerHostPatternRE.MatchString(c.Host) {
+			return errors.New("invalid docker host, like unix:///var/run/docker.sock or tcp://127.0.0.1:2375")
+		}
+		return nil
 	case EUREKA_DISCOVERY, NACOS_DISCOVERY:
+		// cluster peers, like http://nacos1:8848,http://nacos2:8848
+		hosts := c.GetHosts()
+		if len(hosts) == 0 {
+			return errors.New("host must not null")
+		}
+		for _, host := range hosts {
+			if !HostPatternRE.MatchString(host) {
+				return errors.New(fmt.Sprintf("invalid host url:%s", host))
+			}
+		}
+		return nil
+	case CONSUL_DISCOVERY, ETCD_DISCOVERY, HTTP_JSON_DISCOVERY:
+		if !HostPatternRE.MatchString(c.Host) {
+			return errors.New("invalid host url")
+		}
 		return nil
 	default:
 		return errors.New(fmt.Sprintf("invalid discovery type:%s", c.Type))
 	}
 }
 
+// GetHosts split comma separated host
+func (c *Discovery) GetHosts() []string {
+	hosts := []string{}
+	for _, host := range strings.Split(c.Host, ",") {
+		host = strings.TrimSpace(host)
+		if len(host) > 0 {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
 type Gateway struct {
-	Type     GatewayType       `yaml:"type"`
-	AdminUrl string            `yaml:"admin-url"`
-	Prefix   string            `yaml:"prefix,omitempty"`
-	Config   map[string]string `yaml:"config,omitempty"`
+	Type     GatewayType       `yaml:"type" json:"type"`
+	AdminUrl string            `yaml:"admin-url" json:"adminUrl"`
+	Prefix   string            `yaml:"prefix,omitempty" json:"prefix"`
+	Config   map[string]string `yaml:"config,omitempty" json:"config,omitempty"`
+}
+
+// GetEnvoyListen listen address of envoy xDS server, default is :18000
+func (c *Gateway) GetEnvoyListen() string {
+	listen, ok := c.Config["listen"]
+	if !ok || len(listen) == 0 {
+		listen = ":18000"
+	}
+	return listen
 }
 
 func (c *Gateway) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -132,6 +228,40 @@ func (c *Gateway) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	// type of plugin is checked by config.LoadFile, plugin validates its own config
+	if !slices.Contains(GatewayTypes, c.Type) {
+		return nil
+	}
+
+	// nginx writes upstream files into conf-dir, has no admin api
+	if c.Type == NGINX_GATEWAY {
+		if len(c.Config["conf-dir"]) == 0 {
+			return errors.New("nginx conf-dir must not null")
+		}
+		return nil
+	}
+	// envoy gets clusters from syncer by xDS, has no admin api
+	if c.Type == ENVOY_GATEWAY {
+		return nil
+	}
+	// traefik polls services from syncer by http provider or watches the file, has no admin api
+	if c.Type == TRAEFIK_GATEWAY {
+		return nil
+	}
+	// haproxy runtime mode updates server-template slots by runtime api, has no admin api
+	if c.Type == HAPROXY_GATEWAY {
+		mode, ok := c.Config["mode"]
+		if ok && mode != string(HAPROXY_DATAPLANE) && mode != string(HAPROXY_RUNTIME) {
+			return errors.New(fmt.Sprintf("invalid haproxy mode:%s", mode))
+		}
+		if mode == string(HAPROXY_RUNTIME) {
+			if !HaproxyRuntimeApiPatternRE.MatchString(c.Config["runtime-api"]) {
+				return errors.New("invalid haproxy runtime-api")
+			}
+			return nil
+		}
+	}
+
 	if !HostPatternRE.MatchString(c.AdminUrl) {
 		return errors.New("invalid gateway admin url")
 	}
@@ -141,7 +271,7 @@ func (c *Gateway) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	}
 
 	switch c.Type {
-	case APISIX_GATEWAY, KONG_GATEWAY:
+	case APISIX_GATEWAY, KONG_GATEWAY, HAPROXY_GATEWAY, CADDY_GATEWAY:
 		return nil
 	default:
 		return errors.New(fmt.Sprintf("invalid gateway type:%s", c.Type))
@@ -155,6 +285,7 @@ type Target struct {
 	Enabled            bool              `yaml:"enabled,omitempty"`
 	ExcludeService     []string          `yaml:"exclude-service"`
 	UpstreamPrefix     string            `yaml:"upstream-prefix"`
+	UpstreamName       string            `yaml:"upstream-name,omitempty"`
 	FetchInterval      string            `yaml:"fetch-interval,omitempty"`
 	MaximumIntervalSec int64             `yaml:"maximum-interval-sec,omitempty"`
 	Config             map[string]string `yaml:"config,omitempty"`
@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package model
+
+// ConsulServicesResp GET /v1/catalog/services, service name -> tags
+type ConsulServicesResp map[string][]string
+
+type ConsulServiceEntry struct {
+	Node    ConsulNode          `json:"Node"`
+	Service ConsulAgentService  `json:"Service"`
+	Checks  []ConsulHealthCheck `json:"Checks"`
+}
+
+type ConsulNode struct {
+	ID         string `json:"ID"`
+	Node       string `json:"Node"`
+	Address    string `json:"Address"`
+	Datacenter string `json:"Datacenter"`
+}
+
+type ConsulAgentService struct {
+	ID      string            `json:"ID"`
+	Service string            `json:"Service"`
+	Tags    []string          `json:"Tags"`
+	Meta    map[string]string `json:"Meta"`
+	Port    int               `json:"Port"`
+	Address string            `json:"Address"`
+	Weights ConsulWeights     `json:"Weights"`
+}
+
+type ConsulWeights struct {
+	Passing int `json:"Passing"`
+	Warning int `json:"Warning"`
+}
+
+type ConsulHealthCheck struct {
+	CheckID string `json:"CheckID"`
+	Status  string `json:"Status"` // passing warning critical maintenance
+}
@@ -0,0 +1,45 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package model
+
+// DockerContainer GET /containers/json
+type DockerContainer struct {
+	Id              string                  `json:"Id"`
+	Names           []string                `json:"Names"`
+	Labels          map[string]string       `json:"Labels"`
+	State           string                  `json:"State"`
+	Ports           []DockerPort            `json:"Ports"`
+	NetworkSettings DockerNetworkSettings   `json:"NetworkSettings"`
+	HostConfig      DockerContainerHostConf `json:"HostConfig"`
+}
+
+type DockerPort struct {
+	IP          string `json:"IP"`
+	PrivatePort int    `json:"PrivatePort"`
+	PublicPort  int    `json:"PublicPort"`
+	Type        string `json:"Type"`
+}
+
+type DockerNetworkSettings struct {
+	Networks map[string]DockerNetwork `json:"Networks"`
+}
+
+type DockerNetwork struct {
+	IPAddress         string `json:"IPAddress"`
+	GlobalIPv6Address string `json:"GlobalIPv6Address"`
+}
+
+type DockerContainerHostConf struct {
+	NetworkMode string `json:"NetworkMode"`
+}
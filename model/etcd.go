@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package model
+
+type EtcdKeyLayout string
+
+const (
+	ETCD_GRPC_LAYOUT  EtcdKeyLayout = "grpc"
+	ETCD_MICRO_LAYOUT EtcdKeyLayout = "micro"
+	ETCD_PLAIN_LAYOUT EtcdKeyLayout = "plain"
+)
+
+// EtcdRangeReq key and range_end are base64 encoded by grpc-gateway
+type EtcdRangeReq struct {
+	Key      string `json:"key"`
+	RangeEnd string `json:"range_end,omitempty"`
+}
+
+type EtcdRangeResp struct {
+	Kvs   []EtcdKeyValue `json:"kvs"`
+	Count string         `json:"count"`
+}
+
+type EtcdKeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type EtcdAuthReq struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type EtcdAuthResp struct {
+	Token string `json:"token"`
+}
+
+// EtcdGrpcEndpoint go.etcd.io/etcd/client/v3/naming/endpoints.Endpoint
+type EtcdGrpcEndpoint struct {
+	Addr     string      `json:"Addr"`
+	Metadata interface{} `json:"Metadata"`
+}
+
+// EtcdMicroService go-micro registry.Service
+type EtcdMicroService struct {
+	Name     string            `json:"name"`
+	Version  string            `json:"version"`
+	Metadata map[string]string `json:"metadata"`
+	Nodes    []EtcdMicroNode   `json:"nodes"`
+}
+
+type EtcdMicroNode struct {
+	Id       string            `json:"id"`
+	Address  string            `json:"address"`
+	Metadata map[string]string `json:"metadata"`
+}
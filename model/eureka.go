@@ -13,11 +13,18 @@
 
 package model
 
+import (
+	"encoding/json"
+	"strconv"
+)
+
 type EurekaAppsResp struct {
 	Applications EurekaApps `json:"applications"`
 }
 type EurekaApps struct {
-	Application []EurekaApp `json:"application"`
+	VersionsDelta string      `json:"versions__delta"`
+	AppsHashcode  string      `json:"apps__hashcode"`
+	Application   []EurekaApp `json:"application"`
 }
 type EurekaAppResp struct {
 	Application EurekaApp `json:"application"`
@@ -28,7 +35,49 @@ type EurekaApp struct {
 }
 type EurekaInstance struct {
 	HomePageUrl string            `json:"homePageUrl"`
+	IpAddr      string            `json:"ipAddr"`
+	HostName    string            `json:"hostName"`
+	Port        EurekaPort        `json:"port"`
+	SecurePort  EurekaPort        `json:"securePort"`
 	Status      string            `json:"status"`
 	Metadata    map[string]string `json:"metadata"`
 	InstanceId  string            `json:"instanceId"`
+	ActionType  string            `json:"actionType,omitempty"` // ADDED MODIFIED DELETED, only in delta
+}
+
+// EurekaPort {"$": 8080, "@enabled": "true"}
+type EurekaPort struct {
+	Port    int
+	Enabled bool
+}
+
+func (c *EurekaPort) UnmarshalJSON(data []byte) error {
+	*c = EurekaPort{}
+	// some eureka server return port as plain number
+	if port, err := strconv.Atoi(string(data)); err == nil {
+		c.Port = port
+		c.Enabled = true
+		return nil
+	}
+	raw := struct {
+		Port    json.Number `json:"$"`
+		Enabled interface{} `json:"@enabled"`
+	}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if len(raw.Port) > 0 {
+		port, err := strconv.Atoi(raw.Port.String())
+		if err != nil {
+			return err
+		}
+		c.Port = port
+	}
+	switch enabled := raw.Enabled.(type) {
+	case bool:
+		c.Enabled = enabled
+	case string:
+		c.Enabled, _ = strconv.ParseBool(enabled)
+	}
+	return nil
 }
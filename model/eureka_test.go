@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package model
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEurekaPortUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    EurekaPort
+		wantErr bool
+	}{
+		{name: "string enabled", data: `{"$": 8080, "@enabled": "true"}`, want: EurekaPort{Port: 8080, Enabled: true}},
+		{name: "string disabled", data: `{"$": 8443, "@enabled": "false"}`, want: EurekaPort{Port: 8443}},
+		{name: "bool enabled", data: `{"$": 8080, "@enabled": true}`, want: EurekaPort{Port: 8080, Enabled: true}},
+		{name: "string port", data: `{"$": "8080", "@enabled": "true"}`, want: EurekaPort{Port: 8080, Enabled: true}},
+		{name: "without enabled", data: `{"$": 8080}`, want: EurekaPort{Port: 8080}},
+		{name: "plain number", data: `9090`, want: EurekaPort{Port: 9090, Enabled: true}},
+		{name: "empty object", data: `{}`, want: EurekaPort{}},
+		{name: "invalid port", data: `{"$": 80.5, "@enabled": "true"}`, wantErr: true},
+		{name: "not a port", data: `"8080"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// stale values are reset
+			got := EurekaPort{Port: 1, Enabled: true}
+			err := json.Unmarshal([]byte(tt.data), &got)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("UnmarshalJSON should fail, got %#v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("UnmarshalJSON err:%s", err)
+			}
+			if got != tt.want {
+				t.Errorf("UnmarshalJSON got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+
+	instance := EurekaInstance{}
+	if err := json.Unmarshal([]byte(`{"instanceId":"orders-1","port":{"$":8080,"@enabled":"true"},`+
+		`"securePort":{"$":443,"@enabled":"false"}}`), &instance); err != nil {
+		t.Fatalf("unmarshal instance err:%s", err)
+	}
+	if instance.Port != (EurekaPort{Port: 8080, Enabled: true}) || instance.SecurePort != (EurekaPort{Port: 443}) {
+		t.Errorf("ports of instance got %#v, %#v", instance.Port, instance.SecurePort)
+	}
+}
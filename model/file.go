@@ -0,0 +1,31 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package model
+
+// FileServices content of static file discovery, yaml or json
+type FileServices struct {
+	Services []FileService `yaml:"services" json:"services"`
+}
+
+type FileService struct {
+	Name      string         `yaml:"name" json:"name"`
+	Instances []FileInstance `yaml:"instances" json:"instances"`
+}
+
+type FileInstance struct {
+	Ip       string            `yaml:"ip" json:"ip"`
+	Port     int               `yaml:"port" json:"port"`
+	Weight   *float32          `yaml:"weight,omitempty" json:"weight,omitempty"`
+	Metadata map[string]string `yaml:"metadata,omitempty" json:"metadata,omitempty"`
+}
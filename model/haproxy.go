@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package model
+
+type HaproxyMode string
+
+const (
+	// HAPROXY_DATAPLANE update servers by data plane api transactions
+	HAPROXY_DATAPLANE HaproxyMode = "dataplane"
+	// HAPROXY_RUNTIME update server-template slots by runtime api, without reload
+	HAPROXY_RUNTIME HaproxyMode = "runtime"
+)
+
+// HaproxyServer data plane api v2 /services/haproxy/configuration/servers
+type HaproxyServer struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Port    *int   `json:"port,omitempty"`
+	Weight  *int   `json:"weight,omitempty"`
+}
+
+type HaproxyServersResp struct {
+	Version int             `json:"_version"`
+	Data    []HaproxyServer `json:"data"`
+}
+
+// HaproxyTransaction data plane api v2 /services/haproxy/transactions
+type HaproxyTransaction struct {
+	Id      string `json:"id"`
+	Version int    `json:"_version"`
+	Status  string `json:"status"`
+}
+
+// HaproxyRawResp data plane api v2 /services/haproxy/configuration/raw
+type HaproxyRawResp struct {
+	Version int    `json:"_version"`
+	Data    string `json:"data"`
+}
@@ -21,3 +21,37 @@ type KongTarget struct {
 type KongTargetResp struct {
 	Data []KongTarget `json:"data"`
 }
+
+// KongPage paged list of kong admin api, next is null on the last page
+type KongPage struct {
+	Data   []map[string]interface{} `json:"data"`
+	Next   *string                  `json:"next"`
+	Offset string                   `json:"offset"`
+}
+
+// KongEntity admin api path of kong entity and its key in declarative config
+type KongEntity struct {
+	Uri string
+	Key string
+	// Parent entities are listed by parent, e.g. upstreams/{id}/targets
+	Parent string
+}
+
+// KongEntities in dependency order
+var KongEntities = []KongEntity{
+	{Uri: "ca_certificates", Key: "ca_certificates"},
+	{Uri: "certificates", Key: "certificates"},
+	{Uri: "snis", Key: "snis"},
+	{Uri: "services", Key: "services"},
+	{Uri: "routes", Key: "routes"},
+	{Uri: "upstreams", Key: "upstreams"},
+	{Uri: "targets", Key: "targets", Parent: "upstreams"},
+	{Uri: "consumers", Key: "consumers"},
+	{Uri: "key-auths", Key: "keyauth_credentials"},
+	{Uri: "basic-auths", Key: "basicauth_credentials"},
+	{Uri: "hmac-auths", Key: "hmacauth_credentials"},
+	{Uri: "jwts", Key: "jwt_secrets"},
+	{Uri: "acls", Key: "acls"},
+	{Uri: "oauth2", Key: "oauth2_credentials"},
+	{Uri: "plugins", Key: "plugins"},
+}
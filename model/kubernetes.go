@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package model
+
+type K8sObjectMeta struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace"`
+	Labels    map[string]string `json:"labels"`
+}
+
+type K8sServiceList struct {
+	Items []K8sService `json:"items"`
+}
+
+type K8sService struct {
+	Metadata K8sObjectMeta  `json:"metadata"`
+	Spec     K8sServiceSpec `json:"spec"`
+}
+
+type K8sServiceSpec struct {
+	Type     string            `json:"type"`
+	Selector map[string]string `json:"selector"`
+}
+
+type K8sEndpointSliceList struct {
+	Items []K8sEndpointSlice `json:"items"`
+}
+
+// K8sEndpointSlice discovery.k8s.io/v1 EndpointSlice
+type K8sEndpointSlice struct {
+	Metadata    K8sObjectMeta     `json:"metadata"`
+	AddressType string            `json:"addressType"`
+	Endpoints   []K8sEndpoint     `json:"endpoints"`
+	Ports       []K8sEndpointPort `json:"ports"`
+}
+
+type K8sEndpoint struct {
+	Addresses  []string              `json:"addresses"`
+	Conditions K8sEndpointConditions `json:"conditions"`
+	TargetRef  *K8sObjectReference   `json:"targetRef"`
+	NodeName   string                `json:"nodeName"`
+	Zone       string                `json:"zone"`
+}
+
+type K8sEndpointConditions struct {
+	Ready       *bool `json:"ready"`
+	Terminating *bool `json:"terminating"`
+}
+
+type K8sObjectReference struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+type K8sEndpointPort struct {
+	Name     string `json:"name"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+type K8sPodList struct {
+	Items []K8sPod `json:"items"`
+}
+
+type K8sPod struct {
+	Metadata K8sObjectMeta `json:"metadata"`
+}
+
+// KubeConfig the part of kubeconfig file which syncer used, exec and auth-provider are not supported
+type KubeConfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+			Username              string `yaml:"username"`
+			Password              string `yaml:"password"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
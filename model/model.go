@@ -19,8 +19,10 @@ import (
 )
 
 type Service struct {
-	Name      string
-	Instances []Instance
+	Name      string     `json:"name"`
+	Instances []Instance `json:"instances,omitempty"`
+	// Ext overrides target config when fetch instances, e.g. nacos namespaceId and groupName
+	Ext map[string]string `json:"ext,omitempty"`
 }
 
 type Instance struct {
@@ -34,8 +36,8 @@ type Instance struct {
 }
 
 type GetInstanceVo struct {
-	ServiceName string
-	ExtData     map[string]string
+	ServiceName string            `json:"serviceName"`
+	ExtData     map[string]string `json:"extData,omitempty"`
 }
 
 type Registration struct {
@@ -13,6 +13,8 @@
 
 package model
 
+import "encoding/json"
+
 type NacosInstanceResp struct {
 	Hosts []NacosInstance `json:"hosts"`
 }
@@ -23,13 +25,76 @@ type NacosInstance struct {
 	Weight      float32           `json:"weight"`
 	Metadata    map[string]string `json:"metadata"`
 	Enabled     bool              `json:"enabled,omitempty"`
+	Healthy     bool              `json:"healthy,omitempty"`
 	Ephemeral   bool              `json:"ephemeral,omitempty"`
 	NamespaceId string            `json:"namespaceId,omitempty"`
 	ClusterName string            `json:"clusterName,omitempty"`
 	GroupName   string            `json:"groupName,omitempty"`
 	ServiceName string            `json:"serviceName,omitempty"`
 }
+
+func (c *NacosInstance) UnmarshalJSON(data []byte) error {
+	// enabled and healthy are true if absent
+	*c = NacosInstance{Enabled: true, Healthy: true}
+
+	type plain NacosInstance
+	return json.Unmarshal(data, (*plain)(c))
+}
+
+// NacosInstancePolicy how to sync unhealthy or disabled instances
+type NacosInstancePolicy string
+
+const (
+	NACOS_POLICY_DROP        NacosInstancePolicy = "drop"
+	NACOS_POLICY_KEEP        NacosInstancePolicy = "keep"
+	NACOS_POLICY_ZERO_WEIGHT NacosInstancePolicy = "zero-weight"
+)
+
 type NacosServiceResp struct {
 	ServiceNames []string `json:"doms"`
+	Services     []string `json:"services"` // v2
 	Total        int      `json:"count"`
 }
+
+func (resp *NacosServiceResp) GetServiceNames() []string {
+	if len(resp.ServiceNames) == 0 {
+		return resp.Services
+	}
+	return resp.ServiceNames
+}
+
+// NacosV2Resp response of nacos v2 open api
+type NacosV2Resp struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// NacosLoginResp POST /nacos/v1/auth/login
+type NacosLoginResp struct {
+	AccessToken string `json:"accessToken"`
+	TokenTtl    int64  `json:"tokenTtl"`
+	GlobalAdmin bool   `json:"globalAdmin"`
+}
+
+// NacosCatalogServiceResp GET /nacos/v1/ns/catalog/services
+type NacosCatalogServiceResp struct {
+	Count       int                   `json:"count"`
+	ServiceList []NacosCatalogService `json:"serviceList"`
+}
+
+type NacosCatalogService struct {
+	Name      string `json:"name"`
+	GroupName string `json:"groupName"`
+}
+
+// NacosNamespaceResp GET /nacos/v1/console/namespaces
+type NacosNamespaceResp struct {
+	Code int              `json:"code"`
+	Data []NacosNamespace `json:"data"`
+}
+
+type NacosNamespace struct {
+	Namespace         string `json:"namespace"`
+	NamespaceShowName string `json:"namespaceShowName"`
+}
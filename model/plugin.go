@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+type PluginKind string
+
+const (
+	DISCOVERY_PLUGIN PluginKind = "discovery"
+	GATEWAY_PLUGIN   PluginKind = "gateway"
+)
+
+// Plugin external executable, registered as a discovery or gateway type by name,
+// each call runs the executable with PluginRequest in stdin and reads PluginResponse from stdout
+type Plugin struct {
+	Kind    PluginKind        `yaml:"kind"`
+	Path    string            `yaml:"path"`
+	Args    []string          `yaml:"args,omitempty"`
+	Env     map[string]string `yaml:"env,omitempty"`
+	Timeout time.Duration     `yaml:"timeout,omitempty"`
+}
+
+func (c *Plugin) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = Plugin{Timeout: 30 * time.Second}
+
+	type plain Plugin
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if len(c.Path) == 0 {
+		return errors.New("plugin path must not null")
+	}
+	if c.Timeout <= 0 {
+		return errors.New("plugin timeout must greater than 0")
+	}
+	switch c.Kind {
+	case DISCOVERY_PLUGIN, GATEWAY_PLUGIN:
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("invalid plugin kind:%s, discovery or gateway", c.Kind))
+	}
+}
+
+// PluginRequest stdin of plugin, server is the discovery or gateway config,
+// params are the arguments of DiscoveryClient or GatewayClient method
+type PluginRequest struct {
+	Method string      `json:"method"`
+	Server interface{} `json:"server"`
+	Params interface{} `json:"params,omitempty"`
+}
+
+// PluginResponse stdout of plugin, error is not empty if failed
+type PluginResponse struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
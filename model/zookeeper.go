@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2022 The AnJia Authors.
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package model
+
+type ZookeeperLayout string
+
+const (
+	// ZK_DUBBO_LAYOUT /dubbo/<interface>/providers/<provider url>
+	ZK_DUBBO_LAYOUT ZookeeperLayout = "dubbo"
+	// ZK_DUBBO3_LAYOUT /services/<application>/<ip:port>, dubbo3 application-level service discovery
+	ZK_DUBBO3_LAYOUT ZookeeperLayout = "dubbo3"
+	// ZK_SPRING_CLOUD_LAYOUT /services/<name>/<id>, spring cloud zookeeper
+	ZK_SPRING_CLOUD_LAYOUT ZookeeperLayout = "spring-cloud"
+)
+
+// CuratorServiceInstance org.apache.curator.x.discovery.ServiceInstance,
+// used by both dubbo3 and spring cloud zookeeper
+type CuratorServiceInstance struct {
+	Name    string                 `json:"name"`
+	Id      string                 `json:"id"`
+	Address string                 `json:"address"`
+	Port    int                    `json:"port"`
+	SslPort int                    `json:"sslPort"`
+	Enabled *bool                  `json:"enabled"`
+	Payload CuratorInstancePayload `json:"payload"`
+}
+
+type CuratorInstancePayload struct {
+	Id       string            `json:"id"`
+	Name     string            `json:"name"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// DubboEndpoint element of dubbo3 metadata "dubbo.endpoints"
+type DubboEndpoint struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}